@@ -0,0 +1,211 @@
+// annbench compares recall and latency of the HNSW vector index against the exact scan.
+//
+//	go run ./cmd/annbench -n 20000 -dim 768 -ef 16,32,64,128
+//
+// The corpus is synthetic: clustered gaussian vectors, which is closer to real embeddings
+// than uniform noise. "sqlite-style scan" decodes a gob blob per row and runs cosine on it
+// the way retrieval worked before the index, "brute force" is the index's exact fallback.
+// The int8 and pq rows scan quantized codes and re-score the top k*rescore candidates exactly,
+// the way quantized tabs are searched.
+package main
+
+import (
+	"bytes"
+	"context-aware-ai/services"
+	"encoding/gob"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func main() {
+	n := flag.Int("n", 10000, "vectors in the corpus")
+	dim := flag.Int("dim", 768, "embedding dimensions")
+	queries := flag.Int("queries", 200, "queries to average over")
+	k := flag.Int("k", 10, "neighbours per query")
+	clusters := flag.Int("clusters", 50, "gaussian clusters in the synthetic corpus")
+	m := flag.Int("m", 16, "HNSW M")
+	efc := flag.Int("efc", 200, "HNSW ef construction")
+	efs := flag.String("ef", "16,32,64,128,256", "comma separated ef search values to try")
+	rescore := flag.Int("rescore", 4, "int8 candidates per result to re-score exactly")
+	pqRescore := flag.Int("pq-rescore", 20, "pq candidates per result to re-score exactly")
+	flag.Parse()
+
+	rng := rand.New(rand.NewSource(42))
+	corpus := syntheticVectors(rng, *n, *dim, *clusters)
+	qs := syntheticVectors(rng, *queries, *dim, *clusters)
+	fmt.Printf("corpus %d x %d, %d queries, k=%d\n\n", *n, *dim, *queries, *k)
+
+	//exact answers double as the brute force timing
+	exact := &services.VectorIndex{MinGraphSize: math.MaxInt}
+	for i, v := range corpus {
+		exact.Add(services.KindDocuments, 1, 1, uint(i+1), services.NormalizeEmbedding(v))
+	}
+	truth := make([][]services.VectorHit, len(qs))
+	bruteLat := measure(qs, func(i int, q []float64) {
+		truth[i] = exact.Search(services.KindDocuments, 1, 1, services.NormalizeEmbedding(q), *k)
+	})
+
+	blobs := make([][]byte, len(corpus))
+	for i, v := range corpus {
+		var buf bytes.Buffer
+		_ = gob.NewEncoder(&buf).Encode(v)
+		blobs[i] = buf.Bytes()
+	}
+	scanLat := measure(qs, func(i int, q []float64) {
+		scan(blobs, q, *k)
+	})
+
+	start := time.Now()
+	graph := &services.VectorIndex{MinGraphSize: 1, Config: services.HNSWConfig{M: *m, EfConstruction: *efc}}
+	for i, v := range corpus {
+		graph.Add(services.KindDocuments, 1, 1, uint(i+1), services.NormalizeEmbedding(v))
+	}
+	fmt.Printf("hnsw build (M=%d, efc=%d): %s\n", *m, *efc, time.Since(start).Round(time.Millisecond))
+
+	unit := make(map[uint][]float32, len(corpus))
+	for i, v := range corpus {
+		unit[uint(i+1)] = services.NormalizeEmbedding(v)
+	}
+	quantized := map[services.QuantizationMode]*services.VectorIndex{}
+	for _, mode := range []services.QuantizationMode{services.QuantizationInt8, services.QuantizationPQ} {
+		start := time.Now()
+		idx := &services.VectorIndex{}
+		idx.SetQuantization(services.KindDocuments, 1, 1, mode, unit)
+		quantized[mode] = idx
+		fmt.Printf("%s build: %s\n", mode, time.Since(start).Round(time.Millisecond))
+	}
+	fmt.Println()
+
+	fmt.Printf("%-24s %8s %12s %12s\n", "method", "recall", "mean", "p95")
+	printRow("sqlite-style scan", 1, scanLat)
+	printRow("brute force", 1, bruteLat)
+	for _, f := range strings.Split(*efs, ",") {
+		ef, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			continue
+		}
+		graph.Config.EfSearch = ef
+		results := make([][]services.VectorHit, len(qs))
+		lat := measure(qs, func(i int, q []float64) {
+			results[i] = graph.Search(services.KindDocuments, 1, 1, services.NormalizeEmbedding(q), *k)
+		})
+		printRow(fmt.Sprintf("hnsw ef=%d", ef), recall(truth, results), lat)
+	}
+	for _, mode := range []services.QuantizationMode{services.QuantizationInt8, services.QuantizationPQ} {
+		factor := *rescore
+		if mode == services.QuantizationPQ {
+			factor = *pqRescore
+		}
+		idx := quantized[mode]
+		results := make([][]services.VectorHit, len(qs))
+		lat := measure(qs, func(i int, q []float64) {
+			qv := services.NormalizeEmbedding(q)
+			cands := idx.Search(services.KindDocuments, 1, 1, qv, *k*factor)
+			results[i] = rescoreExact(cands, unit, qv, *k)
+		})
+		printRow(fmt.Sprintf("%s + rescore x%d", mode, factor), recall(truth, results), lat)
+	}
+}
+
+//what the sqlite store does with quantized candidates, minus reading the rows back
+func rescoreExact(cands []services.VectorHit, vecs map[uint][]float32, q []float32, k int) []services.VectorHit {
+	hits := make([]services.VectorHit, len(cands))
+	for i, c := range cands {
+		var dot float32
+		for j, v := range vecs[c.ID] {
+			dot += q[j] * v
+		}
+		hits[i] = services.VectorHit{ID: c.ID, Score: float64(dot)}
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].Score > hits[j].Score })
+	if len(hits) > k {
+		hits = hits[:k]
+	}
+	return hits
+}
+
+func syntheticVectors(rng *rand.Rand, n, dim, clusters int) [][]float64 {
+	centers := make([][]float64, clusters)
+	r := rand.New(rand.NewSource(7))
+	for c := range centers {
+		centers[c] = make([]float64, dim)
+		for d := range centers[c] {
+			centers[c][d] = r.NormFloat64()
+		}
+	}
+	out := make([][]float64, n)
+	for i := range out {
+		center := centers[rng.Intn(clusters)]
+		out[i] = make([]float64, dim)
+		for d := range out[i] {
+			out[i][d] = center[d] + rng.NormFloat64()*0.6
+		}
+	}
+	return out
+}
+
+//the pre-index retrieval path: decode every row and cosine it against the query
+func scan(blobs [][]byte, q []float64, k int) {
+	scores := make([]float64, len(blobs))
+	for i, b := range blobs {
+		var v []float64
+		_ = gob.NewDecoder(bytes.NewReader(b)).Decode(&v)
+		var dot, na, nb float64
+		for j := range v {
+			dot += q[j] * v[j]
+			na += q[j] * q[j]
+			nb += v[j] * v[j]
+		}
+		scores[i] = dot / (math.Sqrt(na) * math.Sqrt(nb))
+	}
+	sort.Float64s(scores)
+	_ = scores[len(scores)-min(k, len(scores)):]
+}
+
+func measure(qs [][]float64, fn func(i int, q []float64)) []time.Duration {
+	lat := make([]time.Duration, len(qs))
+	for i, q := range qs {
+		start := time.Now()
+		fn(i, q)
+		lat[i] = time.Since(start)
+	}
+	return lat
+}
+
+func recall(truth, got [][]services.VectorHit) float64 {
+	var found, total int
+	for i := range truth {
+		want := map[uint]bool{}
+		for _, h := range truth[i] {
+			want[h.ID] = true
+		}
+		for _, h := range got[i] {
+			if want[h.ID] {
+				found++
+			}
+		}
+		total += len(truth[i])
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(found) / float64(total)
+}
+
+func printRow(name string, recall float64, lat []time.Duration) {
+	sorted := append([]time.Duration(nil), lat...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var sum time.Duration
+	for _, l := range sorted {
+		sum += l
+	}
+	mean := sum / time.Duration(len(sorted))
+	p95 := sorted[len(sorted)*95/100]
+	fmt.Printf("%-24s %8.3f %12s %12s\n", name, recall, mean.Round(time.Microsecond), p95.Round(time.Microsecond))
+}
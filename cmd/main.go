@@ -8,6 +8,9 @@ import (
 	"github.com/gin-gonic/gin"
 	"context-aware-ai/loadenv"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func main() {
@@ -15,21 +18,155 @@ func main() {
 	_ = loadenv.LoadEnv("")
 	//took out the other check because it breaks if dockerized 
 	//but this will check if set
-	jwtSecretKey := os.Getenv("JWT_SECRET_KEY")
-	if jwtSecretKey == "" {
-		log.Fatal("JWT_SECRET_KEY not set in .env file")
+	//HS256 with JWT_SECRET_KEY unless JWT_ALGORITHM picks RS256 or EdDSA
+	jwtKeys, err := services.NewJWTKeys(services.JWTConfig{
+		Algorithm:        os.Getenv("JWT_ALGORITHM"),
+		KeyID:            os.Getenv("JWT_KEY_ID"),
+		Issuer:           os.Getenv("JWT_ISSUER"),
+		Secret:           os.Getenv("JWT_SECRET_KEY"),
+		PreviousSecrets:  os.Getenv("JWT_PREVIOUS_SECRETS"),
+		PrivateKeyFile:   os.Getenv("JWT_PRIVATE_KEY_FILE"),
+		PreviousKeyFiles: os.Getenv("JWT_PREVIOUS_PUBLIC_KEYS"),
+	})
+	if err != nil {
+		log.Fatal("Invalid JWT configuration: ", err)
 	}
 
 	db.Init()
-	memoryService := &services.MemoryService{DB: db.DB}
+	//rows written before the binary codec are converted once, later runs find nothing to do
+	if n, err := services.MigrateEmbeddings(db.DB); err != nil {
+		log.Fatal("Failed to migrate embeddings:", err)
+	} else if n > 0 {
+		log.Printf("converted %d embeddings to the binary format", n)
+	}
+	keywordIndex := &services.KeywordIndex{DB: db.DB}
+	//the default store keeps embeddings in sqlite with an in-process index,
+	//the others move them to a vector database
+	var vectorStore services.VectorStore
+	switch os.Getenv("VECTOR_STORE") {
+	case "", "sqlite":
+		sqliteStore := &services.SQLiteVectorStore{
+			DB: db.DB,
+			Index: &services.VectorIndex{
+				Config: services.HNSWConfig{
+					M:              envInt("HNSW_M", 16),
+					EfConstruction: envInt("HNSW_EF_CONSTRUCTION", 200),
+					EfSearch:       envInt("HNSW_EF_SEARCH", 64),
+				},
+				//tabs below this are scanned exactly, the graph only pays off once they grow
+				MinGraphSize: envInt("HNSW_MIN_SIZE", 1000),
+			},
+			RescoreFactor:   envInt("QUANTIZATION_RESCORE_FACTOR", 4),
+			PQRescoreFactor: envInt("PQ_RESCORE_FACTOR", 20),
+		}
+		if err := sqliteStore.Load(); err != nil {
+			log.Fatal("Failed to build vector index:", err)
+		}
+		vectorStore = sqliteStore
+	case "pgvector":
+		pgStore, err := services.NewPgVectorStore(os.Getenv("PGVECTOR_DSN"))
+		if err != nil {
+			log.Fatal("Failed to connect to pgvector:", err)
+		}
+		vectorStore = pgStore
+	case "qdrant":
+		vectorStore = &services.QdrantStore{
+			BaseURL: os.Getenv("QDRANT_URL"),
+			APIKey:  os.Getenv("QDRANT_API_KEY"),
+			Prefix:  os.Getenv("QDRANT_COLLECTION_PREFIX"),
+		}
+	case "memory":
+		vectorStore = &services.MemoryVectorStore{}
+	default:
+		log.Fatal("Unknown vector store")
+	}
+	//copies the existing sqlite embeddings over, only needed once after switching stores
+	if os.Getenv("VECTOR_STORE_BACKFILL") == "true" {
+		n, err := services.BackfillVectorStore(db.DB, vectorStore)
+		if err != nil {
+			log.Fatal("Failed to backfill vector store:", err)
+		}
+		log.Printf("backfilled %d embeddings into the vector store", n)
+	}
+	memoryService := &services.MemoryService{DB: db.DB, KeywordIndex: keywordIndex, VectorStore: vectorStore}
 	tabService := &services.TabService{DB: db.DB}
-	userService := &services.UserService{DB: db.DB}
+	userService := &services.UserService{
+		DB: db.DB,
+		Policy: services.PasswordPolicy{
+			MinLength:  envInt("PASSWORD_MIN_LENGTH", 8),
+			MinClasses: envInt("PASSWORD_MIN_CLASSES", 0),
+		},
+	}
+	refreshTokens := &services.RefreshTokenService{
+		DB:  db.DB,
+		TTL: time.Duration(envInt("REFRESH_TOKEN_TTL_HOURS", 30*24)) * time.Hour,
+	}
+	//records past their expiry are useless, reuse detection only needs the live ones
+	if err := refreshTokens.PurgeExpired(); err != nil {
+		log.Printf("purging expired refresh tokens: %v", err)
+	}
+	apiKeys := &services.APIKeyService{DB: db.DB}
+	//the first admin comes from the environment, later ones are promoted through /admin/users/:id/role
+	if name := os.Getenv("ADMIN_USERNAME"); name != "" {
+		if _, err := userService.EnsureAdmin(name, os.Getenv("ADMIN_PASSWORD")); err != nil {
+			log.Fatal("Failed to set up the admin user: ", err)
+		}
+	}
 	ollamaService := &services.OllamaService{
 		BaseURL:        os.Getenv("OLLAMA_BASE_URL"),
 		GenerateModel:  os.Getenv("OLLAMA_GENERATE_MODEL"),
 		EmbeddingModel: os.Getenv("OLLAMA_EMBEDDING_MODEL"),
+		RerankModel:    os.Getenv("OLLAMA_RERANK_MODEL"),
+	}
+	//embeddings default to ollama but can come from any provider with an embeddings api
+	var embeddingProvider services.EmbeddingService
+	var embeddingModel string
+	switch os.Getenv("EMBEDDING_PROVIDER") {
+	case "", "ollama":
+		embeddingProvider = ollamaService
+		embeddingModel = "ollama/" + ollamaService.EmbeddingModel
+	case "openai":
+		embeddingProvider = &services.OpenAIService{
+			APIKey:         os.Getenv("OPENAI_API_KEY"),
+			EmbeddingModel: os.Getenv("OPENAI_EMBEDDING_MODEL"),
+		}
+		embeddingModel = "openai/" + os.Getenv("OPENAI_EMBEDDING_MODEL")
+	case "gemini":
+		embeddingProvider = &services.GeminiService{
+			APIKey:         os.Getenv("GEMINI_API_KEY"),
+			EmbeddingModel: os.Getenv("GEMINI_EMBEDDING_MODEL"),
+		}
+		embeddingModel = "gemini/" + os.Getenv("GEMINI_EMBEDDING_MODEL")
+	default:
+		log.Fatal("Unknown embedding provider")
+	}
+	//every embedding goes through the cache so repeated chunks and questions are only embedded once
+	embeddingCache := &services.EmbeddingCache{
+		Inner:    embeddingProvider,
+		DB:       db.DB,
+		Model:    embeddingModel,
+		Capacity: envInt("EMBEDDING_CACHE_SIZE", 10000),
+	}
+	var embeddingService services.EmbeddingService = embeddingCache
+	ragService := &services.RAGService{
+		DB:               db.DB,
+		EmbeddingService: embeddingService,
+		BatchSize:        envInt("EMBEDDING_BATCH_SIZE", 32),
+		KeywordIndex:     keywordIndex,
+		VectorStore:      vectorStore,
+		Rerankers:        map[string]services.Reranker{},
+		RerankCandidates: envInt("RERANK_CANDIDATES", 20),
+		RerankTimeout:    time.Duration(envInt("RERANK_TIMEOUT_MS", 10000)) * time.Millisecond,
+	}
+	ingestionService := &services.IngestionService{
+		DB:          db.DB,
+		RAGService:  ragService,
+		Workers:     envInt("INGEST_WORKERS", 4),
+		MaxAttempts: envInt("INGEST_MAX_ATTEMPTS", 3),
+	}
+	if err := ingestionService.Start(); err != nil {
+		log.Fatal("Failed to start ingestion workers:", err)
 	}
-	ragService := &services.RAGService{ DB: db.DB, OllamaService: ollamaService, }
 	var llmService services.LLMService
 	llmProvider := os.Getenv("LLM_PROVIDER")
 	switch llmProvider {
@@ -56,39 +193,191 @@ func main() {
 	default:
 		log.Fatal("Unknown LLM provider")
 	}
+	//LLM_PRICES is "model=input:output,..." per million tokens, unpriced models are counted at 0
+	prices, err := services.ParsePrices(os.Getenv("LLM_PRICES"))
+	if err != nil {
+		log.Fatalf("LLM_PRICES: %v", err)
+	}
+	usageService := &services.UsageService{
+		DB:     db.DB,
+		Prices: prices,
+		Defaults: services.UsageLimits{
+			DailyTokens:   int64(envInt("QUOTA_DAILY_TOKENS", 0)),
+			MonthlyTokens: int64(envInt("QUOTA_MONTHLY_TOKENS", 0)),
+			DailyCost:     envFloat("QUOTA_DAILY_COST", 0),
+			MonthlyCost:   envFloat("QUOTA_MONTHLY_COST", 0),
+		},
+	}
+	//tabs opt into a reranker with PUT /tabs/:id/rerank
+	ragService.Rerankers[services.RerankerLLM] = &services.LLMReranker{LLM: llmService, Usage: usageService}
+	if ollamaService.RerankModel != "" {
+		ragService.Rerankers[services.RerankerOllama] = ollamaService
+	}
 
+	registration := os.Getenv("REGISTRATION_MODE")
+	switch registration {
+	case "":
+		registration = handlers.RegistrationOpen
+	case handlers.RegistrationOpen, handlers.RegistrationInvite, handlers.RegistrationDisabled:
+	default:
+		log.Fatal("REGISTRATION_MODE must be open, invite or disabled")
+	}
+	//RATE_LIMIT_* take "<n>/<s|m|h>[,burst]" or "off"
+	rateLimit := func(key, def string) *services.RateLimiter {
+		spec, ok := os.LookupEnv(key)
+		if !ok {
+			spec = def
+		}
+		l, err := services.ParseRateLimit(spec)
+		if err != nil {
+			log.Fatalf("%s: %v", key, err)
+		}
+		return l
+	}
+	limits := handlers.RateLimits{
+		IP:     rateLimit("RATE_LIMIT_IP", "600/m,100"),
+		Login:  rateLimit("RATE_LIMIT_LOGIN", "20/m,10"),
+		Chat:   rateLimit("RATE_LIMIT_CHAT", "30/m,10"),
+		Upload: rateLimit("RATE_LIMIT_UPLOAD", "60/h,10"),
+		Search: rateLimit("RATE_LIMIT_SEARCH", "120/m,30"),
+	}
+	loginThrottle := &services.LoginThrottle{
+		Free: envInt("LOGIN_FREE_ATTEMPTS", 5),
+		Base: time.Duration(envInt("LOGIN_LOCKOUT_BASE_SECONDS", 30)) * time.Second,
+		Max:  time.Duration(envInt("LOGIN_LOCKOUT_MAX_SECONDS", 3600)) * time.Second,
+	}
+	auth := &handlers.Auth{JWTKeys: jwtKeys, UserService: userService, APIKeys: apiKeys}
 	chatHandler := &handlers.ChatHandler{
 		MemoryService: memoryService,
 		TabService:    tabService,
 		UserService:   userService,
-		OllamaService: ollamaService,
+		EmbeddingService: embeddingService,
+		EmbeddingCache:   embeddingCache,
 		LLMService:    llmService,
 		RAGService :	ragService,
+		IngestionService: ingestionService,
 		TopK:          3,
-		JWTSecret:     []byte(jwtSecretKey),
+		KeywordWeight: envFloat("HYBRID_KEYWORD_WEIGHT", 0.3),
+		MMRLambda:     envFloat("MMR_LAMBDA", 0.5),
+		MergeAdjacent: os.Getenv("MERGE_ADJACENT_CHUNKS") == "true",
+		DocumentMinScore: envFloat("DOCUMENT_MIN_SCORE", 0),
+		MemoryMinScore:   envFloat("MEMORY_MIN_SCORE", 0),
+		QueryRewriter:    &services.QueryRewriter{LLM: llmService},
+		QueryPlan: services.QueryPlan{
+			Rewrite:     os.Getenv("QUERY_REWRITE") == "true",
+			Paraphrases: envInt("QUERY_PARAPHRASES", 0),
+			HyDE:        os.Getenv("QUERY_HYDE") == "true",
+		},
+		RewriteTurns: envInt("QUERY_REWRITE_TURNS", 3),
+		Auth:          auth,
+		RefreshTokens: refreshTokens,
+		Registration:  registration,
+		Limits:        limits,
+		LoginThrottle: loginThrottle,
+		Usage:         usageService,
 	}
 
 	r := gin.Default()
+	//X-Forwarded-For is only believed from these, otherwise anyone could pick the IP they are limited as
+	var proxies []string
+	if v := os.Getenv("TRUSTED_PROXIES"); v != "" {
+		proxies = strings.Split(v, ",")
+	}
+	if err := r.SetTrustedProxies(proxies); err != nil {
+		log.Fatalf("TRUSTED_PROXIES: %v", err)
+	}
 
 	//for when the frontend is created
 	r.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key")
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
 			return
 		}
 		c.Next()
 	})
+	r.Use(handlers.LimitByIP(limits.IP))
 
-	chatHandler.SetupRoutes(r)
 	fileHandler := &handlers.FileHandler{
-		RAGService:  ragService,
-		ChatHandler: chatHandler,
+		RAGService:       ragService,
+		TabService:       tabService,
+		Auth:             auth,
+		IngestionService: ingestionService,
+		UploadLimit:      limits.Upload,
+		MaxUploadSize:    int64(envInt("MAX_UPLOAD_SIZE", 50<<20)),
+		//keep single files and whole archives to something we can hold in memory
+		RepoLoader: &services.RepoLoader{
+			MaxFileSize:  1 << 20,
+			MaxTotalSize: 200 << 20,
+		},
+	}
+	searchHandler := &handlers.SearchHandler{ChatHandler: chatHandler}
+	apiKeyHandler := &handlers.APIKeyHandler{Auth: auth, APIKeys: apiKeys}
+	adminHandler := &handlers.AdminHandler{ChatHandler: chatHandler}
+	usageHandler := &handlers.UsageHandler{ChatHandler: chatHandler}
+	//single sign-on is only offered when a provider is configured
+	var oidcHandler *handlers.OIDCHandler
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		scopes := strings.Fields(strings.ReplaceAll(os.Getenv("OIDC_SCOPES"), ",", " "))
+		oidcService := &services.OIDCService{
+			DB: db.DB,
+			Config: services.OIDCConfig{
+				Issuer:       issuer,
+				ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+				ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+				RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+				Scopes:       scopes,
+				//by default only open registration lets new provider accounts in
+				AutoProvision:  registration == handlers.RegistrationOpen,
+				AllowedDomains: strings.Fields(strings.ReplaceAll(os.Getenv("OIDC_ALLOWED_DOMAINS"), ",", " ")),
+			},
+		}
+		switch os.Getenv("OIDC_AUTO_PROVISION") {
+		case "true":
+			oidcService.Config.AutoProvision = true
+		case "false":
+			oidcService.Config.AutoProvision = false
+		}
+		if oidcService.Config.ClientID == "" || oidcService.Config.RedirectURL == "" {
+			log.Fatal("OIDC_CLIENT_ID and OIDC_REDIRECT_URL are required with OIDC_ISSUER")
+		}
+		if err := oidcService.PurgeExpired(); err != nil {
+			log.Printf("purging expired oidc logins: %v", err)
+		}
+		oidcHandler = &handlers.OIDCHandler{ChatHandler: chatHandler, OIDC: oidcService}
+	}
+	//the unversioned paths stay as aliases of /api/v1 for existing clients
+	for _, router := range []gin.IRouter{r.Group("/api/v1"), r} {
+		chatHandler.SetupRoutes(router)
+		fileHandler.SetupRoutes(router)
+		searchHandler.SetupRoutes(router)
+		apiKeyHandler.SetupRoutes(router)
+		adminHandler.SetupRoutes(router)
+		usageHandler.SetupRoutes(router)
+		if oidcHandler != nil {
+			oidcHandler.SetupRoutes(router)
+		}
 	}
-	fileHandler.SetupRoutes(r)
 	if err := r.Run(":3000"); err != nil {
 		log.Fatal(err)
 	}
 }
+
+//optional numeric settings fall back to the default when unset or malformed
+func envInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func envFloat(key string, def float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context-aware-ai/handlers"
+	"context-aware-ai/models"
+	"context-aware-ai/services"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// env is the mock provider and the server's SSO routes, each on its own httptest server
+type env struct {
+	provider *provider
+	idp      *httptest.Server
+	app      *httptest.Server
+	db       *gorm.DB
+	oidc     *services.OIDCService
+	browser  *http.Client
+}
+
+// newBrowser keeps cookies like a browser but leaves the redirects to the test, so each step can be
+// checked or tampered with
+func newBrowser(t *testing.T) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Jar: jar, CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+}
+
+func newEnv(t *testing.T) *env {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	p, err := newProvider("", "local", "", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := httptest.NewServer(p.handler())
+	t.Cleanup(idp.Close)
+	p.issuer = idp.URL
+
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, _ := db.DB()
+	//every connection to :memory: is its own database
+	sqlDB.SetMaxOpenConns(1)
+	if err := db.AutoMigrate(&models.User{}, &models.RefreshToken{}, &models.ExternalIdentity{}, &models.OIDCLoginState{}); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := services.NewJWTKeys(services.JWTConfig{Secret: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := &services.UserService{DB: db}
+	ch := &handlers.ChatHandler{
+		UserService:   users,
+		Auth:          &handlers.Auth{JWTKeys: keys, UserService: users},
+		RefreshTokens: &services.RefreshTokenService{DB: db},
+		Registration:  handlers.RegistrationOpen,
+	}
+	oidc := &services.OIDCService{
+		DB: db,
+		Config: services.OIDCConfig{
+			Issuer:        idp.URL,
+			ClientID:      "local",
+			AutoProvision: true,
+		},
+	}
+	r := gin.New()
+	(&handlers.OIDCHandler{ChatHandler: ch, OIDC: oidc}).SetupRoutes(r)
+	app := httptest.NewServer(r)
+	t.Cleanup(app.Close)
+	oidc.Config.RedirectURL = app.URL + "/auth/oidc/callback"
+
+	return &env{provider: p, idp: idp, app: app, db: db, oidc: oidc, browser: newBrowser(t)}
+}
+
+// authorize starts a login at the server and lets the provider approve it, returning the
+// callback URL the browser would be sent to
+func (e *env) authorize(t *testing.T, loginHint string) string {
+	t.Helper()
+	resp, err := e.browser.Get(e.app.URL + "/auth/oidc/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("login: got %d, want 302", resp.StatusCode)
+	}
+	authURL := resp.Header.Get("Location")
+	if !strings.HasPrefix(authURL, e.idp.URL+"/authorize?") {
+		t.Fatalf("login redirected to %q, not the provider", authURL)
+	}
+	if loginHint != "" {
+		authURL += "&login_hint=" + url.QueryEscape(loginHint)
+	}
+
+	resp, err = e.browser.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: got %d, want 302", resp.StatusCode)
+	}
+	callback := resp.Header.Get("Location")
+	if !strings.HasPrefix(callback, e.app.URL+"/auth/oidc/callback?") {
+		t.Fatalf("provider redirected to %q, not the callback", callback)
+	}
+	return callback
+}
+
+// callback follows the provider's redirect in browser and decodes the JSON answer
+func (e *env) callback(t *testing.T, browser *http.Client, callbackURL string) (int, map[string]interface{}) {
+	t.Helper()
+	resp, err := browser.Get(callbackURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("callback: decoding response: %v", err)
+	}
+	return resp.StatusCode, body
+}
+
+func mustParse(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func codeOf(t *testing.T, callbackURL string) string {
+	t.Helper()
+	return mustParse(t, callbackURL).Query().Get("code")
+}
+
+func TestLoginFlow(t *testing.T) {
+	e := newEnv(t)
+
+	status, body := e.callback(t, e.browser, e.authorize(t, ""))
+	if status != http.StatusOK {
+		t.Fatalf("callback: got %d %v, want 200", status, body)
+	}
+	if body["access_token"] == "" || body["refresh_token"] == "" {
+		t.Fatalf("callback returned no tokens: %v", body)
+	}
+	user, _ := body["user"].(map[string]interface{})
+	if user["UserName"] != "alice" {
+		t.Fatalf("got user %v, want alice", user)
+	}
+
+	//the second login is the same account, not a new alice-2
+	status, body = e.callback(t, e.browser, e.authorize(t, ""))
+	if status != http.StatusOK {
+		t.Fatalf("second callback: got %d %v, want 200", status, body)
+	}
+	again, _ := body["user"].(map[string]interface{})
+	if again["ID"] != user["ID"] {
+		t.Fatalf("second login got user %v, want %v", again["ID"], user["ID"])
+	}
+}
+
+func TestReplayedState(t *testing.T) {
+	e := newEnv(t)
+
+	callback := e.authorize(t, "")
+	cookies := e.browser.Jar.Cookies(mustParse(t, e.app.URL+"/auth/oidc/callback"))
+	if status, body := e.callback(t, e.browser, callback); status != http.StatusOK {
+		t.Fatalf("callback: got %d %v, want 200", status, body)
+	}
+	//even with the state cookie back in place the server has already used up the state
+	e.browser.Jar.SetCookies(mustParse(t, e.app.URL+"/auth/oidc/callback"), cookies)
+	status, body := e.callback(t, e.browser, callback)
+	if status != http.StatusBadRequest || body["error"] != "Login expired or already used, start again" {
+		t.Fatalf("replayed callback: got %d %v, want 400 for a used state", status, body)
+	}
+}
+
+func TestStateFromAnotherBrowser(t *testing.T) {
+	e := newEnv(t)
+
+	//the attacker starts a login for their own account and hands the callback to a victim
+	callback := e.authorize(t, "mallory")
+	if status, body := e.callback(t, newBrowser(t), callback); status != http.StatusBadRequest {
+		t.Fatalf("callback in another browser: got %d %v, want 400", status, body)
+	}
+	//nor is the state used up by the attempt
+	if status, body := e.callback(t, e.browser, callback); status != http.StatusOK {
+		t.Fatalf("callback in the starting browser: got %d %v, want 200", status, body)
+	}
+}
+
+func TestUnknownState(t *testing.T) {
+	e := newEnv(t)
+
+	callback := e.authorize(t, "")
+	u, _ := url.Parse(callback)
+	q := u.Query()
+	q.Set("state", "forged")
+	u.RawQuery = q.Encode()
+	if status, body := e.callback(t, e.browser, u.String()); status != http.StatusBadRequest {
+		t.Fatalf("forged state: got %d %v, want 400", status, body)
+	}
+}
+
+func TestNonceMismatch(t *testing.T) {
+	e := newEnv(t)
+
+	callback := e.authorize(t, "")
+	//the provider signs an ID token for another login's nonce
+	code := codeOf(t, callback)
+	e.provider.mu.Lock()
+	g := e.provider.codes[code]
+	g.nonce = "someone-elses-nonce"
+	e.provider.codes[code] = g
+	e.provider.mu.Unlock()
+
+	if status, body := e.callback(t, e.browser, callback); status != http.StatusUnauthorized {
+		t.Fatalf("wrong nonce: got %d %v, want 401", status, body)
+	}
+}
+
+func TestPKCEMismatch(t *testing.T) {
+	e := newEnv(t)
+
+	callback := e.authorize(t, "")
+	//as if the code was intercepted and redeemed by someone without the verifier
+	err := e.db.Model(&models.OIDCLoginState{}).Where("1 = 1").Update("code_verifier", strings.Repeat("x", 64)).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, body := e.callback(t, e.browser, callback); status != http.StatusBadGateway {
+		t.Fatalf("wrong verifier: got %d %v, want 502", status, body)
+	}
+
+	//the provider itself refuses the exchange
+	callback = e.authorize(t, "")
+	resp, err := http.PostForm(e.idp.URL+"/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {"local"},
+		"code":          {codeOf(t, callback)},
+		"redirect_uri":  {e.oidc.Config.RedirectURL},
+		"code_verifier": {"not-the-verifier"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("token with wrong verifier: got %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestProvisioningDisabled(t *testing.T) {
+	e := newEnv(t)
+	e.oidc.Config.AutoProvision = false
+
+	if status, body := e.callback(t, e.browser, e.authorize(t, "bob")); status != http.StatusForbidden {
+		t.Fatalf("unknown account without provisioning: got %d %v, want 403", status, body)
+	}
+}
@@ -13,7 +13,8 @@ var DB *gorm.DB
 //remove log will add it back when switch to vectorized db
 func Init() {
 	var err error
-	DB, err = gorm.Open(sqlite.Open("memory.db"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent),})
+	//ingestion workers write concurrently so wait on the lock instead of failing with SQLITE_BUSY
+	DB, err = gorm.Open(sqlite.Open("memory.db?_busy_timeout=5000"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent),})
 	if err != nil {
 		log.Fatal("Failed to connect database:", err)
 	}
@@ -22,5 +23,19 @@ func Init() {
 		&models.Tab{}, 
 		&models.Memory{},
 		&models.Document{},
+		&models.IngestionJob{},
+		&models.IngestionChunk{},
+		&models.EmbeddingCacheEntry{},
+		&models.RefreshToken{},
+		&models.APIKey{},
+		&models.InviteCode{},
+		&models.ExternalIdentity{},
+		&models.OIDCLoginState{},
+		&models.UsageRecord{},
+		&models.UsageQuota{},
 	)
+	//documents from before they had a creation time get the time of the upload that made them
+	DB.Exec(`UPDATE documents SET created_at = COALESCE(
+		(SELECT created_at FROM ingestion_jobs WHERE ingestion_jobs.id = documents.job_id), CURRENT_TIMESTAMP)
+		WHERE created_at IS NULL`)
 }
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"context-aware-ai/services"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// registration modes for ChatHandler.Registration
+const (
+	RegistrationOpen     = "open"
+	RegistrationInvite   = "invite"
+	RegistrationDisabled = "disabled"
+)
+
+// how long ago an account without a password must have logged in to delete it or set a password
+const recentLoginWindow = 10 * time.Minute
+
+// picks a new password, ends every other session and hands back a fresh token pair
+func (ch *ChatHandler) ChangePasswordHandler(c *gin.Context) {
+	var input struct {
+		OldPassword string `json:"old_password"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	user := currentUser(c)
+	//single sign-on accounts have no old password to ask for, a fresh login stands in for it
+	if user.PasswordHash == "" && time.Since(tokenAuthTime(c)) > recentLoginWindow {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Log in again to set a password"})
+		return
+	}
+	if err := ch.UserService.ChangePassword(user.ID, input.OldPassword, input.NewPassword); err != nil {
+		respondUserError(c, err, "Error changing password")
+		return
+	}
+	if err := ch.RefreshTokens.RevokeAll(user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error revoking sessions"})
+		return
+	}
+
+	//reload for the bumped token version
+	user, err := ch.UserService.GetUserByID(user.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	accessToken, err := ch.GenerateSessionToken(user, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating access token"})
+		return
+	}
+	refreshToken, err := ch.GenerateRefreshToken(user, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating refresh token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"access_token":  accessToken,
+		"refresh_token": refreshToken,
+	})
+}
+
+// deletes the caller's account and everything in it, the password is asked again so a stolen token isn't enough
+func (ch *ChatHandler) DeleteAccountHandler(c *gin.Context) {
+	user := currentUser(c)
+	var input struct {
+		Password string `json:"password"`
+	}
+	//accounts without a password may leave the body out
+	if err := c.ShouldBindJSON(&input); err != nil && user.PasswordHash != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	if user.PasswordHash == "" {
+		//single sign-on accounts have no password to ask for, a fresh login stands in for it
+		if time.Since(tokenAuthTime(c)) > recentLoginWindow {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Log in again to delete the account"})
+			return
+		}
+	} else if valid, err := ch.UserService.CheckPassword(user.ID, input.Password); err != nil || !valid {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password"})
+		return
+	}
+	if msg := ch.deleteAccount(user.ID); msg != "" {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account and all its data deleted"})
+}
+
+// removes the user's rows in one transaction, then drops what the indexes still hold for their tabs
+func (ch *ChatHandler) deleteAccount(userID uint) string {
+	tabs, err := ch.TabService.GetTabs(userID)
+	if err != nil {
+		return "Error loading tabs"
+	}
+	//workers must not commit documents for the user's jobs while they are being deleted
+	err = ch.IngestionService.Exclusive(func() error {
+		return ch.UserService.DeleteAccount(userID)
+	})
+	if err != nil {
+		return "Error deleting account"
+	}
+	for _, tab := range tabs {
+		if err := ch.MemoryService.DropIndexes(userID, tab.ID); err != nil {
+			return "Error deleting memories from the vector store"
+		}
+		if err := ch.RAGService.DropIndexes(userID, tab.ID); err != nil {
+			return "Error deleting documents from the vector store"
+		}
+	}
+	return ""
+}
+
+// maps the errors of creating users and changing passwords to a response
+func respondUserError(c *gin.Context, err error, fallback string) {
+	switch {
+	case errors.Is(err, services.ErrWeakPassword):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrUserExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "Username already taken"})
+	case errors.Is(err, services.ErrInviteInvalid):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or used invite code"})
+	case errors.Is(err, services.ErrWrongPassword):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
+}
@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"context-aware-ai/models"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminHandler manages other users, every route needs an admin session
+type AdminHandler struct {
+	ChatHandler *ChatHandler //for tab deletion and token revocation
+}
+
+func (h *AdminHandler) SetupRoutes(router gin.IRouter) {
+	admin := router.Group("/admin", h.ChatHandler.Auth.Required(), h.ChatHandler.Auth.AdminOnly())
+	admin.GET("/users", h.ListUsers)
+	admin.POST("/users", h.CreateUser)
+	admin.GET("/users/:id", h.GetUser)
+	admin.PUT("/users/:id/role", h.SetRole)
+	admin.POST("/users/:id/disable", h.DisableUser)
+	admin.POST("/users/:id/enable", h.EnableUser)
+	admin.POST("/users/:id/reset-password", h.ResetPassword)
+	admin.DELETE("/users/:id", h.DeleteUser)
+	admin.GET("/users/:id/usage", h.GetUserUsage)
+	admin.PUT("/users/:id/quota", h.SetUserQuota)
+	admin.GET("/invites", h.ListInvites)
+	admin.POST("/invites", h.CreateInvite)
+}
+
+func (h *AdminHandler) ListUsers(c *gin.Context) {
+	users, err := h.ChatHandler.UserService.ListUsers()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error listing users"})
+		return
+	}
+
+	c.JSON(http.StatusOK, users)
+}
+
+// creates an account whatever the registration mode, the password policy still applies
+func (h *AdminHandler) CreateUser(c *gin.Context) {
+	var input struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Role     string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || input.Username == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if input.Role == "" {
+		input.Role = models.RoleUser
+	}
+	if input.Role != models.RoleAdmin && input.Role != models.RoleUser {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be admin or user"})
+		return
+	}
+
+	user, err := h.ChatHandler.UserService.CreateUser(input.Username, input.Password)
+	if err != nil {
+		respondUserError(c, err, "Error creating user")
+		return
+	}
+	if input.Role != models.RoleUser {
+		if err := h.ChatHandler.UserService.SetRole(user.ID, input.Role); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating role"})
+			return
+		}
+		user.Role = input.Role
+	}
+
+	c.JSON(http.StatusCreated, user)
+}
+
+func (h *AdminHandler) GetUser(c *gin.Context) {
+	user, ok := h.targetUser(c)
+	if !ok {
+		return
+	}
+
+	stats, err := h.ChatHandler.UserService.Stats(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error loading user statistics"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user": user, "stats": stats})
+}
+
+func (h *AdminHandler) SetRole(c *gin.Context) {
+	var input struct {
+		Role string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || (input.Role != models.RoleAdmin && input.Role != models.RoleUser) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be admin or user"})
+		return
+	}
+
+	user, ok := h.otherUser(c)
+	if !ok {
+		return
+	}
+
+	if err := h.ChatHandler.UserService.SetRole(user.ID, input.Role); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating role"})
+		return
+	}
+
+	user.Role = input.Role
+	c.JSON(http.StatusOK, user)
+}
+
+// the user can't log in or refresh and their access tokens and API keys stop working
+func (h *AdminHandler) DisableUser(c *gin.Context) {
+	user, ok := h.otherUser(c)
+	if !ok {
+		return
+	}
+
+	if err := h.ChatHandler.UserService.SetDisabled(user.ID, true); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error disabling user"})
+		return
+	}
+	if err := h.ChatHandler.RefreshTokens.RevokeAll(user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error revoking sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User disabled"})
+}
+
+func (h *AdminHandler) EnableUser(c *gin.Context) {
+	user, ok := h.targetUser(c)
+	if !ok {
+		return
+	}
+
+	if err := h.ChatHandler.UserService.SetDisabled(user.ID, false); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error enabling user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User enabled"})
+}
+
+// sets a temporary password and logs the user out everywhere, they are asked to change it after logging in
+func (h *AdminHandler) ResetPassword(c *gin.Context) {
+	user, ok := h.targetUser(c)
+	if !ok {
+		return
+	}
+
+	password, err := h.ChatHandler.UserService.ResetPassword(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error resetting password"})
+		return
+	}
+	if err := h.ChatHandler.RefreshTokens.RevokeAll(user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error revoking sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"temporary_password": password})
+}
+
+// deletes the user with every tab, memory, document, ingestion job, API key and refresh token in one transaction
+func (h *AdminHandler) DeleteUser(c *gin.Context) {
+	user, ok := h.otherUser(c)
+	if !ok {
+		return
+	}
+
+	if msg := h.ChatHandler.deleteAccount(user.ID); msg != "" {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User and all their data deleted"})
+}
+
+func (h *AdminHandler) ListInvites(c *gin.Context) {
+	invites, err := h.ChatHandler.UserService.ListInvites()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error listing invites"})
+		return
+	}
+
+	c.JSON(http.StatusOK, invites)
+}
+
+// CreateInvite makes a single use code for /create-user while registration is invite only
+func (h *AdminHandler) CreateInvite(c *gin.Context) {
+	var input struct {
+		// optional, codes without it don't expire
+		ExpiresInDays int `json:"expires_in_days"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || input.ExpiresInDays < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	var expiresAt *time.Time
+	if input.ExpiresInDays > 0 {
+		t := time.Now().AddDate(0, 0, input.ExpiresInDays)
+		expiresAt = &t
+	}
+	code, invite, err := h.ChatHandler.UserService.CreateInvite(currentUser(c).ID, expiresAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating invite"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"code": code, "invite": invite})
+}
+
+// loads the user named by :id, answering the request itself when that fails
+func (h *AdminHandler) targetUser(c *gin.Context) (*models.User, bool) {
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return nil, false
+	}
+	user, err := h.ChatHandler.UserService.GetUserByID(uint(userID))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return nil, false
+	}
+	return user, true
+}
+
+// like targetUser, but admins can't demote, disable or delete themselves and lock everyone out
+func (h *AdminHandler) otherUser(c *gin.Context) (*models.User, bool) {
+	user, ok := h.targetUser(c)
+	if ok && user.ID == currentUser(c).ID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Admins can't do this to their own account"})
+		return nil, false
+	}
+	return user, ok
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"context-aware-ai/services"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// APIKeyHandler manages a user's personal API keys, keys themselves can't reach these routes
+type APIKeyHandler struct {
+	Auth    *Auth
+	APIKeys *services.APIKeyService
+}
+
+func (h *APIKeyHandler) SetupRoutes(router gin.IRouter) {
+	keys := router.Group("/api-keys", h.Auth.Required())
+	keys.POST("", h.CreateKey)
+	keys.GET("", h.ListKeys)
+	keys.DELETE("/:id", h.RevokeKey)
+}
+
+func (h *APIKeyHandler) CreateKey(c *gin.Context) {
+	var input struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+		//optional, keys without it don't expire
+		ExpiresInDays int `json:"expires_in_days"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || input.Name == "" || len(input.Name) > 255 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if input.ExpiresInDays < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in_days can't be negative"})
+		return
+	}
+
+	user := currentUser(c)
+
+	var expiresAt *time.Time
+	if input.ExpiresInDays > 0 {
+		t := time.Now().AddDate(0, 0, input.ExpiresInDays)
+		expiresAt = &t
+	}
+	secret, key, err := h.APIKeys.Create(user.ID, input.Name, input.Scopes, expiresAt)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidScope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "scopes must be chosen from chat, upload and read"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating API key"})
+		return
+	}
+
+	//the only time the key is shown, only its hash is kept
+	c.JSON(http.StatusCreated, gin.H{"key": secret, "api_key": key})
+}
+
+func (h *APIKeyHandler) ListKeys(c *gin.Context) {
+	user := currentUser(c)
+
+	keys, err := h.APIKeys.List(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error listing API keys"})
+		return
+	}
+
+	c.JSON(http.StatusOK, keys)
+}
+
+func (h *APIKeyHandler) RevokeKey(c *gin.Context) {
+	user := currentUser(c)
+
+	keyID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key ID"})
+		return
+	}
+
+	if err := h.APIKeys.Revoke(user.ID, uint(keyID)); err != nil {
+		if errors.Is(err, services.ErrAPIKeyNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error revoking API key"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"context-aware-ai/models"
+	"context-aware-ai/services"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Auth resolves who is calling, from an access token or an API key, before the handler runs
+type Auth struct {
+	JWTKeys     *services.JWTKeys
+	UserService *services.UserService
+	APIKeys     *services.APIKeyService
+}
+
+const (
+	tokenTypeAccess  = "access"
+	tokenTypeRefresh = "refresh"
+
+	userContextKey     = "user"
+	apiKeyContextKey   = "api_key"
+	authTimeContextKey = "auth_time"
+)
+
+// typ and aud tell access and refresh tokens apart so one can't be used as the other,
+// the user id is the subject
+type tokenClaims struct {
+	Type string `json:"typ"`
+	//access tokens only, the user's TokenVersion when the token was issued
+	Version int `json:"ver,omitempty"`
+	//access tokens only, when the user logged in. Refreshing keeps it, unlike iat
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Required authenticates the request and puts the user in the context for currentUser.
+// API keys are only let through when they carry one of the scopes, routes without scopes
+// are for interactive sessions only. Users whose password was reset by an admin are turned
+// away until they change it.
+func (a *Auth) Required(scopes ...string) gin.HandlerFunc {
+	return a.required(false, scopes)
+}
+
+// AllowingPasswordReset is Required for the few session routes a user has to reach to pick a new password
+func (a *Auth) AllowingPasswordReset() gin.HandlerFunc {
+	return a.required(true, nil)
+}
+
+func (a *Auth) required(allowReset bool, scopes []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		who, status, msg := a.authenticate(c, scopes)
+		if msg == "" && who.user.PasswordResetRequired && !allowReset {
+			status, msg = http.StatusForbidden, "Password change required"
+		}
+		if msg != "" {
+			c.AbortWithStatusJSON(status, gin.H{"error": msg})
+			return
+		}
+		c.Set(userContextKey, who.user)
+		if who.key != nil {
+			c.Set(apiKeyContextKey, who.key)
+		} else {
+			c.Set(authTimeContextKey, who.authTime)
+		}
+		c.Next()
+	}
+}
+
+// AdminOnly goes after Required and turns away everyone but admins
+func (a *Auth) AdminOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !currentUser(c).IsAdmin() {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin only"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// caller is who a request was authenticated as
+type caller struct {
+	user *models.User
+	//nil for session tokens
+	key *models.APIKey
+	//when the user logged in to get the session token
+	authTime time.Time
+}
+
+// returns the caller, or the status and message to answer with
+func (a *Auth) authenticate(c *gin.Context, scopes []string) (*caller, int, string) {
+	sessionToken := c.GetHeader("Authorization")
+	apiKey := c.GetHeader("X-API-Key")
+	tokenString := strings.TrimPrefix(sessionToken, "Bearer ")
+	if apiKey == "" && services.IsAPIKey(tokenString) {
+		apiKey = tokenString
+	}
+	if apiKey != "" {
+		return a.authenticateAPIKey(apiKey, scopes)
+	}
+	if sessionToken == "" {
+		return nil, http.StatusUnauthorized, "Missing session token"
+	}
+	claims, userID, err := a.parseToken(tokenString, tokenTypeAccess)
+	if err != nil {
+		return nil, http.StatusUnauthorized, "Invalid session token"
+	}
+
+	user, err := a.UserService.GetUserByID(userID)
+	if err != nil {
+		return nil, http.StatusNotFound, "User not found"
+	}
+	//logging out everywhere also ends the access tokens that are still around
+	if claims.Version != user.TokenVersion {
+		return nil, http.StatusUnauthorized, "Session token revoked"
+	}
+	if user.DisabledAt != nil {
+		return nil, http.StatusForbidden, "Account disabled"
+	}
+	who := &caller{user: user}
+	if claims.AuthTime != nil {
+		who.authTime = claims.AuthTime.Time
+	}
+	return who, 0, ""
+}
+
+func (a *Auth) authenticateAPIKey(secret string, scopes []string) (*caller, int, string) {
+	key, err := a.APIKeys.Authenticate(secret)
+	if errors.Is(err, services.ErrAPIKeyInvalid) {
+		return nil, http.StatusUnauthorized, "Invalid API key"
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, "Error checking API key"
+	}
+	if len(scopes) == 0 {
+		return nil, http.StatusForbidden, "API keys can't be used here"
+	}
+	if !services.HasScope(key, scopes...) {
+		return nil, http.StatusForbidden, "API key needs one of the scopes: " + strings.Join(scopes, ", ")
+	}
+
+	user, err := a.UserService.GetUserByID(key.UserID)
+	if err != nil {
+		return nil, http.StatusNotFound, "User not found"
+	}
+	if user.DisabledAt != nil {
+		return nil, http.StatusForbidden, "Account disabled"
+	}
+	return &caller{user: user, key: key}, 0, ""
+}
+
+// checks signature, algorithm, issuer, audience, expiry, not-before and type, returns the claims with the user id
+func (a *Auth) parseToken(tokenString, tokenType string) (*tokenClaims, uint, error) {
+	claims := &tokenClaims{}
+	if err := a.JWTKeys.Parse(tokenString, claims, tokenType); err != nil {
+		return nil, 0, err
+	}
+	if claims.Type != tokenType {
+		return nil, 0, fmt.Errorf("not a %s token", tokenType)
+	}
+	userID, err := strconv.ParseUint(claims.Subject, 10, 32)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid user ID")
+	}
+	return claims, uint(userID), nil
+}
+
+// currentUser is the user Required resolved, only call it from handlers behind Required
+func currentUser(c *gin.Context) *models.User {
+	return c.MustGet(userContextKey).(*models.User)
+}
+
+// tokenAuthTime is when the user logged in to get the request's session token, however often it
+// was refreshed since. Zero for API keys and tokens from before auth_time was recorded.
+func tokenAuthTime(c *gin.Context) time.Time {
+	t, _ := c.Get(authTimeContextKey)
+	authTime, _ := t.(time.Time)
+	return authTime
+}
@@ -1,13 +1,15 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"strings"
 	"net/http"
 	"context-aware-ai/models"
 	"context-aware-ai/services"
 	"github.com/gin-gonic/gin"
-	"github.com/dgrijalva/jwt-go"
+	"github.com/golang-jwt/jwt/v5"
 	"time"
 	"strconv"
 )
@@ -17,99 +19,145 @@ type ChatHandler struct {
 	TabService    *services.TabService
 	LLMService    services.LLMService 
 	UserService   *services.UserService
-	OllamaService *services.OllamaService
+	EmbeddingService services.EmbeddingService
+	EmbeddingCache   *services.EmbeddingCache
 	RAGService   *services.RAGService
+	IngestionService *services.IngestionService
 	TopK          int
-	JWTSecret     []byte
+	//default share of BM25 in hybrid retrieval, requests can override it
+	KeywordWeight float64
+	//default MMR trade-off and chunk merging, requests can override both
+	MMRLambda     float64
+	MergeAdjacent bool
+	//cosine similarity below which documents and memories are left out of the prompt, 0 keeps everything
+	DocumentMinScore float64
+	MemoryMinScore   float64
+	//optional pre-retrieval query generation, QueryPlan holds the defaults requests can override
+	QueryRewriter *services.QueryRewriter
+	QueryPlan     services.QueryPlan
+	//how many recent exchanges the rewrite sees
+	RewriteTurns  int
+	Auth          *Auth
+	RefreshTokens *services.RefreshTokenService
+	//who may call /create-user: open (default), invite or disabled
+	Registration  string
+	Limits        RateLimits
+	LoginThrottle *services.LoginThrottle
+	//token accounting and quotas of the LLM calls, nil records nothing
+	Usage *services.UsageService
 }
 
-func (ch *ChatHandler) SetupRoutes(router *gin.Engine) {
-	router.POST("/create-user", ch.CreateUserHandler)
-	router.POST("/login", ch.LoginHandler)
-	router.POST("/refresh-token", ch.RefreshTokenHandler)
-	router.GET("/tabs", ch.GetTabsHandler)
-	router.POST("/tabs", ch.CreateTabHandler)
-	router.DELETE("/tabs/:id", ch.DeleteTabHandler)
-	router.POST("/chat", ch.ChatHandler)
+// ChatSource is a document or memory that was put in the prompt
+type ChatSource struct {
+	Type      string  `json:"type"`
+	ID        uint    `json:"id"`
+	Score     float64 `json:"score"`
+	Source    string  `json:"source,omitempty"`
+	Symbol    string  `json:"symbol,omitempty"`
+	StartLine int     `json:"start_line,omitempty"`
+	EndLine   int     `json:"end_line,omitempty"`
+}
+
+func (ch *ChatHandler) SetupRoutes(router gin.IRouter) {
+	public := router.Group("", LimitByIP(ch.Limits.Login))
+	public.POST("/create-user", ch.CreateUserHandler)
+	public.POST("/login", ch.LoginHandler)
+	public.POST("/refresh-token", ch.RefreshTokenHandler)
+	public.POST("/logout", ch.LogoutHandler)
+
+	//managing the account and its tabs needs a session, API keys only reach the routes given their scopes
+	router.POST("/change-password", ch.Auth.AllowingPasswordReset(), ch.ChangePasswordHandler)
+	router.POST("/logout-all", ch.Auth.AllowingPasswordReset(), ch.LogoutAllHandler)
+	session := router.Group("", ch.Auth.Required())
+	session.DELETE("/account", ch.DeleteAccountHandler)
+	session.POST("/tabs", ch.CreateTabHandler)
+	session.DELETE("/tabs/:id", ch.DeleteTabHandler)
+	session.PUT("/tabs/:id/quantization", ch.SetTabQuantizationHandler)
+	session.PUT("/tabs/:id/rerank", ch.SetTabRerankerHandler)
+
+	router.GET("/tabs", ch.Auth.Required(services.ScopeRead, services.ScopeChat, services.ScopeUpload), ch.GetTabsHandler)
+	router.POST("/chat", ch.Auth.Required(services.ScopeChat), LimitByUser(ch.Limits.Chat), ch.withinQuota, ch.ChatHandler)
+	router.GET("/embedding-cache/stats", ch.Auth.Required(services.ScopeRead), ch.EmbeddingCacheStatsHandler)
 }
 
 func (ch *ChatHandler) CreateUserHandler(c *gin.Context) {
 	var input struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
+		//required when registration is invite only
+		InviteCode string `json:"invite_code"`
 	}
 
-	if err := c.ShouldBindJSON(&input); err != nil {
+	if err := c.ShouldBindJSON(&input); err != nil || input.Username == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
 		return
 	}
 
-	user, err := ch.UserService.CreateUser(input.Username, input.Password)
+	var user *models.User
+	var err error
+	switch ch.Registration {
+	case RegistrationDisabled:
+		c.JSON(http.StatusForbidden, gin.H{"error": "Registration is disabled, ask an admin for an account"})
+		return
+	case RegistrationInvite:
+		if input.InviteCode == "" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "An invite code is required"})
+			return
+		}
+		user, err = ch.UserService.CreateUserWithInvite(input.Username, input.Password, input.InviteCode)
+	default:
+		user, err = ch.UserService.CreateUser(input.Username, input.Password)
+	}
 	if err != nil || user == nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating user"})
+		respondUserError(c, err, "Error creating user")
 		return
 	}
 
 	c.JSON(http.StatusCreated, user)
 }
 
-func (ch *ChatHandler) GenerateSessionToken(user *models.User) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
-	claims := &jwt.StandardClaims{
-		Issuer:    fmt.Sprintf("%d", user.ID),
-		ExpiresAt: expirationTime.Unix(),
+// GenerateSessionToken signs an access token, authTime is when the user logged in for this session
+func (ch *ChatHandler) GenerateSessionToken(user *models.User, authTime time.Time) (string, error) {
+	now := time.Now()
+	claims := &tokenClaims{
+		Type:     tokenTypeAccess,
+		Version:  user.TokenVersion,
+		AuthTime: jwt.NewNumericDate(authTime),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.FormatUint(uint64(user.ID), 10),
+			Issuer:    ch.Auth.JWTKeys.Issuer,
+			Audience:  jwt.ClaimStrings{tokenTypeAccess},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(24 * time.Hour)),
+		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	sessionToken, err := token.SignedString(ch.JWTSecret)
-	if err != nil {
-		return "", err
-	}
-	return sessionToken, nil
+	return ch.Auth.JWTKeys.Sign(claims)
 }
 
-func (ch *ChatHandler) GenerateRefreshToken(user *models.User) (string, error) {
-	expirationTime := time.Now().Add(30 * 24 * time.Hour)
-	claims := &jwt.StandardClaims{
-		Issuer:    fmt.Sprintf("%d", user.ID),
-		ExpiresAt: expirationTime.Unix(),
-	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	refreshToken, err := token.SignedString(ch.JWTSecret)
+//records a new refresh token in the family (a new one when familyID is empty) and signs it
+func (ch *ChatHandler) GenerateRefreshToken(user *models.User, familyID string) (string, error) {
+	record, err := ch.RefreshTokens.Issue(user.ID, familyID)
 	if err != nil {
 		return "", err
 	}
-	return refreshToken, nil
+	return ch.signRefreshToken(record)
 }
 
-func (ch *ChatHandler) Authenticate(c *gin.Context) (*models.User, error) {
-	sessionToken := c.GetHeader("Authorization")
-	if sessionToken == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing session token"})
-		return nil, fmt.Errorf("missing session token")
-	}
-	tokenString := strings.TrimPrefix(sessionToken, "Bearer ")
-	claims := &jwt.StandardClaims{}
-	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return ch.JWTSecret, nil
-	})
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid session token"})
-		return nil, fmt.Errorf("invalid session token")
-	}
-
-	userID := claims.Issuer
-	userIDInt, err := strconv.ParseUint(userID, 10, 32)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user ID"})
-		return nil, fmt.Errorf("invalid user ID")
+func (ch *ChatHandler) signRefreshToken(record *models.RefreshToken) (string, error) {
+	claims := &tokenClaims{
+		Type: tokenTypeRefresh,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        record.JTI,
+			Subject:   strconv.FormatUint(uint64(record.UserID), 10),
+			Issuer:    ch.Auth.JWTKeys.Issuer,
+			Audience:  jwt.ClaimStrings{tokenTypeRefresh},
+			IssuedAt:  jwt.NewNumericDate(record.CreatedAt),
+			NotBefore: jwt.NewNumericDate(record.CreatedAt),
+			ExpiresAt: jwt.NewNumericDate(record.ExpiresAt),
+		},
 	}
-
-	user, err := ch.UserService.GetUserByID(uint(userIDInt))
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
-		return nil, err
-	}
-	return user, nil
+	return ch.Auth.JWTKeys.Sign(claims)
 }
 
 func (ch *ChatHandler) LoginHandler(c *gin.Context) {
@@ -123,25 +171,36 @@ func (ch *ChatHandler) LoginHandler(c *gin.Context) {
 		return
 	}
 
-	user, err := ch.UserService.GetUserByUserName(input.Username)
-	if err != nil || user == nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	wait, done := ch.LoginThrottle.Attempt(c.ClientIP(), input.Username)
+	if done == nil {
+		tooManyRequests(c, wait, "Too many failed logins")
 		return
 	}
 
-	valid, err := ch.UserService.CheckPassword(user.ID, input.Password)
-	if err != nil || !valid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password"})
+	//unknown users and wrong passwords get the same answer so logins can't be used to find usernames
+	user, err := ch.UserService.Authenticate(input.Username, input.Password)
+	//errors count as failures too, the attempt proved nothing
+	done(err == nil)
+	if errors.Is(err, services.ErrInvalidCredentials) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error logging in"})
+		return
+	}
+	if user.DisabledAt != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account disabled"})
 		return
 	}
 
-	accessToken, err := ch.GenerateSessionToken(user)
+	accessToken, err := ch.GenerateSessionToken(user, time.Now())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating access token"})
 		return
 	}
 
-	refreshToken, err := ch.GenerateRefreshToken(user)
+	refreshToken, err := ch.GenerateRefreshToken(user, "")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating refresh token"})
 		return
@@ -149,11 +208,13 @@ func (ch *ChatHandler) LoginHandler(c *gin.Context) {
 
 	c.Header("Authorization", "Bearer "+accessToken)
 	c.JSON(http.StatusOK, gin.H{
-		"access_token":  accessToken,
-		"refresh_token": refreshToken,
+		"access_token":            accessToken,
+		"refresh_token":           refreshToken,
+		"password_reset_required": user.PasswordResetRequired,
 	})
 }
 
+//swaps a refresh token for a new access token and a new refresh token, the old one can't be used again
 func (ch *ChatHandler) RefreshTokenHandler(c *gin.Context) {
 	var input struct {
 		RefreshToken string `json:"refresh_token"`
@@ -164,46 +225,100 @@ func (ch *ChatHandler) RefreshTokenHandler(c *gin.Context) {
 		return
 	}
 
-	claims := &jwt.StandardClaims{}
-	refreshTokenString := input.RefreshToken
-	_, err := jwt.ParseWithClaims(refreshTokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return ch.JWTSecret, nil
-	})
+	claims, userID, err := ch.Auth.parseToken(input.RefreshToken, tokenTypeRefresh)
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
 		return
 	}
 
-	userID := claims.Issuer
-	userIDInt, err := strconv.ParseUint(userID, 10, 32)
+	user, err := ch.UserService.GetUserByID(userID)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user ID"})
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if user.DisabledAt != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account disabled"})
 		return
 	}
 
-	user, err := ch.UserService.GetUserByID(uint(userIDInt))
+	record, err := ch.RefreshTokens.Rotate(user.ID, claims.ID)
+	if errors.Is(err, services.ErrRefreshTokenReused) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token already used, please log in again"})
+		return
+	}
+	if errors.Is(err, services.ErrRefreshTokenInvalid) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error rotating refresh token"})
 		return
 	}
 
-	accessToken, err := ch.GenerateSessionToken(user)
+	accessToken, err := ch.GenerateSessionToken(user, record.AuthTime)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating new access token"})
 		return
 	}
+	refreshToken, err := ch.signRefreshToken(record)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating refresh token"})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"access_token": accessToken,
+		"access_token":  accessToken,
+		"refresh_token": refreshToken,
 	})
 }
 
-func (ch *ChatHandler) GetTabsHandler(c *gin.Context) {
-	user, err := ch.Authenticate(c)
+//ends the session the refresh token belongs to, the access token runs out on its own
+func (ch *ChatHandler) LogoutHandler(c *gin.Context) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	claims, userID, err := ch.Auth.parseToken(input.RefreshToken, tokenTypeRefresh)
 	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+	if err := ch.RefreshTokens.RevokeFamily(userID, claims.ID); err != nil {
+		if errors.Is(err, services.ErrRefreshTokenInvalid) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error logging out"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+//revokes every refresh token of the user and every access token issued so far
+func (ch *ChatHandler) LogoutAllHandler(c *gin.Context) {
+	user := currentUser(c)
+
+	if err := ch.RefreshTokens.RevokeAll(user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error logging out"})
+		return
+	}
+	if err := ch.UserService.RevokeTokens(user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error logging out"})
 		return
 	}
 
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out of all sessions"})
+}
+
+func (ch *ChatHandler) GetTabsHandler(c *gin.Context) {
+	user := currentUser(c)
+
 	tabs, err := ch.TabService.GetTabs(user.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error getting tabs"})
@@ -214,10 +329,7 @@ func (ch *ChatHandler) GetTabsHandler(c *gin.Context) {
 }
 
 func (ch *ChatHandler) CreateTabHandler(c *gin.Context) {
-	user, err := ch.Authenticate(c)
-	if err != nil {
-		return
-	}
+	user := currentUser(c)
 
 	var input struct {
 		TabName string `json:"tab_name"`
@@ -238,10 +350,7 @@ func (ch *ChatHandler) CreateTabHandler(c *gin.Context) {
 }
 
 func (ch *ChatHandler) DeleteTabHandler(c *gin.Context) {
-    user, err := ch.Authenticate(c)
-    if err != nil {
-        return
-    }
+    user := currentUser(c)
 
     tabIDStr := c.Param("id")
     tabID, err := strconv.Atoi(tabIDStr)
@@ -257,24 +366,119 @@ func (ch *ChatHandler) DeleteTabHandler(c *gin.Context) {
     }
 
     tab := tabs[tabID-1]
-    err = ch.MemoryService.DeleteMemoriesByTabID(user.ID, tab.ID)
-    if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting memories"})
+    if msg := ch.deleteTab(user.ID, tab.ID); msg != "" {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
         return
     }
 
-	if err := ch.RAGService.DeleteDocumentsByTabID(user.ID, tab.ID); err != nil { 
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting documents"})
-		return 
+    c.JSON(http.StatusOK, gin.H{"message": "Tab, memories, and documents deleted successfully"})
+}
+
+//deletes the tab with its memories, ingestion jobs and documents, returns what failed
+func (ch *ChatHandler) deleteTab(userID, tabID uint) string {
+	if err := ch.MemoryService.DeleteMemoriesByTabID(userID, tabID); err != nil {
+		return "Error deleting memories"
+	}
+	if err := ch.IngestionService.DeleteJobsByTabID(userID, tabID); err != nil {
+		return "Error deleting ingestion jobs"
+	}
+	if err := ch.RAGService.DeleteDocumentsByTabID(userID, tabID); err != nil {
+		return "Error deleting documents"
 	}
+	if err := ch.TabService.DeleteTab(userID, tabID); err != nil {
+		return "Error deleting tab"
+	}
+	return ""
+}
 
-    err = ch.TabService.DeleteTab(user.ID, tab.ID)
-    if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting tab"})
-        return
-    }
+func (ch *ChatHandler) SetTabQuantizationHandler(c *gin.Context) {
+	user := currentUser(c)
 
-    c.JSON(http.StatusOK, gin.H{"message": "Tab, memories, and documents deleted successfully"})
+	tabID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tab ID"})
+		return
+	}
+
+	var input struct {
+		Mode string `json:"mode"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	mode, err := services.ParseQuantizationMode(input.Mode)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Mode must be none, int8 or pq"})
+		return
+	}
+
+	tabs, err := ch.TabService.GetTabs(user.ID)
+	if err != nil || tabID < 1 || tabID > len(tabs) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tab not found"})
+		return
+	}
+	tab := tabs[tabID-1]
+
+	if err := ch.RAGService.SetQuantization(user.ID, tab.ID, mode); err != nil {
+		if errors.Is(err, services.ErrQuantizationUnsupported) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Quantization is only available with the sqlite vector store"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error rebuilding tab index"})
+		return
+	}
+	if err := ch.TabService.SetQuantization(user.ID, tab.ID, mode); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating tab"})
+		return
+	}
+
+	tab.Quantization = string(mode)
+	c.JSON(http.StatusOK, tab)
+}
+
+func (ch *ChatHandler) SetTabRerankerHandler(c *gin.Context) {
+	user := currentUser(c)
+
+	tabID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tab ID"})
+		return
+	}
+
+	var input struct {
+		Reranker string `json:"reranker"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if input.Reranker == "" {
+		input.Reranker = services.RerankerNone
+	}
+	if !ch.RAGService.HasReranker(input.Reranker) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown or unconfigured reranker"})
+		return
+	}
+
+	tabs, err := ch.TabService.GetTabs(user.ID)
+	if err != nil || tabID < 1 || tabID > len(tabs) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tab not found"})
+		return
+	}
+	tab := tabs[tabID-1]
+
+	if err := ch.TabService.SetReranker(user.ID, tab.ID, input.Reranker); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating tab"})
+		return
+	}
+
+	tab.Reranker = input.Reranker
+	c.JSON(http.StatusOK, tab)
+}
+
+func (ch *ChatHandler) EmbeddingCacheStatsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, ch.EmbeddingCache.Stats())
 }
 
 func (ch *ChatHandler) ChatHandler(c *gin.Context) {
@@ -283,6 +487,21 @@ func (ch *ChatHandler) ChatHandler(c *gin.Context) {
         Message string `json:"message"`
 		//optional to add reason to the chat
 		Reasoning *bool `json:"reasoning"`
+		//optional 0-1, how much keyword matches count against vector similarity
+		KeywordWeight *float64 `json:"keyword_weight"`
+		//optional 0-1, lower values favour diverse results over near duplicates, 1 turns MMR off
+		MMRLambda *float64 `json:"mmr_lambda"`
+		//optional, join neighbouring chunks of the same file
+		MergeAdjacent *bool `json:"merge_adjacent"`
+		//optional query generation before retrieval, see QueryPlan
+		Rewrite     *bool `json:"rewrite"`
+		Paraphrases *int  `json:"paraphrases"`
+		HyDE        *bool `json:"hyde"`
+		//optional filter expression for retrieval, e.g. source=handbook.pdf AND tag in (hr)
+		Filter string `json:"filter"`
+		//optional tags and metadata stored on the memory of this exchange
+		Tags     []string          `json:"tags"`
+		Metadata map[string]string `json:"metadata"`
     }
 
     if err := c.ShouldBindJSON(&input); err != nil {
@@ -290,8 +509,19 @@ func (ch *ChatHandler) ChatHandler(c *gin.Context) {
         return
     }
 
-    user, err := ch.Authenticate(c)
+    user := currentUser(c)
+
+    filter, err := services.ParseFilter(input.Filter)
     if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    tags, msg := cleanTags(input.Tags)
+    if msg == "" {
+        msg = checkMetadata(input.Metadata)
+    }
+    if msg != "" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": msg})
         return
     }
 
@@ -309,44 +539,104 @@ func (ch *ChatHandler) ChatHandler(c *gin.Context) {
     tab := tabs[input.TabID-1]
     input.TabID = tab.ID
 
-    queryEmbedding, err := ch.OllamaService.GetEmbedding(input.Message)
+    queryEmbedding, err := ch.EmbeddingService.GetEmbedding(input.Message)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Error embedding message"})
         return
     }
 
-    memories, err := ch.MemoryService.RetrieveRelevant(queryEmbedding, ch.TopK, user.ID, input.TabID)
+    opts := services.SearchOptions{
+        TopK:          ch.TopK,
+        KeywordWeight: ch.KeywordWeight,
+        Reranker:      tab.Reranker,
+        MMRLambda:     ch.MMRLambda,
+        MergeAdjacent: ch.MergeAdjacent,
+        Filter:        filter,
+    }
+    if input.KeywordWeight != nil {
+        if *input.KeywordWeight < 0 || *input.KeywordWeight > 1 {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "keyword_weight must be between 0 and 1"})
+            return
+        }
+        opts.KeywordWeight = *input.KeywordWeight
+    }
+    if input.MMRLambda != nil {
+        if *input.MMRLambda < 0 || *input.MMRLambda > 1 {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "mmr_lambda must be between 0 and 1"})
+            return
+        }
+        opts.MMRLambda = *input.MMRLambda
+    }
+    if input.MergeAdjacent != nil {
+        opts.MergeAdjacent = *input.MergeAdjacent
+    }
+
+    plan := ch.QueryPlan
+    if input.Rewrite != nil {
+        plan.Rewrite = *input.Rewrite
+    }
+    if input.Paraphrases != nil {
+        if *input.Paraphrases < 0 || *input.Paraphrases > 5 {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "paraphrases must be between 0 and 5"})
+            return
+        }
+        plan.Paraphrases = *input.Paraphrases
+    }
+    if input.HyDE != nil {
+        plan.HyDE = *input.HyDE
+    }
+    queries, queryEmbeddings, err := ch.retrievalQueries(user.ID, input.TabID, input.Message, queryEmbedding, plan)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error embedding message"})
+        return
+    }
+
+    memoryOpts := opts
+    memoryOpts.MinScore = ch.MemoryMinScore
+    opts.MinScore = ch.DocumentMinScore
+
+    memories, err := ch.MemoryService.RetrieveRelevantQueries(queries, queryEmbeddings, memoryOpts, user.ID, input.TabID)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving memories"})
         return
     }
 
-    docs, err := ch.RAGService.Search(user.ID, input.TabID, input.Message, ch.TopK)
+    docs, err := ch.RAGService.SearchQueries(user.ID, input.TabID, queries, opts)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving documents"})
         return
     }
 	useReasoning := input.Reasoning != nil && *input.Reasoning
+	llm := ch.Usage.Wrap(ch.LLMService, user.ID, input.TabID, services.PurposeChat)
 	var response string
     prompt := buildRAGPrompt(input.Message, memories, docs)
 	if useReasoning {
 		//reasoning path 
 		reasoningPrompt := fmt.Sprintf( "You are a reasoning model. Analyze the context and produce a structured reasoning plan.\n\n%s", prompt, ) 
 		//TODO add a specific model for reasoning to will be another interface
-		reasoningOutput, err := ch.LLMService.GenerateResponse(reasoningPrompt) 
+		reasoningOutput, err := ch.Usage.Wrap(ch.LLMService, user.ID, input.TabID, services.PurposeReasoning).GenerateResponse(reasoningPrompt) 
+		if ch.quotaExceeded(c, err) {
+			return
+		}
 		if err != nil { 
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating reasoning"}) 
 			return 
 		} 
-		finalPrompt := fmt.Sprintf( "Here is the reasoning:\n%s\n\nNow produce the final answer for the user.", reasoningOutput, ) 
-		response, err = ch.LLMService.GenerateResponse(finalPrompt) 
+		finalPrompt := fmt.Sprintf( "Here is the reasoning:\n%s\n\nNow produce the final answer for the user, keeping any [n] document citations.", reasoningOutput, ) 
+		response, err = llm.GenerateResponse(finalPrompt) 
+		if ch.quotaExceeded(c, err) {
+			return
+		}
 		if err != nil { 
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating response"}) 
 			return 
 		} 
 	} else {
 		//direct answer path 
-		response, err = ch.LLMService.GenerateResponse(prompt) 
+		response, err = llm.GenerateResponse(prompt) 
+		if ch.quotaExceeded(c, err) {
+			return
+		}
 		if err != nil { 
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating response"}) 
 			return 
@@ -358,28 +648,99 @@ func (ch *ChatHandler) ChatHandler(c *gin.Context) {
         queryEmbedding,
         user.ID,
         input.TabID,
+        tags,
+        input.Metadata,
     ); err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Error storing memory"})
         return
     }
 
-    c.JSON(http.StatusOK, gin.H{"response": response})
+    c.JSON(http.StatusOK, gin.H{
+        "response":  response,
+        "queries":   queries,
+        "sources":   chatSources(memories, docs),
+        "citations": services.ParseCitations(response, docs),
+    })
 }
 
-func buildRAGPrompt(userInput string, memories []models.Memory, docs []models.Document) string {
-    var sb strings.Builder
+//the message itself comes first, generated queries follow. failures in the generation step are
+//logged and retrieval carries on with whatever queries were produced
+func (ch *ChatHandler) retrievalQueries(userID, tabID uint, message string, messageEmbedding []float64, plan services.QueryPlan) ([]string, [][]float64, error) {
+    if ch.QueryRewriter == nil || (!plan.Rewrite && plan.Paraphrases == 0 && !plan.HyDE) {
+        return []string{message}, [][]float64{messageEmbedding}, nil
+    }
 
-    sb.WriteString("Relevant Document Context:\n")
+    var history []string
+    if plan.Rewrite {
+        recent, err := ch.MemoryService.RecentMemories(userID, tabID, ch.RewriteTurns)
+        if err != nil {
+            return nil, nil, err
+        }
+        for _, m := range recent {
+            history = append(history, m.Text)
+        }
+    }
+    rewriter := *ch.QueryRewriter
+    rewriter.LLM = ch.Usage.Wrap(rewriter.LLM, userID, tabID, services.PurposeRewrite)
+    queries, errs := rewriter.Queries(message, history, plan)
+    for _, err := range errs {
+        log.Printf("query generation: %v", err)
+    }
+    if len(queries) == 1 && queries[0] == message {
+        return queries, [][]float64{messageEmbedding}, nil
+    }
+
+    embeddings, err := ch.EmbeddingService.GetEmbeddings(queries)
+    if err != nil {
+        return nil, nil, err
+    }
+    return queries, embeddings, nil
+}
+
+//documents first, matching their order in the prompt
+func chatSources(memories []services.MemoryHit, docs []services.DocumentHit) []ChatSource {
+    sources := make([]ChatSource, 0, len(docs)+len(memories))
     for _, d := range docs {
+        sources = append(sources, ChatSource{
+            Type:      "document",
+            ID:        d.ID,
+            Score:     d.Score,
+            Source:    d.Source,
+            Symbol:    d.Symbol,
+            StartLine: d.StartLine,
+            EndLine:   d.EndLine,
+        })
+    }
+    for _, m := range memories {
+        sources = append(sources, ChatSource{Type: "memory", ID: m.ID, Score: m.Score})
+    }
+    return sources
+}
+
+//sections with nothing above the thresholds are left out rather than sent empty.
+//document blocks are numbered from 1 in docs order so the answer can cite them as [n]
+func buildRAGPrompt(userInput string, memories []services.MemoryHit, docs []services.DocumentHit) string {
+    var sb strings.Builder
+
+    if len(docs) > 0 {
+        sb.WriteString("Relevant Document Context:\n")
+        sb.WriteString("When you use information from a document, cite it with its block number in square brackets, e.g. [1]. Only cite blocks listed here.\n")
+    }
+    for i, d := range docs {
 		//adding file name to context
-		sb.WriteString("- File: ")
+		sb.WriteString(fmt.Sprintf("[%d] File: ", i+1))
         sb.WriteString(d.Source) 
+        if d.Symbol != "" {
+            sb.WriteString(fmt.Sprintf(" (%s, lines %d-%d)", d.Symbol, d.StartLine, d.EndLine))
+        }
         sb.WriteString("\nContent: ")
         sb.WriteString(d.Content)
         sb.WriteString("\n")
     }
 
-    sb.WriteString("\nRelevant Chat Memory:\n")
+    if len(memories) > 0 {
+        sb.WriteString("\nRelevant Chat Memory:\n")
+    }
     for _, m := range memories {
         sb.WriteString("- ")
         sb.WriteString(m.Text)
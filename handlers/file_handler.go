@@ -1,6 +1,10 @@
 package handlers
 
 import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "context-aware-ai/models"
     "context-aware-ai/services"
     "io"
     "net/http"
@@ -11,16 +15,38 @@ import (
 
 type FileHandler struct {
     RAGService   *services.RAGService
-    ChatHandler  *ChatHandler//for authentication and gettabs
+    TabService   *services.TabService
+    Auth         *Auth
+    RepoLoader   *services.RepoLoader
+    IngestionService *services.IngestionService
+    //per user, nil for no limit
+    UploadLimit  *services.RateLimiter
+    //bytes per /upload file, defaults to 50MB
+    MaxUploadSize int64
 }
 
-func (h *FileHandler) SetupRoutes(router *gin.Engine) {
-    router.POST("/upload", h.Upload)
+//room for the tab, tags and metadata fields next to the file
+const uploadFormOverhead = 64 << 10
+
+//parts of the form past this are spooled to temporary files, same as net/http's default
+const uploadFormMemory = 32 << 20
+
+func (h *FileHandler) SetupRoutes(router gin.IRouter) {
+    upload := router.Group("", h.Auth.Required(services.ScopeUpload), LimitByUser(h.UploadLimit))
+    upload.POST("/upload", h.Upload)
+    upload.POST("/upload-repo", h.UploadRepo)
+    upload.POST("/jobs/:id/retry", h.RetryJob)
+    router.GET("/jobs/:id", h.Auth.Required(services.ScopeUpload, services.ScopeRead), h.GetJob)
 }
 
 func (h *FileHandler) Upload(c *gin.Context) {
-    user, err := h.ChatHandler.Authenticate(c)
-    if err != nil {
+    user := currentUser(c)
+
+    maxSize := h.MaxUploadSize
+    if maxSize <= 0 {
+        maxSize = 50 << 20
+    }
+    if !parseUploadForm(c, maxSize, "File") {
         return
     }
 
@@ -31,7 +57,7 @@ func (h *FileHandler) Upload(c *gin.Context) {
         return
     }
 
-    tabs, err := h.ChatHandler.TabService.GetTabs(user.ID)
+    tabs, err := h.TabService.GetTabs(user.ID)
     if err != nil || tabID < 1 || tabID > len(tabs) {
         c.JSON(http.StatusNotFound, gin.H{"error": "Tab not found"})
         return
@@ -39,26 +65,257 @@ func (h *FileHandler) Upload(c *gin.Context) {
 
     tab := tabs[tabID-1]
 
+    tags, metadata, msg := uploadLabels(c)
+    if msg != "" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+        return
+    }
+
     file, err := c.FormFile("file")
     if err != nil {
         c.JSON(http.StatusBadRequest, gin.H{"error": "file required"})
         return
     }
 
-    f, _ := file.Open()
+    if file.Size > maxSize {
+        c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("File exceeds %d bytes", maxSize)})
+        return
+    }
+    f, err := file.Open()
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "could not read file"})
+        return
+    }
     defer f.Close()
-    data, _ := io.ReadAll(f)
+    data, err := io.ReadAll(io.LimitReader(f, maxSize))
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "could not read file"})
+        return
+    }
+
+    var chunks []services.CodeChunk
+    for _, text := range chunkText(string(data), 300, 50) {
+        chunks = append(chunks, services.CodeChunk{Path: file.Filename, Content: text})
+    }
+
+    job, err := h.IngestionService.Submit(user.ID, tab.ID, file.Filename, chunks, tags, metadata)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "error queuing document"})
+        return
+    }
+
+    c.JSON(http.StatusAccepted, gin.H{"status": job.Status, "job_id": job.ID})
+}
+
+func (h *FileHandler) GetJob(c *gin.Context) {
+    user := currentUser(c)
+
+    jobID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid job ID"})
+        return
+    }
 
-    chunks := chunkText(string(data), 300, 50)
+    job, err := h.IngestionService.GetJob(user.ID, uint(jobID))
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+        return
+    }
+
+    c.JSON(http.StatusOK, jobResponse(job))
+}
+
+//re-queues the chunks of a job that ran out of attempts
+func (h *FileHandler) RetryJob(c *gin.Context) {
+    user := currentUser(c)
 
-    for _, ch := range chunks {
-        if err := h.RAGService.IndexChunk(user.ID, tab.ID, file.Filename, ch); err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "error indexing document"})
+    jobID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid job ID"})
+        return
+    }
+
+    job, err := h.IngestionService.RetryFailed(user.ID, uint(jobID))
+    if err != nil {
+        if errors.Is(err, services.ErrJobNotFound) {
+            c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
             return
         }
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrying job"})
+        return
+    }
+
+    c.JSON(http.StatusAccepted, jobResponse(job))
+}
+
+func jobResponse(job *models.IngestionJob) gin.H {
+    progress := 1.0
+    if job.TotalChunks > 0 {
+        progress = float64(job.DoneChunks+job.FailedChunks) / float64(job.TotalChunks)
+    }
+    return gin.H{
+        "job_id":        job.ID,
+        "source":        job.Source,
+        "status":        job.Status,
+        "total_chunks":  job.TotalChunks,
+        "done_chunks":   job.DoneChunks,
+        "failed_chunks": job.FailedChunks,
+        "progress":      progress,
+        "error":         job.Error,
+        "created_at":    job.CreatedAt,
+        "updated_at":    job.UpdatedAt,
+    }
+}
+
+//indexes every text file of a zip or tarball, code files are split per function/type
+func (h *FileHandler) UploadRepo(c *gin.Context) {
+    user := currentUser(c)
+
+    if !parseUploadForm(c, h.RepoLoader.MaxTotalSize, "Archive") {
+        return
+    }
+
+    tabID, err := strconv.Atoi(c.PostForm("tab_id"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tab ID"})
+        return
+    }
+
+    tabs, err := h.TabService.GetTabs(user.ID)
+    if err != nil || tabID < 1 || tabID > len(tabs) {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Tab not found"})
+        return
+    }
+
+    tab := tabs[tabID-1]
+
+    tags, metadata, msg := uploadLabels(c)
+    if msg != "" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+        return
+    }
+
+    file, err := c.FormFile("file")
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "file required"})
+        return
+    }
+
+    f, err := file.Open()
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "could not read archive"})
+        return
+    }
+    defer f.Close()
+
+    //exclude can be sent several times and each value can hold one pattern per line or comma
+    var excludes []string
+    for _, v := range c.PostFormArray("exclude") {
+        excludes = append(excludes, strings.FieldsFunc(v, func(r rune) bool {
+            return r == '\n' || r == ','
+        })...)
+    }
+
+    files, err := h.RepoLoader.Load(file.Filename, f, file.Size, excludes)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+
+    var chunks []services.CodeChunk
+    for _, rf := range files {
+        chunks = append(chunks, chunkFile(rf)...)
+    }
+
+    job, err := h.IngestionService.Submit(user.ID, tab.ID, file.Filename, chunks, tags, metadata)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "error queuing repository"})
+        return
+    }
+
+    c.JSON(http.StatusAccepted, gin.H{"status": job.Status, "job_id": job.ID, "files": len(files), "chunks": len(chunks)})
+}
+
+//parses the multipart form, refusing bodies past limit plus the other fields before they are
+//spooled to disk. No limit when it is 0, reports false when it already answered the request
+func parseUploadForm(c *gin.Context, limit int64, what string) bool {
+    if limit > 0 {
+        c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit+uploadFormOverhead)
+    }
+    err := c.Request.ParseMultipartForm(uploadFormMemory)
+    if err == nil || errors.Is(err, http.ErrNotMultipart) {
+        return true
+    }
+    var tooLarge *http.MaxBytesError
+    if errors.As(err, &tooLarge) {
+        c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("%s exceeds %d bytes", what, limit)})
+        return false
+    }
+    c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid form"})
+    return false
+}
+
+//optional form fields: tags (repeated or comma separated) and metadata (a JSON object of strings),
+//returns an error message for the client when either is malformed
+func uploadLabels(c *gin.Context) ([]string, map[string]string, string) {
+    var raw []string
+    for _, v := range c.PostFormArray("tags") {
+        raw = append(raw, strings.Split(v, ",")...)
+    }
+    tags, msg := cleanTags(raw)
+    if msg != "" {
+        return nil, nil, msg
+    }
+
+    var metadata map[string]string
+    if v := c.PostForm("metadata"); v != "" {
+        if err := json.Unmarshal([]byte(v), &metadata); err != nil {
+            return nil, nil, "metadata must be a JSON object of strings"
+        }
     }
+    if msg := checkMetadata(metadata); msg != "" {
+        return nil, nil, msg
+    }
+    return tags, metadata, ""
+}
+
+//trims and de-duplicates tags
+func cleanTags(raw []string) ([]string, string) {
+    var tags []string
+    seen := map[string]bool{}
+    for _, t := range raw {
+        t = strings.TrimSpace(t)
+        if t == "" || seen[t] {
+            continue
+        }
+        if len(t) > 64 {
+            return nil, "tags can be at most 64 characters"
+        }
+        seen[t] = true
+        tags = append(tags, t)
+    }
+    return tags, ""
+}
 
-    c.JSON(http.StatusOK, gin.H{"status": "indexed"})
+func checkMetadata(metadata map[string]string) string {
+    for key := range metadata {
+        if !services.ValidMetadataKey(key) {
+            return fmt.Sprintf("Invalid metadata key %q", key)
+        }
+    }
+    return ""
+}
+
+//code goes through the symbol aware splitter, anything else gets the same word windows as /upload
+func chunkFile(rf services.RepoFile) []services.CodeChunk {
+    if services.IsCodeFile(rf.Path) {
+        return services.ChunkSource(rf.Path, rf.Data)
+    }
+    var chunks []services.CodeChunk
+    for _, text := range chunkText(string(rf.Data), 300, 50) {
+        chunks = append(chunks, services.CodeChunk{Path: rf.Path, Content: text})
+    }
+    return chunks
 }
 
 func chunkText(text string, size, overlap int) []string {
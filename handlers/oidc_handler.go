@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"context-aware-ai/services"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OIDCHandler logs users in through the configured identity provider and hands out the usual tokens
+type OIDCHandler struct {
+	ChatHandler *ChatHandler //for users and token generation
+	OIDC        *services.OIDCService
+}
+
+//carries the state of the login the browser started, so a state and code minted elsewhere (say for
+//an attacker's own account) can't be planted on it
+const oidcStateCookie = "oidc_state"
+
+func (h *OIDCHandler) SetupRoutes(router gin.IRouter) {
+	sso := router.Group("/auth/oidc", LimitByIP(h.ChatHandler.Limits.Login))
+	sso.GET("/login", h.Login)
+	sso.GET("/callback", h.Callback)
+}
+
+// Login sends the browser to the provider, ?redirect=false returns the URL instead for clients that follow it themselves
+func (h *OIDCHandler) Login(c *gin.Context) {
+	authURL, state, err := h.OIDC.Begin()
+	if err != nil {
+		log.Printf("oidc login: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Error contacting the identity provider"})
+		return
+	}
+	setStateCookie(c, state, int(services.OIDCStateTTL.Seconds()))
+
+	if c.Query("redirect") == "false" {
+		c.JSON(http.StatusOK, gin.H{"auth_url": authURL})
+		return
+	}
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// Callback is where the provider sends the browser back with the code, the first login creates the
+// user when provisioning is allowed
+func (h *OIDCHandler) Callback(c *gin.Context) {
+	if c.Query("error") != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "The identity provider refused the login: " + c.Query("error")})
+		return
+	}
+	state, code := c.Query("state"), c.Query("code")
+	if state == "" || code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing state or code"})
+		return
+	}
+	started, _ := c.Cookie(oidcStateCookie)
+	if subtle.ConstantTimeCompare([]byte(started), []byte(state)) != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Login was not started in this browser, start again"})
+		return
+	}
+	setStateCookie(c, "", -1)
+
+	identity, err := h.OIDC.Finish(state, code)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrOIDCStateInvalid):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Login expired or already used, start again"})
+		case errors.Is(err, services.ErrOIDCTokenInvalid):
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid ID token"})
+		default:
+			log.Printf("oidc callback: %v", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Error contacting the identity provider"})
+		}
+		return
+	}
+
+	user, err := h.ChatHandler.UserService.ExternalUser(identity, h.OIDC.MayProvision(identity))
+	if errors.Is(err, services.ErrUserNotFound) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "No account for this login, ask an admin for access"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating user"})
+		return
+	}
+	if user.DisabledAt != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account disabled"})
+		return
+	}
+
+	accessToken, err := h.ChatHandler.GenerateSessionToken(user, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating access token"})
+		return
+	}
+	refreshToken, err := h.ChatHandler.GenerateRefreshToken(user, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating refresh token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"access_token":            accessToken,
+		"refresh_token":           refreshToken,
+		"password_reset_required": user.PasswordResetRequired,
+		"user":                    user,
+	})
+}
+
+//lax so it still comes along on the provider's top level redirect back to the callback
+func setStateCookie(c *gin.Context, state string, maxAge int) {
+	path := strings.TrimSuffix(strings.TrimSuffix(c.Request.URL.Path, "/login"), "/callback")
+	secure := c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, state, maxAge, path, "", secure, true)
+}
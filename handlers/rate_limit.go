@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"context-aware-ai/services"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimits are the buckets routes draw from, a nil limiter lets everything through
+type RateLimits struct {
+	//every request, per client IP
+	IP *services.RateLimiter
+	//login, registration, token refresh and single sign-on, per client IP
+	Login *services.RateLimiter
+	//the routes that cost LLM or embedding calls, per user
+	Chat   *services.RateLimiter
+	Upload *services.RateLimiter
+	Search *services.RateLimiter
+}
+
+// LimitByIP keys the limiter on the client IP, see TRUSTED_PROXIES for running behind a proxy
+func LimitByIP(l *services.RateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ok, wait := l.Allow(c.ClientIP()); !ok {
+			tooManyRequests(c, wait, "Too many requests")
+			return
+		}
+		c.Next()
+	}
+}
+
+// LimitByUser keys the limiter on the authenticated user, so it goes after Auth.Required.
+// Session tokens and API keys of the same user share the bucket.
+func LimitByUser(l *services.RateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ok, wait := l.Allow(strconv.FormatUint(uint64(currentUser(c).ID), 10)); !ok {
+			tooManyRequests(c, wait, "Too many requests")
+			return
+		}
+		c.Next()
+	}
+}
+
+// answers 429 with Retry-After in whole seconds, rounded up so retrying right then succeeds
+func tooManyRequests(c *gin.Context, wait time.Duration, msg string) {
+	seconds := max(int(math.Ceil(wait.Seconds())), 1)
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+		"error":       fmt.Sprintf("%s, retry in %d seconds", msg, seconds),
+		"retry_after": seconds,
+	})
+}
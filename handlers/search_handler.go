@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"context-aware-ai/services"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SearchHandler runs retrieval on its own, nothing is generated and no memory is written
+type SearchHandler struct {
+	ChatHandler *ChatHandler //for tabs and the retrieval defaults
+}
+
+const (
+	defaultSearchPageSize = 10
+	maxSearchPageSize     = 50
+	//how far pagination can reach, every page re-runs retrieval for page*page_size hits per tab
+	maxSearchDepth   = 500
+	searchSnippetLen = 240
+)
+
+// SearchResult is one ranked document or memory, TabID is the tab's index like everywhere else in the API
+type SearchResult struct {
+	Type      string            `json:"type"`
+	ID        uint              `json:"id"`
+	TabID     uint              `json:"tab_id"`
+	Score     float64           `json:"score"`
+	Source    string            `json:"source,omitempty"`
+	Symbol    string            `json:"symbol,omitempty"`
+	StartLine int               `json:"start_line,omitempty"`
+	EndLine   int               `json:"end_line,omitempty"`
+	Snippet   services.Snippet  `json:"snippet"`
+	Tags      []string          `json:"tags,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+func (h *SearchHandler) SetupRoutes(router gin.IRouter) {
+	router.POST("/search", h.ChatHandler.Auth.Required(services.ScopeRead, services.ScopeChat), LimitByUser(h.ChatHandler.Limits.Search), h.Search)
+}
+
+func (h *SearchHandler) Search(c *gin.Context) {
+	var input struct {
+		Query string `json:"query"`
+		//one tab, several tabs, or every tab of the user when both are left out
+		TabID  uint   `json:"tab_id"`
+		TabIDs []uint `json:"tab_ids"`
+		//optional filter expression, e.g. source=handbook.pdf AND tag in (hr)
+		Filter string `json:"filter"`
+		//documents, memories or both (default)
+		Types         []string `json:"types"`
+		KeywordWeight *float64 `json:"keyword_weight"`
+		Page          int      `json:"page"`
+		PageSize      int      `json:"page_size"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || input.Query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	user := currentUser(c)
+
+	filter, err := services.ParseFilter(input.Filter)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if input.Page == 0 {
+		input.Page = 1
+	}
+	if input.PageSize == 0 {
+		input.PageSize = defaultSearchPageSize
+	}
+	if input.Page < 1 || input.PageSize < 1 || input.PageSize > maxSearchPageSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "page must be at least 1 and page_size between 1 and 50"})
+		return
+	}
+	depth := input.Page * input.PageSize
+	if depth > maxSearchDepth {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Page out of range"})
+		return
+	}
+
+	searchDocs, searchMemories := len(input.Types) == 0, len(input.Types) == 0
+	for _, t := range input.Types {
+		switch t {
+		case "documents":
+			searchDocs = true
+		case "memories":
+			searchMemories = true
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "types can only contain documents and memories"})
+			return
+		}
+	}
+
+	tabs, err := h.ChatHandler.TabService.GetTabs(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error loading tabs"})
+		return
+	}
+	indexes := input.TabIDs
+	if input.TabID != 0 {
+		indexes = append(indexes, input.TabID)
+	}
+	if len(indexes) == 0 {
+		for i := range tabs {
+			indexes = append(indexes, uint(i+1))
+		}
+	}
+	for _, idx := range indexes {
+		if idx < 1 || idx > uint(len(tabs)) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Tab not found"})
+			return
+		}
+	}
+
+	//plain ranking: no reranker (the llm one would call the LLM) and no MMR, whose picks
+	//change with the depth and would shuffle results between pages
+	opts := services.SearchOptions{
+		TopK:          depth,
+		KeywordWeight: h.ChatHandler.KeywordWeight,
+		Filter:        filter,
+	}
+	if input.KeywordWeight != nil {
+		if *input.KeywordWeight < 0 || *input.KeywordWeight > 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "keyword_weight must be between 0 and 1"})
+			return
+		}
+		opts.KeywordWeight = *input.KeywordWeight
+	}
+	memoryOpts := opts
+	memoryOpts.MinScore = h.ChatHandler.MemoryMinScore
+	opts.MinScore = h.ChatHandler.DocumentMinScore
+
+	var queryEmbedding []float64
+	if searchMemories {
+		queryEmbedding, err = h.ChatHandler.EmbeddingService.GetEmbedding(input.Query)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error embedding query"})
+			return
+		}
+	}
+
+	var results []SearchResult
+	seen := map[uint]bool{}
+	for _, idx := range indexes {
+		if seen[idx] {
+			continue
+		}
+		seen[idx] = true
+		tab := tabs[idx-1]
+
+		if searchDocs {
+			docs, err := h.ChatHandler.RAGService.Search(user.ID, tab.ID, input.Query, opts)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving documents"})
+				return
+			}
+			for _, d := range docs {
+				results = append(results, SearchResult{
+					Type:      "document",
+					ID:        d.ID,
+					TabID:     idx,
+					Score:     d.Score,
+					Source:    d.Source,
+					Symbol:    d.Symbol,
+					StartLine: d.StartLine,
+					EndLine:   d.EndLine,
+					Snippet:   services.MakeSnippet(d.Content, input.Query, searchSnippetLen),
+					Tags:      d.Tags,
+					Metadata:  d.Metadata,
+					CreatedAt: d.CreatedAt,
+				})
+			}
+		}
+		if searchMemories {
+			memories, err := h.ChatHandler.MemoryService.RetrieveRelevant(input.Query, queryEmbedding, memoryOpts, user.ID, tab.ID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving memories"})
+				return
+			}
+			for _, m := range memories {
+				results = append(results, SearchResult{
+					Type:      "memory",
+					ID:        m.ID,
+					TabID:     idx,
+					Score:     m.Score,
+					Snippet:   services.MakeSnippet(m.Text, input.Query, searchSnippetLen),
+					Tags:      m.Tags,
+					Metadata:  m.Metadata,
+					CreatedAt: m.CreatedAt,
+				})
+			}
+		}
+	}
+
+	//hits from different tabs and types only share the cosine score, so that is what orders the page
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	start := (input.Page - 1) * input.PageSize
+	end := min(start+input.PageSize, len(results))
+	page := []SearchResult{}
+	if start < len(results) {
+		page = results[start:end]
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"query":     input.Query,
+		"page":      input.Page,
+		"page_size": input.PageSize,
+		"has_more":  len(results) > end,
+		"results":   page,
+	})
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"context-aware-ai/models"
+	"context-aware-ai/services"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UsageHandler reports the tokens and estimated cost of the caller's LLM calls
+type UsageHandler struct {
+	ChatHandler *ChatHandler
+}
+
+func (h *UsageHandler) SetupRoutes(router gin.IRouter) {
+	router.GET("/usage", h.ChatHandler.Auth.Required(services.ScopeRead), h.GetUsage)
+}
+
+// UsageGroup is one row of a /usage breakdown, only the field it is grouped by is set
+type UsageGroup struct {
+	Model   string `json:"model,omitempty"`
+	Purpose string `json:"purpose,omitempty"`
+	//positional like everywhere else, null for tabs that were deleted since
+	TabID *int `json:"tab_id,omitempty"`
+	services.UsageTotals
+}
+
+func (h *UsageHandler) GetUsage(c *gin.Context) {
+	report, msg := h.ChatHandler.usageReport(currentUser(c).ID)
+	if msg != "" {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// withinQuota stops users who used up a quota before the request costs anything, it goes after Auth.Required
+func (ch *ChatHandler) withinQuota(c *gin.Context) {
+	resetsAt, err := ch.Usage.CheckQuota(currentUser(c).ID)
+	if errors.Is(err, services.ErrQuotaExceeded) {
+		tooManyRequests(c, time.Until(resetsAt), "Usage quota exceeded")
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Error checking usage quota"})
+		return
+	}
+	c.Next()
+}
+
+// quotaExceeded answers 429 when err is the quota running out between the LLM calls of a request
+func (ch *ChatHandler) quotaExceeded(c *gin.Context, err error) bool {
+	if !errors.Is(err, services.ErrQuotaExceeded) {
+		return false
+	}
+	resetsAt, _ := ch.Usage.CheckQuota(currentUser(c).ID)
+	tooManyRequests(c, time.Until(resetsAt), "Usage quota exceeded")
+	return true
+}
+
+// the current day and month against their quotas, and the month broken down by model, tab and purpose
+func (ch *ChatHandler) usageReport(userID uint) (gin.H, string) {
+	day, month, err := ch.Usage.Periods(userID)
+	if err != nil {
+		return nil, "Error loading usage"
+	}
+	tabs, err := ch.TabService.GetTabs(userID)
+	if err != nil {
+		return nil, "Error loading tabs"
+	}
+	position := map[string]int{}
+	for i, t := range tabs {
+		position[strconv.FormatUint(uint64(t.ID), 10)] = i + 1
+	}
+
+	report := gin.H{"day": day, "month": month}
+	for _, by := range []struct{ column, name string }{
+		{"model", "by_model"}, {"tab_id", "by_tab"}, {"purpose", "by_purpose"},
+	} {
+		groups, err := ch.Usage.Breakdown(userID, month.Start, by.column)
+		if err != nil {
+			return nil, "Error loading usage"
+		}
+		rows := make([]UsageGroup, 0, len(groups))
+		for _, g := range groups {
+			row := UsageGroup{UsageTotals: g.UsageTotals}
+			switch by.column {
+			case "model":
+				row.Model = g.Key
+			case "purpose":
+				row.Purpose = g.Key
+			case "tab_id":
+				if pos, ok := position[g.Key]; ok {
+					row.TabID = &pos
+				}
+			}
+			rows = append(rows, row)
+		}
+		report[by.name] = rows
+	}
+	return report, ""
+}
+
+// GetUserUsage shows an admin the user's usage and their quota overrides
+func (h *AdminHandler) GetUserUsage(c *gin.Context) {
+	user, ok := h.targetUser(c)
+	if !ok {
+		return
+	}
+
+	report, msg := h.ChatHandler.usageReport(user.ID)
+	if msg != "" {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+		return
+	}
+	quota, err := h.ChatHandler.Usage.Quota(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error loading quota"})
+		return
+	}
+
+	report["quota"] = quota
+	c.JSON(http.StatusOK, report)
+}
+
+// SetUserQuota replaces the user's quota overrides, omitted or null fields use the default and 0 is unlimited
+func (h *AdminHandler) SetUserQuota(c *gin.Context) {
+	var quota models.UsageQuota
+	if err := c.ShouldBindJSON(&quota); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	for _, v := range []*int64{quota.DailyTokens, quota.MonthlyTokens} {
+		if v != nil && *v < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Quotas can't be negative"})
+			return
+		}
+	}
+	for _, v := range []*float64{quota.DailyCost, quota.MonthlyCost} {
+		if v != nil && *v < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Quotas can't be negative"})
+			return
+		}
+	}
+
+	user, ok := h.targetUser(c)
+	if !ok {
+		return
+	}
+	quota.UserID = user.ID
+	if err := h.ChatHandler.Usage.SetQuota(&quota); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating quota"})
+		return
+	}
+
+	limits, err := h.ChatHandler.Usage.Limits(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error loading quota"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"quota": quota, "limits": limits})
+}
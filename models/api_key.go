@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// APIKey lets scripts authenticate without the login and refresh loop. Only the SHA-256 of the key
+// is stored, Prefix is kept in the clear so users can tell their keys apart.
+type APIKey struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	UserID     uint       `gorm:"index" json:"-"`
+	Name       string     `gorm:"size:255" json:"name"`
+	Prefix     string     `gorm:"size:16" json:"prefix"`
+	Hash       string     `gorm:"size:64;uniqueIndex" json:"-"`
+	Scopes     []string   `gorm:"serializer:json;type:text" json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
@@ -1,10 +1,25 @@
 package models
 
+import "time"
+
 type Document struct {
     ID        uint   `gorm:"primaryKey"`
     UserID    uint
     TabID     uint
     Source    string
+    //only set for chunks that came from source code
+    Symbol    string
+    StartLine int
+    EndLine   int
     Content   string
     Embedding []byte
+    //set while the ingestion job that created it is still running
+    JobID     uint `gorm:"index"`
+    Pending   bool `gorm:"index"`
+    //position within the job, neighbouring chunks of a file have consecutive indexes
+    ChunkIndex int
+    //copied from the upload, both can be used in search filters
+    Tags      []string          `gorm:"serializer:json;type:text"`
+    Metadata  map[string]string `gorm:"serializer:json;type:text"`
+    CreatedAt time.Time         `gorm:"index"`
 }
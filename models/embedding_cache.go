@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+//persistent half of the embedding cache, hash is the hex sha256 of the embedded text
+type EmbeddingCacheEntry struct {
+	Model     string `gorm:"primaryKey;size:255"`
+	Hash      string `gorm:"primaryKey;size:64"`
+	Embedding []byte
+	CreatedAt time.Time
+}
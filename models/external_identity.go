@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// ExternalIdentity links an account at an OIDC provider to a local user
+type ExternalIdentity struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"index"`
+	Issuer    string `gorm:"size:255;uniqueIndex:idx_identity_subject"`
+	Subject   string `gorm:"size:255;uniqueIndex:idx_identity_subject"`
+	Email     string `gorm:"size:255"`
+	CreatedAt time.Time
+}
+
+// OIDCLoginState remembers a login that went to the provider until it comes back to the callback
+type OIDCLoginState struct {
+	State        string    `gorm:"primaryKey;size:64"`
+	CodeVerifier string    `gorm:"size:128"`
+	Nonce        string    `gorm:"size:64"`
+	ExpiresAt    time.Time `gorm:"index"`
+}
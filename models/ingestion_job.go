@@ -0,0 +1,51 @@
+package models
+
+import "time"
+
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	//every chunk is embedded, the documents are on their way into the vector store
+	JobPublishing = "publishing"
+	JobCompleted  = "completed"
+	JobFailed     = "failed"
+
+	ChunkPending = "pending"
+	ChunkDone    = "done"
+	ChunkFailed  = "failed"
+)
+
+type IngestionJob struct {
+	ID           uint `gorm:"primaryKey"`
+	UserID       uint `gorm:"index"`
+	TabID        uint `gorm:"index"`
+	Source       string
+	Status       string `gorm:"size:16"`
+	TotalChunks  int
+	DoneChunks   int
+	FailedChunks int
+	Error        string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	//given on upload and copied onto every document of the job
+	Tags     []string          `gorm:"serializer:json;type:text"`
+	Metadata map[string]string `gorm:"serializer:json;type:text"`
+}
+
+// a chunk waiting to be embedded, kept around so failed ones can be retried
+type IngestionChunk struct {
+	ID        uint `gorm:"primaryKey"`
+	JobID     uint `gorm:"index"`
+	Source    string
+	Symbol    string
+	StartLine int
+	EndLine   int
+	//order the chunk was submitted in, copied onto the document
+	ChunkIndex int
+	Content    string
+	Status     string `gorm:"size:16;index"`
+	Attempts   int
+	Error      string
+	//a failed chunk with attempts left isn't claimed again before this
+	NextAttemptAt time.Time `gorm:"index"`
+}
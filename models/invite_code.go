@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// InviteCode lets one person register while registration is invite only, only its hash is stored
+type InviteCode struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	Prefix    string     `gorm:"size:16" json:"prefix"`
+	Hash      string     `gorm:"size:64;uniqueIndex" json:"-"`
+	CreatedBy uint       `gorm:"index" json:"created_by"`
+	UsedBy    *uint      `json:"used_by"`
+	UsedAt    *time.Time `json:"used_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
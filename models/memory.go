@@ -3,10 +3,12 @@ package models
 import("time")
 
 type Memory struct {
-    ID        uint      `gorm:"primaryKey"`
+    ID        uint              `gorm:"primaryKey"`
     Text      string
-    Embedding []byte    `gorm:"type:blob"`
-    UserID    uint      `gorm:"index"`
-    TabID     uint      `gorm:"index"`
+    Embedding []byte            `gorm:"type:blob"`
+    UserID    uint              `gorm:"index"`
+    TabID     uint              `gorm:"index"`
+    Tags      []string          `gorm:"serializer:json;type:text"`
+    Metadata  map[string]string `gorm:"serializer:json;type:text"`
     CreatedAt time.Time
 }
@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// RefreshToken is the server side record of an issued refresh token. Every refresh hands out a new
+// token in the same family and marks the old one used, so a used token showing up again means it leaked.
+type RefreshToken struct {
+	ID       uint   `gorm:"primaryKey"`
+	JTI      string `gorm:"size:64;uniqueIndex"`
+	FamilyID string `gorm:"size:64;index"`
+	UserID   uint   `gorm:"index"`
+	//when the user logged in to start the family, every token of the family carries it
+	AuthTime  time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
@@ -4,4 +4,8 @@ type Tab struct {
 	ID     uint   `gorm:"primaryKey"`
 	UserID uint   `gorm:"index"`
 	Name   string `gorm:"size:255"`
+	//how the tab's document vectors are held in memory: none, int8 or pq
+	Quantization string `gorm:"size:16;default:none"`
+	//reranker applied to the tab's documents: none, ollama or llm
+	Reranker string `gorm:"size:16;default:none"`
 }
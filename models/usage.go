@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// UsageRecord is one call to the LLM provider made on behalf of a user, with the token counts the
+// provider reported and what they cost at the configured prices
+type UsageRecord struct {
+	ID     uint `gorm:"primaryKey"`
+	UserID uint `gorm:"index:idx_usage_user_time"`
+	//database id of the tab, records outlive the tab so quotas still count them
+	TabID uint
+	//chat, reasoning, rewrite or rerank
+	Purpose      string `gorm:"size:32"`
+	Model        string `gorm:"size:255"`
+	InputTokens  int
+	OutputTokens int
+	Cost         float64
+	CreatedAt    time.Time `gorm:"index:idx_usage_user_time"`
+}
+
+// UsageQuota overrides the default quotas for one user, nil fields keep the default and 0 means unlimited
+type UsageQuota struct {
+	UserID        uint      `gorm:"primaryKey" json:"-"`
+	DailyTokens   *int64    `json:"daily_tokens"`
+	MonthlyTokens *int64    `json:"monthly_tokens"`
+	DailyCost     *float64  `json:"daily_cost"`
+	MonthlyCost   *float64  `json:"monthly_cost"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
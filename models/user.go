@@ -1,7 +1,26 @@
 package models
 
+import "time"
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 type User struct {
 	ID           uint   `gorm:"primaryKey"`
 	UserName     string `gorm:"size:255;unique"`
-	PasswordHash string `gorm:"size:255"`
+	PasswordHash string `gorm:"size:255" json:"-"`
+	Role         string `gorm:"size:16;default:user"`
+	//disabled users can't log in and their tokens and API keys stop working
+	DisabledAt *time.Time
+	//set when an admin resets the password, cleared once the user picks a new one
+	PasswordResetRequired bool
+	//access tokens carry the version they were issued under, bumping it ends every one of them
+	TokenVersion int `json:"-"`
+	CreatedAt    time.Time
+}
+
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
 }
@@ -0,0 +1,145 @@
+package services
+
+import (
+	"context-aware-ai/models"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// API key scopes, a key may only call the routes that accept one of its scopes
+const (
+	ScopeChat   = "chat"
+	ScopeUpload = "upload"
+	ScopeRead   = "read"
+)
+
+// every key starts with this so it can be told apart from a JWT in the Authorization header
+const APIKeyPrefix = "cak_"
+
+var (
+	ErrAPIKeyInvalid  = errors.New("api key invalid, expired or revoked")
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	ErrInvalidScope   = errors.New("invalid scope")
+)
+
+// last_used_at is only written when older than this, so a busy key doesn't write on every request
+const apiKeyTouchInterval = time.Minute
+
+type APIKeyService struct {
+	DB *gorm.DB
+}
+
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// ValidScopes checks the scopes and drops duplicates
+func ValidScopes(scopes []string) ([]string, error) {
+	var out []string
+	seen := map[string]bool{}
+	for _, s := range scopes {
+		switch s {
+		case ScopeChat, ScopeUpload, ScopeRead:
+		default:
+			return nil, fmt.Errorf("%w %q", ErrInvalidScope, s)
+		}
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%w: at least one scope is required", ErrInvalidScope)
+	}
+	return out, nil
+}
+
+// Create stores a new key and returns it in the clear, the only time it is ever available
+func (s *APIKeyService) Create(userID uint, name string, scopes []string, expiresAt *time.Time) (string, *models.APIKey, error) {
+	scopes, err := ValidScopes(scopes)
+	if err != nil {
+		return "", nil, err
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	secret := APIKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+	key := models.APIKey{
+		UserID:    userID,
+		Name:      name,
+		Prefix:    secret[:len(APIKeyPrefix)+6],
+		Hash:      hashSecret(secret),
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	}
+	if err := s.DB.Create(&key).Error; err != nil {
+		return "", nil, err
+	}
+	return secret, &key, nil
+}
+
+func (s *APIKeyService) List(userID uint) ([]models.APIKey, error) {
+	var keys []models.APIKey
+	err := s.DB.Where("user_id = ?", userID).Order("id").Find(&keys).Error
+	return keys, err
+}
+
+func (s *APIKeyService) Revoke(userID, id uint) error {
+	res := s.DB.Model(&models.APIKey{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", id, userID).
+		Update("revoked_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// Authenticate looks the key up by its hash and records that it was used
+func (s *APIKeyService) Authenticate(secret string) (*models.APIKey, error) {
+	var key models.APIKey
+	err := s.DB.Where("hash = ?", hashSecret(secret)).First(&key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if key.RevokedAt != nil || (key.ExpiresAt != nil && now.After(*key.ExpiresAt)) {
+		return nil, ErrAPIKeyInvalid
+	}
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > apiKeyTouchInterval {
+		s.DB.Model(&key).Update("last_used_at", now)
+	}
+	return &key, nil
+}
+
+// HasScope reports whether the key carries any of the scopes
+func HasScope(key *models.APIKey, scopes ...string) bool {
+	for _, have := range key.Scopes {
+		for _, want := range scopes {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// keys are 256 random bits so a plain hash is enough, there is nothing to brute force
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,50 @@
+package services
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Citation is a [n] marker in a generated answer resolved to the context block it points at.
+// Missing is set when the model cited a block number that was never in the prompt.
+type Citation struct {
+	N       int    `json:"n"`
+	File    string `json:"file,omitempty"`
+	ChunkID uint   `json:"chunk_id,omitempty"`
+	Excerpt string `json:"excerpt,omitempty"`
+	Missing bool   `json:"missing,omitempty"`
+}
+
+//long enough to recognise the passage, short enough for a tooltip
+const citationExcerptLen = 200
+
+//[1], [1, 3] and [1][2] are all accepted
+var citationMarker = regexp.MustCompile(`\[(\d+(?:\s*,\s*\d+)*)\]`)
+
+// ParseCitations lists the blocks cited in answer in order of first use, block n is docs[n-1]
+func ParseCitations(answer string, docs []DocumentHit) []Citation {
+	citations := []Citation{}
+	seen := map[int]bool{}
+	for _, m := range citationMarker.FindAllStringSubmatch(answer, -1) {
+		for _, part := range strings.Split(m[1], ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil || seen[n] {
+				continue
+			}
+			seen[n] = true
+			if n < 1 || n > len(docs) {
+				citations = append(citations, Citation{N: n, Missing: true})
+				continue
+			}
+			d := docs[n-1]
+			citations = append(citations, Citation{
+				N:       n,
+				File:    d.Source,
+				ChunkID: d.ID,
+				Excerpt: truncateRunes(strings.TrimSpace(d.Content), citationExcerptLen),
+			})
+		}
+	}
+	return citations
+}
@@ -14,6 +14,11 @@ type ClaudeService struct {
 }
 
 func (cs *ClaudeService) GenerateResponse(prompt string) (string, error) {
+    text, _, err := cs.Generate(prompt)
+    return text, err
+}
+
+func (cs *ClaudeService) Generate(prompt string) (string, Usage, error) {
     url := "https://api.anthropic.com/v1/messages"
 
     payload := map[string]interface{}{
@@ -29,12 +34,12 @@ func (cs *ClaudeService) GenerateResponse(prompt string) (string, error) {
 
     data, err := json.Marshal(payload)
     if err != nil {
-        return "", err
+        return "", Usage{}, err
     }
 
     req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
     if err != nil {
-        return "", err
+        return "", Usage{}, err
     }
 
     req.Header.Set("Content-Type", "application/json")
@@ -43,28 +48,37 @@ func (cs *ClaudeService) GenerateResponse(prompt string) (string, error) {
 
     resp, err := http.DefaultClient.Do(req)
     if err != nil {
-        return "", err
+        return "", Usage{}, err
     }
     defer resp.Body.Close()
 
     body, err := ioutil.ReadAll(resp.Body)
     if err != nil {
-        return "", err
+        return "", Usage{}, err
     }
 
     var r struct {
         Content []struct {
             Text string `json:"text"`
         } `json:"content"`
+        Model string `json:"model"`
+        Usage struct {
+            InputTokens  int `json:"input_tokens"`
+            OutputTokens int `json:"output_tokens"`
+        } `json:"usage"`
     }
 
     if err := json.Unmarshal(body, &r); err != nil {
-        return "", err
+        return "", Usage{}, err
     }
 
     if len(r.Content) == 0 {
-        return "", fmt.Errorf("no content returned")
+        return "", Usage{}, fmt.Errorf("no content returned")
     }
 
-    return r.Content[0].Text, nil
+    usage := Usage{Model: r.Model, InputTokens: r.Usage.InputTokens, OutputTokens: r.Usage.OutputTokens}
+    if usage.Model == "" {
+        usage.Model = cs.Model
+    }
+    return r.Content[0].Text, usage, nil
 }
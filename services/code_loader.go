@@ -0,0 +1,237 @@
+package services
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// CodeChunk is one indexable piece of a source file along with where it came from
+type CodeChunk struct {
+	Path      string
+	Symbol    string
+	StartLine int
+	EndLine   int
+	Content   string
+}
+
+//functions longer than this get split so one chunk doesn't swamp the embedding model
+const maxChunkLines = 120
+
+//top level definitions for languages we don't have a real parser for
+var definitionPatterns = map[string]*regexp.Regexp{
+	".py":    regexp.MustCompile(`^(?:async\s+)?(?:def|class)\s+([A-Za-z_]\w*)`),
+	".js":    regexp.MustCompile(`^(?:export\s+)?(?:default\s+)?(?:async\s+)?(?:function\*?\s+([A-Za-z_$][\w$]*)|class\s+([A-Za-z_$][\w$]*)|(?:const|let|var)\s+([A-Za-z_$][\w$]*)\s*=\s*(?:async\s+)?(?:function|\())`),
+	".ts":    regexp.MustCompile(`^(?:export\s+)?(?:default\s+)?(?:abstract\s+)?(?:async\s+)?(?:function\*?\s+([A-Za-z_$][\w$]*)|class\s+([A-Za-z_$][\w$]*)|interface\s+([A-Za-z_$][\w$]*)|type\s+([A-Za-z_$][\w$]*)\s*=|enum\s+([A-Za-z_$][\w$]*)|(?:const|let|var)\s+([A-Za-z_$][\w$]*)\s*=\s*(?:async\s+)?(?:function|\())`),
+	".rs":    regexp.MustCompile(`^(?:pub(?:\([^)]*\))?\s+)?(?:async\s+)?(?:unsafe\s+)?(?:fn|struct|enum|trait|mod|impl(?:<[^>]*>)?)\s+([A-Za-z_]\w*)`),
+	".rb":    regexp.MustCompile(`^(?:def|class|module)\s+([A-Za-z_][\w.:]*[?!]?)`),
+	".java":  regexp.MustCompile(`^\s{0,4}(?:(?:public|private|protected|static|final|abstract|synchronized)\s+)*(?:class|interface|enum|record|[\w<>\[\],\s]+?)\s+([A-Za-z_]\w*)\s*[({<]`),
+	".c":     regexp.MustCompile(`^(?:static\s+|inline\s+|extern\s+)*(?:struct\s+|enum\s+|union\s+)?[A-Za-z_][\w\s\*]*?\b([A-Za-z_]\w*)\s*\([^;]*$`),
+	".php":   regexp.MustCompile(`^\s{0,4}(?:(?:public|private|protected|static|abstract|final)\s+)*(?:function|class|interface|trait)\s+([A-Za-z_]\w*)`),
+	".kt":    regexp.MustCompile(`^(?:(?:public|private|internal|data|sealed|abstract|open|suspend)\s+)*(?:fun|class|object|interface)\s+(?:<[^>]*>\s*)?([A-Za-z_][\w.]*)`),
+	".swift": regexp.MustCompile(`^(?:(?:public|private|internal|open|final|static)\s+)*(?:func|class|struct|enum|protocol|extension)\s+([A-Za-z_]\w*)`),
+	".scala": regexp.MustCompile(`^(?:(?:private|protected|final|sealed|abstract|case|implicit)\s+)*(?:def|class|object|trait)\s+([A-Za-z_]\w*)`),
+}
+
+//extensions that share a pattern with one above
+var definitionAliases = map[string]string{
+	".jsx": ".js", ".mjs": ".js", ".cjs": ".js",
+	".tsx": ".ts",
+	".h":   ".c", ".cc": ".c", ".cpp": ".c", ".hpp": ".c", ".cs": ".java",
+}
+
+// IsCodeFile reports whether ChunkSource knows how to split the file along definitions
+func IsCodeFile(filePath string) bool {
+	ext := strings.ToLower(path.Ext(filePath))
+	if ext == ".go" {
+		return true
+	}
+	_, ok := definitionPattern(ext)
+	return ok
+}
+
+func definitionPattern(ext string) (*regexp.Regexp, bool) {
+	if alias, ok := definitionAliases[ext]; ok {
+		ext = alias
+	}
+	re, ok := definitionPatterns[ext]
+	return re, ok
+}
+
+// ChunkSource splits a source file along function and type boundaries.
+// Go files are parsed with go/parser, everything else goes through a per language heuristic.
+func ChunkSource(filePath string, src []byte) []CodeChunk {
+	ext := strings.ToLower(path.Ext(filePath))
+	if ext == ".go" {
+		if chunks, err := chunkGoSource(filePath, src); err == nil {
+			return chunks
+		}
+		//fall through to the generic splitter if the file doesn't parse
+	}
+	re, _ := definitionPattern(ext)
+	return chunkByHeuristic(filePath, src, re)
+}
+
+func chunkGoSource(filePath string, src []byte) ([]CodeChunk, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filePath, src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(src), "\n")
+
+	var chunks []CodeChunk
+	//package clause, imports and anything else before the first real declaration
+	headerEnd := len(lines)
+	for _, decl := range file.Decls {
+		if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.IMPORT {
+			headerEnd = fset.Position(gen.End()).Line
+			continue
+		}
+		headerEnd = fset.Position(declStart(decl)).Line - 1
+		break
+	}
+	if headerEnd > 0 {
+		chunks = append(chunks, makeChunks(filePath, "package "+file.Name.Name, lines, 1, headerEnd)...)
+	}
+
+	for _, decl := range file.Decls {
+		start := fset.Position(declStart(decl)).Line
+		end := fset.Position(decl.End()).Line
+		if start <= headerEnd {
+			continue
+		}
+		symbol := goDeclName(decl)
+		chunks = append(chunks, makeChunks(filePath, symbol, lines, start, end)...)
+	}
+	return chunks, nil
+}
+
+//include the doc comment so the chunk carries the description of the symbol
+func declStart(decl ast.Decl) token.Pos {
+	switch d := decl.(type) {
+	case *ast.FuncDecl:
+		if d.Doc != nil {
+			return d.Doc.Pos()
+		}
+	case *ast.GenDecl:
+		if d.Doc != nil {
+			return d.Doc.Pos()
+		}
+	}
+	return decl.Pos()
+}
+
+func goDeclName(decl ast.Decl) string {
+	switch d := decl.(type) {
+	case *ast.FuncDecl:
+		if d.Recv != nil && len(d.Recv.List) > 0 {
+			return receiverName(d.Recv.List[0].Type) + "." + d.Name.Name
+		}
+		return d.Name.Name
+	case *ast.GenDecl:
+		var names []string
+		for _, spec := range d.Specs {
+			switch s := spec.(type) {
+			case *ast.TypeSpec:
+				names = append(names, s.Name.Name)
+			case *ast.ValueSpec:
+				for _, n := range s.Names {
+					names = append(names, n.Name)
+				}
+			}
+		}
+		return strings.Join(names, ", ")
+	}
+	return ""
+}
+
+func receiverName(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return receiverName(t.X)
+	case *ast.Ident:
+		return t.Name
+	case *ast.IndexExpr:
+		return receiverName(t.X)
+	case *ast.IndexListExpr:
+		return receiverName(t.X)
+	}
+	return ""
+}
+
+func chunkByHeuristic(filePath string, src []byte, re *regexp.Regexp) []CodeChunk {
+	lines := strings.Split(string(src), "\n")
+	if re == nil {
+		return makeChunks(filePath, "", lines, 1, len(lines))
+	}
+
+	var chunks []CodeChunk
+	start, symbol := 1, ""
+	for i, line := range lines {
+		name, ok := matchDefinition(re, line)
+		if !ok {
+			continue
+		}
+		//pull leading comments and decorators into the definition they describe
+		boundary := i
+		for boundary >= start && isLeadingLine(lines[boundary-1]) {
+			boundary--
+		}
+		if boundary >= start {
+			chunks = append(chunks, makeChunks(filePath, symbol, lines, start, boundary)...)
+			start = boundary + 1
+		}
+		symbol = name
+	}
+	chunks = append(chunks, makeChunks(filePath, symbol, lines, start, len(lines))...)
+	return chunks
+}
+
+func matchDefinition(re *regexp.Regexp, line string) (string, bool) {
+	m := re.FindStringSubmatch(line)
+	if m == nil {
+		return "", false
+	}
+	for _, g := range m[1:] {
+		if g != "" {
+			return g, true
+		}
+	}
+	return "", true
+}
+
+func isLeadingLine(line string) bool {
+	t := strings.TrimSpace(line)
+	return strings.HasPrefix(t, "//") || strings.HasPrefix(t, "#") || strings.HasPrefix(t, "@") ||
+		strings.HasPrefix(t, "/*") || strings.HasPrefix(t, "*") || strings.HasPrefix(t, "///")
+}
+
+//lines are 1 based and inclusive, blank chunks are dropped and long ones split
+func makeChunks(filePath, symbol string, lines []string, start, end int) []CodeChunk {
+	if end > len(lines) {
+		end = len(lines)
+	}
+	var chunks []CodeChunk
+	for s := start; s <= end; s += maxChunkLines {
+		e := s + maxChunkLines - 1
+		if e > end {
+			e = end
+		}
+		content := strings.Join(lines[s-1:e], "\n")
+		if strings.TrimSpace(content) == "" {
+			continue
+		}
+		chunks = append(chunks, CodeChunk{
+			Path:      filePath,
+			Symbol:    symbol,
+			StartLine: s,
+			EndLine:   e,
+			Content:   content,
+		})
+	}
+	return chunks
+}
@@ -0,0 +1,172 @@
+package services
+
+import (
+	"context-aware-ai/models"
+	"strings"
+)
+
+// mmrSelect picks up to k items from a ranked candidate list by maximal marginal relevance and
+// returns their indexes in pick order. Relevance comes from the rank, so it follows whatever
+// produced the list (vector, fused, reranked or recency weighted), and similarity is the cosine
+// between candidates. lambda 1 keeps the ranking, lower values trade relevance for diversity.
+func mmrSelect(vecs [][]float32, k int, lambda float64) []int {
+	n := len(vecs)
+	if k > n {
+		k = n
+	}
+	picked := make([]int, 0, k)
+	used := make([]bool, n)
+	//highest similarity of each candidate to anything picked so far
+	maxSim := make([]float64, n)
+	for len(picked) < k {
+		best, bestScore := -1, 0.0
+		for i := 0; i < n; i++ {
+			if used[i] {
+				continue
+			}
+			relevance := 1 - float64(i)/float64(n)
+			score := lambda*relevance - (1-lambda)*maxSim[i]
+			if best < 0 || score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		used[best] = true
+		picked = append(picked, best)
+		for i := 0; i < n; i++ {
+			if used[i] || vecs[i] == nil || vecs[best] == nil {
+				continue
+			}
+			if sim := dot32(vecs[i], vecs[best]); sim > maxSim[i] {
+				maxSim[i] = sim
+			}
+		}
+	}
+	return picked
+}
+
+//lambda outside (0, 1) leaves the ranking alone
+func mmrEnabled(lambda float64) bool {
+	return lambda > 0 && lambda < 1
+}
+
+func diversifyDocuments(docs []DocumentHit, k int, lambda float64) []DocumentHit {
+	vecs := make([][]float32, len(docs))
+	for i, d := range docs {
+		vecs[i] = d.vec
+	}
+	out := make([]DocumentHit, 0, k)
+	for _, i := range mmrSelect(vecs, k, lambda) {
+		out = append(out, docs[i])
+	}
+	return out
+}
+
+// mergeAdjacentChunks joins documents that were next to each other in the same upload into one
+// block, placed where the better ranked of them was. The overlap chunkText adds between
+// neighbouring chunks is only kept once.
+// The block keeps the highest score of its chunks.
+func mergeAdjacentChunks(docs []DocumentHit) []DocumentHit {
+	type chunkKey struct {
+		jobID uint
+		index int
+	}
+	byPos := map[chunkKey]int{}
+	for i, d := range docs {
+		if d.JobID != 0 {
+			byPos[chunkKey{d.JobID, d.ChunkIndex}] = i
+		}
+	}
+
+	merged := make([]bool, len(docs))
+	var out []DocumentHit
+	for i, d := range docs {
+		if merged[i] {
+			continue
+		}
+		merged[i] = true
+		if d.JobID == 0 {
+			out = append(out, d)
+			continue
+		}
+		//walk back to the first chunk of the run, then forward to the last
+		first := d.ChunkIndex
+		for {
+			j, ok := byPos[chunkKey{d.JobID, first - 1}]
+			if !ok || merged[j] || !adjacentChunks(docs[j].Document, docs[byPos[chunkKey{d.JobID, first}]].Document) {
+				break
+			}
+			first--
+		}
+		prev := byPos[chunkKey{d.JobID, first}]
+		block := docs[prev]
+		merged[prev] = true
+		for next := first + 1; ; next++ {
+			j, ok := byPos[chunkKey{d.JobID, next}]
+			if !ok || (merged[j] && j != i) || !adjacentChunks(docs[prev].Document, docs[j].Document) {
+				break
+			}
+			prev = j
+			merged[j] = true
+			block.Document = joinChunks(block.Document, docs[j].Document)
+			if docs[j].Score > block.Score {
+				block.Score = docs[j].Score
+			}
+		}
+		out = append(out, block)
+	}
+	return out
+}
+
+//b directly follows a in the same file, code chunks also need touching line ranges
+func adjacentChunks(a, b models.Document) bool {
+	if a.Source != b.Source {
+		return false
+	}
+	if a.StartLine > 0 && b.StartLine > 0 {
+		return b.StartLine <= a.EndLine+1
+	}
+	return true
+}
+
+func joinChunks(a, b models.Document) models.Document {
+	if a.StartLine > 0 && b.StartLine > 0 {
+		//code chunks carry line ranges, skip any lines both cover
+		lines := strings.Split(b.Content, "\n")
+		if skip := a.EndLine - b.StartLine + 1; skip > 0 && skip < len(lines) {
+			lines = lines[skip:]
+		}
+		a.Content = a.Content + "\n" + strings.Join(lines, "\n")
+		if b.EndLine > a.EndLine {
+			a.EndLine = b.EndLine
+		}
+		if b.Symbol != "" && b.Symbol != a.Symbol {
+			if a.Symbol == "" {
+				a.Symbol = b.Symbol
+			} else {
+				a.Symbol += ", " + b.Symbol
+			}
+		}
+		return a
+	}
+
+	aw := strings.Fields(a.Content)
+	bw := strings.Fields(b.Content)
+	overlap := 0
+	for n := min(len(aw), len(bw)); n > 0; n-- {
+		if equalWords(aw[len(aw)-n:], bw[:n]) {
+			overlap = n
+			break
+		}
+	}
+	a.Content = strings.Join(append(aw, bw[overlap:]...), " ")
+	return a
+}
+
+func equalWords(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
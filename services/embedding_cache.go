@@ -0,0 +1,188 @@
+package services
+
+import (
+	"container/list"
+	"context-aware-ai/models"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// EmbeddingCache wraps an EmbeddingService with an in-memory LRU backed by a sqlite table.
+// Entries are keyed by (model, sha256(text)) so switching models never returns stale vectors.
+type EmbeddingCache struct {
+	Inner    EmbeddingService
+	DB       *gorm.DB
+	Model    string
+	Capacity int
+
+	mu    sync.Mutex
+	lru   *list.List
+	items map[string]*list.Element
+
+	memoryHits atomic.Int64
+	diskHits   atomic.Int64
+	misses     atomic.Int64
+}
+
+type cacheItem struct {
+	hash string
+	emb  []float64
+}
+
+type EmbeddingCacheStats struct {
+	Model      string  `json:"model"`
+	MemoryHits int64   `json:"memory_hits"`
+	DiskHits   int64   `json:"disk_hits"`
+	Misses     int64   `json:"misses"`
+	HitRate    float64 `json:"hit_rate"`
+	Entries    int     `json:"entries"`
+	Capacity   int     `json:"capacity"`
+}
+
+func (c *EmbeddingCache) GetEmbedding(text string) ([]float64, error) {
+	embs, err := c.GetEmbeddings([]string{text})
+	if err != nil {
+		return nil, err
+	}
+	return embs[0], nil
+}
+
+// GetEmbeddings answers from memory, then sqlite, and only sends the remaining texts to the provider
+func (c *EmbeddingCache) GetEmbeddings(texts []string) ([][]float64, error) {
+	embs := make([][]float64, len(texts))
+	hashes := make([]string, len(texts))
+	missing := map[string][]int{}
+	for i, t := range texts {
+		hashes[i] = hashText(t)
+		if emb, ok := c.getMemory(hashes[i]); ok {
+			c.memoryHits.Add(1)
+			embs[i] = emb
+			continue
+		}
+		missing[hashes[i]] = append(missing[hashes[i]], i)
+	}
+	if len(missing) == 0 {
+		return embs, nil
+	}
+
+	keys := make([]string, 0, len(missing))
+	for h := range missing {
+		keys = append(keys, h)
+	}
+	var rows []models.EmbeddingCacheEntry
+	if err := c.DB.Where("model = ? AND hash IN ?", c.Model, keys).Find(&rows).Error; err != nil {
+		log.Printf("embedding cache lookup failed: %v", err)
+	}
+	for _, row := range rows {
+		emb, err := decodeRawEmbedding(row.Embedding)
+		if err != nil {
+			continue
+		}
+		c.putMemory(row.Hash, emb)
+		for _, i := range missing[row.Hash] {
+			c.diskHits.Add(1)
+			embs[i] = emb
+		}
+		delete(missing, row.Hash)
+	}
+	if len(missing) == 0 {
+		return embs, nil
+	}
+
+	//identical texts in one batch are only sent once
+	var toEmbed []string
+	var order []string
+	for h, idx := range missing {
+		order = append(order, h)
+		toEmbed = append(toEmbed, texts[idx[0]])
+	}
+	fresh, err := c.Inner.GetEmbeddings(toEmbed)
+	if err != nil {
+		return nil, err
+	}
+
+	newRows := make([]models.EmbeddingCacheEntry, len(order))
+	for j, h := range order {
+		for _, i := range missing[h] {
+			c.misses.Add(1)
+			embs[i] = fresh[j]
+		}
+		c.putMemory(h, fresh[j])
+		newRows[j] = models.EmbeddingCacheEntry{Model: c.Model, Hash: h, Embedding: encodeRawEmbedding(fresh[j])}
+	}
+	//the cache is best effort, a failed write just means embedding again later
+	if err := c.DB.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(&newRows, 100).Error; err != nil {
+		log.Printf("embedding cache write failed: %v", err)
+	}
+	return embs, nil
+}
+
+func (c *EmbeddingCache) Stats() EmbeddingCacheStats {
+	c.mu.Lock()
+	entries := len(c.items)
+	c.mu.Unlock()
+
+	stats := EmbeddingCacheStats{
+		Model:      c.Model,
+		MemoryHits: c.memoryHits.Load(),
+		DiskHits:   c.diskHits.Load(),
+		Misses:     c.misses.Load(),
+		Entries:    entries,
+		Capacity:   c.capacity(),
+	}
+	if total := stats.MemoryHits + stats.DiskHits + stats.Misses; total > 0 {
+		stats.HitRate = float64(stats.MemoryHits+stats.DiskHits) / float64(total)
+	}
+	return stats
+}
+
+func (c *EmbeddingCache) getMemory(hash string) ([]float64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.items == nil {
+		return nil, false
+	}
+	el, ok := c.items[hash]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheItem).emb, true
+}
+
+func (c *EmbeddingCache) putMemory(hash string, emb []float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.items == nil {
+		c.items = map[string]*list.Element{}
+		c.lru = list.New()
+	}
+	if el, ok := c.items[hash]; ok {
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.items[hash] = c.lru.PushFront(&cacheItem{hash: hash, emb: emb})
+	for c.lru.Len() > c.capacity() {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheItem).hash)
+	}
+}
+
+func (c *EmbeddingCache) capacity() int {
+	if c.Capacity <= 0 {
+		return 10000
+	}
+	return c.Capacity
+}
+
+func hashText(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,127 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Embeddings are stored as a 5 byte header followed by little-endian float32 values:
+//
+//	0x00 'E' 'V' <version> <flags>
+//
+// The leading zero byte can't start a gob stream or a JSON array, so rows written
+// before the codec existed are told apart by the header alone.
+const (
+	embeddingVersion    byte = 1
+	embeddingHeaderSize      = 5
+	//the vector has unit length, dot product equals cosine similarity
+	flagNormalized byte = 1
+)
+
+var embeddingMagic = []byte{0x00, 'E', 'V'}
+
+var ErrEmbeddingFormat = errors.New("embedding is not in the binary format")
+
+func encodeVector(vec []float32, flags byte) []byte {
+	out := make([]byte, embeddingHeaderSize+4*len(vec))
+	copy(out, embeddingMagic)
+	out[3] = embeddingVersion
+	out[4] = flags
+	for i, v := range vec {
+		binary.LittleEndian.PutUint32(out[embeddingHeaderSize+4*i:], math.Float32bits(v))
+	}
+	return out
+}
+
+func decodeVector(b []byte) ([]float32, byte, error) {
+	if !isEncodedEmbedding(b) {
+		return nil, 0, ErrEmbeddingFormat
+	}
+	if b[3] != embeddingVersion {
+		return nil, 0, fmt.Errorf("unsupported embedding version %d", b[3])
+	}
+	body := b[embeddingHeaderSize:]
+	if len(body)%4 != 0 {
+		return nil, 0, fmt.Errorf("embedding body is %d bytes, not a multiple of 4", len(body))
+	}
+	vec := make([]float32, len(body)/4)
+	for i := range vec {
+		vec[i] = math.Float32frombits(binary.LittleEndian.Uint32(body[4*i:]))
+	}
+	return vec, b[4], nil
+}
+
+func isEncodedEmbedding(b []byte) bool {
+	return len(b) >= embeddingHeaderSize && bytes.Equal(b[:3], embeddingMagic)
+}
+
+// encodeEmbedding is what documents and memories store, normalized up front so search is a dot product
+func encodeEmbedding(vec []float64) []byte {
+	return encodeVector(normalize32(vec), flagNormalized)
+}
+
+// decodeEmbedding returns the stored vector with unit length
+func decodeEmbedding(b []byte) ([]float32, error) {
+	vec, flags, err := decodeVector(b)
+	if err != nil {
+		return nil, err
+	}
+	if flags&flagNormalized == 0 {
+		vec = normalize32(toFloat64(vec))
+	}
+	return vec, nil
+}
+
+// the embedding cache keeps provider output as is, callers may rely on the magnitude
+func encodeRawEmbedding(vec []float64) []byte {
+	return encodeVector(toFloat32(vec), 0)
+}
+
+func decodeRawEmbedding(b []byte) ([]float64, error) {
+	vec, _, err := decodeVector(b)
+	if err != nil {
+		return nil, err
+	}
+	return toFloat64(vec), nil
+}
+
+// NormalizeEmbedding converts a provider embedding to the unit float32 form vector stores take
+func NormalizeEmbedding(vec []float64) []float32 {
+	return normalize32(vec)
+}
+
+// decodeLegacyEmbedding reads the formats used before the codec, JSON arrays for memories and gob for the rest
+func decodeLegacyEmbedding(b []byte) ([]float64, error) {
+	var vec []float64
+	if len(b) > 0 && (b[0] == '[' || b[0] == 'n') {
+		if err := json.Unmarshal(b, &vec); err != nil {
+			return nil, err
+		}
+		return vec, nil
+	}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&vec); err != nil {
+		return nil, err
+	}
+	return vec, nil
+}
+
+func toFloat32(vec []float64) []float32 {
+	out := make([]float32, len(vec))
+	for i, v := range vec {
+		out[i] = float32(v)
+	}
+	return out
+}
+
+func toFloat64(vec []float32) []float64 {
+	out := make([]float64, len(vec))
+	for i, v := range vec {
+		out[i] = float64(v)
+	}
+	return out
+}
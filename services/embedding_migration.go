@@ -0,0 +1,104 @@
+package services
+
+import (
+	"context-aware-ai/models"
+	"log"
+
+	"gorm.io/gorm"
+)
+
+//rows whose embedding doesn't start with the codec magic (0x00 'E' 'V')
+const legacyEmbeddingSQL = "length(embedding) > 0 AND hex(substr(embedding, 1, 3)) != '004556'"
+
+const embeddingMigrationBatch = 500
+
+// MigrateEmbeddings rewrites embeddings still stored as gob or JSON into the binary codec.
+// Only rows without the header are read, so once everything is converted it costs one query
+// per table and is safe to run on every startup.
+func MigrateEmbeddings(db *gorm.DB) (int, error) {
+	total := 0
+	for _, table := range []string{"documents", "memories"} {
+		n, err := migrateEmbeddingTable(db, table)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	n, err := migrateEmbeddingCache(db)
+	return total + n, err
+}
+
+func migrateEmbeddingTable(db *gorm.DB, table string) (int, error) {
+	type row struct {
+		ID        uint
+		Embedding []byte
+	}
+	migrated := 0
+	//rows that can't be decoded are left alone and reported instead of failing startup
+	var skip []uint
+	for {
+		q := db.Table(table).Select("id, embedding").Where(legacyEmbeddingSQL)
+		if len(skip) > 0 {
+			q = q.Where("id NOT IN ?", skip)
+		}
+		var rows []row
+		if err := q.Order("id").Limit(embeddingMigrationBatch).Scan(&rows).Error; err != nil {
+			return migrated, err
+		}
+		if len(rows) == 0 {
+			return migrated, nil
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			for _, r := range rows {
+				vec, err := decodeLegacyEmbedding(r.Embedding)
+				if err != nil || len(vec) == 0 {
+					log.Printf("skipping unreadable embedding in %s row %d: %v", table, r.ID, err)
+					skip = append(skip, r.ID)
+					continue
+				}
+				if err := tx.Table(table).Where("id = ?", r.ID).Update("embedding", encodeEmbedding(vec)).Error; err != nil {
+					return err
+				}
+				migrated++
+			}
+			return nil
+		})
+		if err != nil {
+			return migrated, err
+		}
+	}
+}
+
+func migrateEmbeddingCache(db *gorm.DB) (int, error) {
+	migrated := 0
+	for {
+		var rows []models.EmbeddingCacheEntry
+		if err := db.Where(legacyEmbeddingSQL).Limit(embeddingMigrationBatch).Find(&rows).Error; err != nil {
+			return migrated, err
+		}
+		if len(rows) == 0 {
+			return migrated, nil
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			for _, r := range rows {
+				q := tx.Model(&models.EmbeddingCacheEntry{}).Where("model = ? AND hash = ?", r.Model, r.Hash)
+				vec, err := decodeLegacyEmbedding(r.Embedding)
+				if err != nil || len(vec) == 0 {
+					//it's only a cache, an unreadable entry is dropped and embedded again on demand
+					if err := q.Delete(&models.EmbeddingCacheEntry{}).Error; err != nil {
+						return err
+					}
+					continue
+				}
+				if err := q.Update("embedding", encodeRawEmbedding(vec)).Error; err != nil {
+					return err
+				}
+				migrated++
+			}
+			return nil
+		})
+		if err != nil {
+			return migrated, err
+		}
+	}
+}
@@ -0,0 +1,7 @@
+package services
+
+type EmbeddingService interface {
+    GetEmbedding(text string) ([]float64, error)
+    //one vector per input, in the same order
+    GetEmbeddings(texts []string) ([][]float64, error)
+}
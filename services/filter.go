@@ -0,0 +1,282 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// FilterCondition is one clause of a filter expression such as `tag in (hr)`.
+// Field is source, symbol, tag, created_after, created_before or a metadata key.
+type FilterCondition struct {
+	Field  string
+	Op     string
+	Values []string
+	//parsed value of created_after and created_before
+	Time time.Time
+}
+
+const (
+	FilterEq    = "="
+	FilterNe    = "!="
+	FilterIn    = "in"
+	FilterNotIn = "not in"
+)
+
+//fields with their own meaning, everything else is looked up in the metadata
+const (
+	FilterSource        = "source"
+	FilterSymbol        = "symbol"
+	FilterTag           = "tag"
+	FilterCreatedAfter  = "created_after"
+	FilterCreatedBefore = "created_before"
+)
+
+var ErrInvalidFilter = errors.New("invalid filter")
+
+var (
+	filterClause = regexp.MustCompile(`(?is)^\s*([A-Za-z0-9_.\-]+)\s*(!=|=|not\s+in\b|in\b)\s*(.*?)\s*$`)
+	metadataKey  = regexp.MustCompile(`^[A-Za-z0-9_.\-]{1,64}$`)
+)
+
+// IsReservedMetadataKey reports whether key is taken by a built-in filter field
+func IsReservedMetadataKey(key string) bool {
+	switch key {
+	case FilterSource, FilterSymbol, FilterTag, FilterCreatedAfter, FilterCreatedBefore:
+		return true
+	}
+	return false
+}
+
+// ValidMetadataKey is what upload and memory metadata keys must look like to be filterable
+func ValidMetadataKey(key string) bool {
+	return metadataKey.MatchString(key) && !IsReservedMetadataKey(key)
+}
+
+// ParseFilter parses clauses joined by AND, e.g.
+// `source=handbook.pdf AND created_after=2026-01-01 AND tag in (hr, legal)`.
+// Values may be quoted with ' or ", dates are YYYY-MM-DD or RFC 3339 in server time.
+func ParseFilter(expr string) ([]FilterCondition, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, nil
+	}
+	var conds []FilterCondition
+	for _, clause := range splitFilter(expr) {
+		cond, err := parseClause(clause)
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, cond)
+	}
+	return conds, nil
+}
+
+func parseClause(clause string) (FilterCondition, error) {
+	m := filterClause.FindStringSubmatch(clause)
+	if m == nil {
+		return FilterCondition{}, fmt.Errorf("%w: can't read %q", ErrInvalidFilter, strings.TrimSpace(clause))
+	}
+	cond := FilterCondition{Field: strings.ToLower(m[1]), Op: strings.ToLower(strings.Join(strings.Fields(m[2]), " "))}
+
+	if cond.Op == FilterIn || cond.Op == FilterNotIn {
+		list := m[3]
+		if !strings.HasPrefix(list, "(") || !strings.HasSuffix(list, ")") {
+			return cond, fmt.Errorf("%w: %s needs a list like (a, b)", ErrInvalidFilter, cond.Op)
+		}
+		for _, v := range splitOutsideQuotes(list[1:len(list)-1], ',') {
+			if v = unquoteFilterValue(v); v != "" {
+				cond.Values = append(cond.Values, v)
+			}
+		}
+		if len(cond.Values) == 0 {
+			return cond, fmt.Errorf("%w: empty list for %s", ErrInvalidFilter, cond.Field)
+		}
+	} else {
+		v := unquoteFilterValue(m[3])
+		if v == "" {
+			return cond, fmt.Errorf("%w: missing value for %s", ErrInvalidFilter, cond.Field)
+		}
+		cond.Values = []string{v}
+	}
+
+	if cond.Field == FilterCreatedAfter || cond.Field == FilterCreatedBefore {
+		if cond.Op != FilterEq {
+			return cond, fmt.Errorf("%w: %s only supports =", ErrInvalidFilter, cond.Field)
+		}
+		t, err := parseFilterTime(cond.Values[0])
+		if err != nil {
+			return cond, fmt.Errorf("%w: %s is not a date", ErrInvalidFilter, cond.Values[0])
+		}
+		cond.Time = t
+	}
+	return cond, nil
+}
+
+func parseFilterTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, time.Local)
+}
+
+//splits on AND outside quotes and parentheses
+func splitFilter(expr string) []string {
+	var parts []string
+	var quote rune
+	depth, start := 0, 0
+	runes := []rune(expr)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case depth == 0 && i+5 <= len(runes) && isSpace(r) &&
+			strings.EqualFold(string(runes[i+1:i+4]), "and") && isSpace(runes[i+4]):
+			parts = append(parts, string(runes[start:i]))
+			start = i + 5
+			i += 4
+		}
+	}
+	return append(parts, string(runes[start:]))
+}
+
+func splitOutsideQuotes(s string, sep rune) []string {
+	var parts []string
+	var quote rune
+	var cur strings.Builder
+	for _, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == sep:
+			parts = append(parts, cur.String())
+			cur.Reset()
+			continue
+		}
+		cur.WriteRune(r)
+	}
+	return append(parts, cur.String())
+}
+
+func unquoteFilterValue(v string) string {
+	v = strings.TrimSpace(v)
+	if len(v) >= 2 && (v[0] == '\'' || v[0] == '"') && v[len(v)-1] == v[0] {
+		return v[1 : len(v)-1]
+	}
+	return v
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n'
+}
+
+// filterFor drops the clauses that don't apply to a collection. Memories have no file, so a
+// source or symbol clause narrows the documents without hiding the chat history.
+func filterFor(collection string, conds []FilterCondition) []FilterCondition {
+	if collection != KindMemories {
+		return conds
+	}
+	var out []FilterCondition
+	for _, c := range conds {
+		if c.Field != FilterSource && c.Field != FilterSymbol {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// applyFilter adds the conditions to a query over the documents or memories table
+func applyFilter(q *gorm.DB, conds []FilterCondition) *gorm.DB {
+	for _, c := range conds {
+		switch c.Field {
+		case FilterCreatedAfter:
+			q = q.Where("created_at >= ?", c.Time)
+		case FilterCreatedBefore:
+			q = q.Where("created_at < ?", c.Time)
+		case FilterTag:
+			hasTag := "EXISTS (SELECT 1 FROM json_each(tags) WHERE json_each.value IN ?)"
+			if negated(c.Op) {
+				q = q.Where("NOT "+hasTag, c.Values)
+			} else {
+				q = q.Where(hasTag, c.Values)
+			}
+		case FilterSource, FilterSymbol:
+			q = sqlCompare(q, c.Field, nil, c)
+		default:
+			//the key is bound as a json path so it never ends up in the statement
+			q = sqlCompare(q, "json_extract(metadata, ?)", []interface{}{`$."` + c.Field + `"`}, c)
+		}
+	}
+	return q
+}
+
+//negated clauses also match rows that don't have the field at all
+func sqlCompare(q *gorm.DB, expr string, exprArgs []interface{}, c FilterCondition) *gorm.DB {
+	twice := append(append([]interface{}{}, exprArgs...), exprArgs...)
+	switch c.Op {
+	case FilterNe:
+		return q.Where("("+expr+" IS NULL OR "+expr+" != ?)", append(twice, c.Values[0])...)
+	case FilterIn:
+		return q.Where(expr+" IN ?", append(exprArgs, c.Values)...)
+	case FilterNotIn:
+		return q.Where("("+expr+" IS NULL OR "+expr+" NOT IN ?)", append(twice, c.Values)...)
+	default:
+		return q.Where(expr+" = ?", append(exprArgs, c.Values[0])...)
+	}
+}
+
+func negated(op string) bool {
+	return op == FilterNe || op == FilterNotIn
+}
+
+// matchesConditions evaluates the conditions against a record, for stores that filter in process
+func matchesConditions(r VectorRecord, conds []FilterCondition) bool {
+	for _, c := range conds {
+		var ok bool
+		switch c.Field {
+		case FilterCreatedAfter:
+			ok = !r.CreatedAt.Before(c.Time)
+		case FilterCreatedBefore:
+			ok = r.CreatedAt.Before(c.Time)
+		case FilterTag:
+			ok = anyIn(r.Tags, c.Values) != negated(c.Op)
+		default:
+			value, present := r.Metadata[c.Field]
+			ok = present && anyIn([]string{value}, c.Values)
+			if negated(c.Op) {
+				ok = !ok
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func anyIn(have, want []string) bool {
+	for _, h := range have {
+		for _, w := range want {
+			if h == w {
+				return true
+			}
+		}
+	}
+	return false
+}
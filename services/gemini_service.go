@@ -9,11 +9,17 @@ import (
 )
 
 type GeminiService struct {
-    APIKey string
-    Model  string
+    APIKey         string
+    Model          string
+    EmbeddingModel string
 }
 
 func (gs *GeminiService) GenerateResponse(prompt string) (string, error) {
+    text, _, err := gs.Generate(prompt)
+    return text, err
+}
+
+func (gs *GeminiService) Generate(prompt string) (string, Usage, error) {
     url := fmt.Sprintf(
         "https://generativelanguage.googleapis.com/v1beta/models/%s:generateContent?key=%s",
         gs.Model,
@@ -32,24 +38,24 @@ func (gs *GeminiService) GenerateResponse(prompt string) (string, error) {
 
     data, err := json.Marshal(payload)
     if err != nil {
-        return "", err
+        return "", Usage{}, err
     }
 
     req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
     if err != nil {
-        return "", err
+        return "", Usage{}, err
     }
     req.Header.Set("Content-Type", "application/json")
 
     resp, err := http.DefaultClient.Do(req)
     if err != nil {
-        return "", err
+        return "", Usage{}, err
     }
     defer resp.Body.Close()
 
     body, err := ioutil.ReadAll(resp.Body)
     if err != nil {
-        return "", err
+        return "", Usage{}, err
     }
 
     var r struct {
@@ -60,15 +66,107 @@ func (gs *GeminiService) GenerateResponse(prompt string) (string, error) {
                 } `json:"parts"`
             } `json:"content"`
         } `json:"candidates"`
+        ModelVersion  string `json:"modelVersion"`
+        UsageMetadata struct {
+            PromptTokenCount     int `json:"promptTokenCount"`
+            CandidatesTokenCount int `json:"candidatesTokenCount"`
+            //thinking models bill their thoughts as output
+            ThoughtsTokenCount int `json:"thoughtsTokenCount"`
+        } `json:"usageMetadata"`
     }
 
     if err := json.Unmarshal(body, &r); err != nil {
-        return "", err
+        return "", Usage{}, err
     }
 
     if len(r.Candidates) == 0 || len(r.Candidates[0].Content.Parts) == 0 {
-        return "", fmt.Errorf("no response text found")
+        return "", Usage{}, fmt.Errorf("no response text found")
+    }
+
+    usage := Usage{
+        Model:        r.ModelVersion,
+        InputTokens:  r.UsageMetadata.PromptTokenCount,
+        OutputTokens: r.UsageMetadata.CandidatesTokenCount + r.UsageMetadata.ThoughtsTokenCount,
+    }
+    if usage.Model == "" {
+        usage.Model = gs.Model
+    }
+    return r.Candidates[0].Content.Parts[0].Text, usage, nil
+}
+
+func (gs *GeminiService) GetEmbedding(text string) ([]float64, error) {
+    embs, err := gs.GetEmbeddings([]string{text})
+    if err != nil {
+        return nil, err
+    }
+    return embs[0], nil
+}
+
+//batchEmbedContents takes one request per text and answers in the same order
+func (gs *GeminiService) GetEmbeddings(texts []string) ([][]float64, error) {
+    if len(texts) == 0 {
+        return nil, nil
+    }
+    url := fmt.Sprintf(
+        "https://generativelanguage.googleapis.com/v1beta/models/%s:batchEmbedContents?key=%s",
+        gs.EmbeddingModel,
+        gs.APIKey,
+    )
+
+    requests := make([]map[string]interface{}, len(texts))
+    for i, text := range texts {
+        requests[i] = map[string]interface{}{
+            "model": "models/" + gs.EmbeddingModel,
+            "content": map[string]interface{}{
+                "parts": []map[string]string{
+                    {"text": text},
+                },
+            },
+        }
+    }
+
+    data, err := json.Marshal(map[string]interface{}{"requests": requests})
+    if err != nil {
+        return nil, err
     }
 
-    return r.Candidates[0].Content.Parts[0].Text, nil
+    req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("gemini embeddings returned %s: %s", resp.Status, body)
+    }
+
+    var r struct {
+        Embeddings []struct {
+            Values []float64 `json:"values"`
+        } `json:"embeddings"`
+    }
+
+    if err := json.Unmarshal(body, &r); err != nil {
+        return nil, err
+    }
+
+    if len(r.Embeddings) != len(texts) {
+        return nil, fmt.Errorf("gemini returned %d embeddings for %d inputs", len(r.Embeddings), len(texts))
+    }
+
+    embs := make([][]float64, len(texts))
+    for i, e := range r.Embeddings {
+        embs[i] = e.Values
+    }
+    return embs, nil
 }
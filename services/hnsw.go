@@ -0,0 +1,341 @@
+package services
+
+import (
+	"container/heap"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// HNSWConfig tunes the approximate nearest neighbour graph.
+// Larger M and EfConstruction give better recall for more memory and slower inserts,
+// EfSearch trades query latency for recall.
+type HNSWConfig struct {
+	M              int
+	EfConstruction int
+	EfSearch       int
+}
+
+func (c HNSWConfig) withDefaults() HNSWConfig {
+	if c.M <= 0 {
+		c.M = 16
+	}
+	if c.EfConstruction <= 0 {
+		c.EfConstruction = 200
+	}
+	if c.EfSearch <= 0 {
+		c.EfSearch = 64
+	}
+	return c
+}
+
+type VectorHit struct {
+	ID    uint
+	Score float64
+}
+
+type hnswNode struct {
+	id      uint
+	vec     []float32
+	links   [][]int
+	deleted bool
+}
+
+// hnswGraph is a hierarchical navigable small world graph over unit vectors,
+// distance is 1 - dot product so it orders the same as cosine similarity.
+// It is not safe for concurrent use, callers hold their own lock.
+type hnswGraph struct {
+	cfg       HNSWConfig
+	levelMult float64
+	nodes     []*hnswNode
+	byID      map[uint]int
+	entry     int
+	maxLevel  int
+	deleted   int
+	rng       *rand.Rand
+}
+
+func newHNSWGraph(cfg HNSWConfig) *hnswGraph {
+	cfg = cfg.withDefaults()
+	return &hnswGraph{
+		cfg:       cfg,
+		levelMult: 1 / math.Log(float64(cfg.M)),
+		byID:      map[uint]int{},
+		entry:     -1,
+		rng:       rand.New(rand.NewSource(1)),
+	}
+}
+
+func (g *hnswGraph) insert(id uint, vec []float32) {
+	//updates are a delete plus a fresh node, the old one stays as a routing hop
+	g.remove(id)
+
+	level := int(math.Floor(-math.Log(1-g.rng.Float64()) * g.levelMult))
+	node := &hnswNode{id: id, vec: vec, links: make([][]int, level+1)}
+	idx := len(g.nodes)
+	g.nodes = append(g.nodes, node)
+	g.byID[id] = idx
+
+	if g.entry < 0 {
+		g.entry = idx
+		g.maxLevel = level
+		return
+	}
+
+	ep := g.entry
+	for l := g.maxLevel; l > level; l-- {
+		ep = g.greedy(vec, ep, l)
+	}
+	entries := []int{ep}
+	for l := min(level, g.maxLevel); l >= 0; l-- {
+		found := g.searchLayer(vec, entries, g.cfg.EfConstruction, l)
+		neighbours := g.selectNeighbours(found, g.maxLinks(l))
+		node.links[l] = neighbours
+		for _, n := range neighbours {
+			g.link(n, idx, l)
+		}
+		entries = make([]int, len(found))
+		for i, c := range found {
+			entries[i] = c.idx
+		}
+	}
+	if level > g.maxLevel {
+		g.entry = idx
+		g.maxLevel = level
+	}
+}
+
+// remove tombstones the node so it keeps routing searches but is never returned
+func (g *hnswGraph) remove(id uint) bool {
+	idx, ok := g.byID[id]
+	if !ok {
+		return false
+	}
+	g.nodes[idx].deleted = true
+	delete(g.byID, id)
+	g.deleted++
+	return true
+}
+
+//worth rebuilding once tombstones make up most of the graph
+func (g *hnswGraph) stale() bool {
+	return g.deleted > 64 && g.deleted > len(g.byID)
+}
+
+func (g *hnswGraph) search(q []float32, k, ef int) []VectorHit {
+	if g.entry < 0 || k <= 0 {
+		return nil
+	}
+	if ef < k {
+		ef = k
+	}
+	ep := g.entry
+	for l := g.maxLevel; l > 0; l-- {
+		ep = g.greedy(q, ep, l)
+	}
+	found := g.searchLayer(q, []int{ep}, ef+g.deletedSlack(ef), 0)
+	hits := make([]VectorHit, 0, k)
+	for _, c := range found {
+		n := g.nodes[c.idx]
+		if n.deleted {
+			continue
+		}
+		hits = append(hits, VectorHit{ID: n.id, Score: 1 - c.dist})
+		if len(hits) == k {
+			break
+		}
+	}
+	return hits
+}
+
+//widen the beam by the share of tombstones so deleted nodes don't eat the results
+func (g *hnswGraph) deletedSlack(ef int) int {
+	if g.deleted == 0 || len(g.nodes) == 0 {
+		return 0
+	}
+	return ef * g.deleted / len(g.nodes)
+}
+
+func (g *hnswGraph) maxLinks(level int) int {
+	if level == 0 {
+		return g.cfg.M * 2
+	}
+	return g.cfg.M
+}
+
+func (g *hnswGraph) link(from, to, level int) {
+	node := g.nodes[from]
+	if level >= len(node.links) {
+		return
+	}
+	node.links[level] = append(node.links[level], to)
+	max := g.maxLinks(level)
+	if len(node.links[level]) <= max {
+		return
+	}
+	cands := make([]hnswCandidate, len(node.links[level]))
+	for i, n := range node.links[level] {
+		cands[i] = hnswCandidate{idx: n, dist: distance(node.vec, g.nodes[n].vec)}
+	}
+	//plain nearest-first pruning here, the heuristic is too slow to rerun on every back link
+	sort.Slice(cands, func(i, j int) bool { return cands[i].dist < cands[j].dist })
+	for i := 0; i < max; i++ {
+		node.links[level][i] = cands[i].idx
+	}
+	node.links[level] = node.links[level][:max]
+}
+
+// selectNeighbours is the paper's heuristic: keep a candidate only if it is closer to the
+// new node than to any neighbour already kept, which spreads links across clusters.
+// cands must be sorted nearest first.
+func (g *hnswGraph) selectNeighbours(cands []hnswCandidate, max int) []int {
+	selected := make([]int, 0, max)
+	var skipped []int
+	for _, c := range cands {
+		if len(selected) == max {
+			break
+		}
+		keep := true
+		for _, s := range selected {
+			if distance(g.nodes[c.idx].vec, g.nodes[s].vec) < c.dist {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			selected = append(selected, c.idx)
+		} else {
+			skipped = append(skipped, c.idx)
+		}
+	}
+	//top up with the closest pruned ones so sparse regions still get M links
+	for _, s := range skipped {
+		if len(selected) == max {
+			break
+		}
+		selected = append(selected, s)
+	}
+	return selected
+}
+
+func (g *hnswGraph) greedy(q []float32, ep int, level int) int {
+	best := distance(q, g.nodes[ep].vec)
+	for changed := true; changed; {
+		changed = false
+		for _, n := range g.nodes[ep].links[level] {
+			if d := distance(q, g.nodes[n].vec); d < best {
+				best, ep, changed = d, n, true
+			}
+		}
+	}
+	return ep
+}
+
+// searchLayer returns up to ef nearest nodes on one layer, nearest first
+func (g *hnswGraph) searchLayer(q []float32, entries []int, ef int, level int) []hnswCandidate {
+	visited := make(map[int]bool, ef*4)
+	cands := &candidateHeap{}
+	results := &candidateHeap{max: true}
+	for _, e := range entries {
+		if visited[e] {
+			continue
+		}
+		visited[e] = true
+		c := hnswCandidate{idx: e, dist: distance(q, g.nodes[e].vec)}
+		heap.Push(cands, c)
+		heap.Push(results, c)
+	}
+	for results.Len() > ef {
+		heap.Pop(results)
+	}
+
+	for cands.Len() > 0 {
+		c := heap.Pop(cands).(hnswCandidate)
+		if results.Len() >= ef && c.dist > results.items[0].dist {
+			break
+		}
+		node := g.nodes[c.idx]
+		if level >= len(node.links) {
+			continue
+		}
+		for _, n := range node.links[level] {
+			if visited[n] {
+				continue
+			}
+			visited[n] = true
+			d := distance(q, g.nodes[n].vec)
+			if results.Len() < ef || d < results.items[0].dist {
+				heap.Push(cands, hnswCandidate{idx: n, dist: d})
+				heap.Push(results, hnswCandidate{idx: n, dist: d})
+				if results.Len() > ef {
+					heap.Pop(results)
+				}
+			}
+		}
+	}
+
+	out := make([]hnswCandidate, results.Len())
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = heap.Pop(results).(hnswCandidate)
+	}
+	return out
+}
+
+type hnswCandidate struct {
+	idx  int
+	dist float64
+}
+
+//min heap by distance, or max heap when max is set
+type candidateHeap struct {
+	items []hnswCandidate
+	max   bool
+}
+
+func (h candidateHeap) Len() int { return len(h.items) }
+func (h candidateHeap) Less(i, j int) bool {
+	if h.max {
+		return h.items[i].dist > h.items[j].dist
+	}
+	return h.items[i].dist < h.items[j].dist
+}
+func (h candidateHeap) Swap(i, j int)       { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *candidateHeap) Push(x interface{}) { h.items = append(h.items, x.(hnswCandidate)) }
+func (h *candidateHeap) Pop() interface{} {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
+
+//vectors are normalized on the way in so this is cosine distance
+func distance(a, b []float32) float64 {
+	return 1 - dot32(a, b)
+}
+
+func dot32(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var sum float32
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return float64(sum)
+}
+
+// normalize32 converts to float32 and scales to unit length
+func normalize32(vec []float64) []float32 {
+	var norm float64
+	for _, v := range vec {
+		norm += v * v
+	}
+	out := make([]float32, len(vec))
+	if norm == 0 {
+		return out
+	}
+	norm = math.Sqrt(norm)
+	for i, v := range vec {
+		out[i] = float32(v / norm)
+	}
+	return out
+}
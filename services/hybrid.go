@@ -0,0 +1,83 @@
+package services
+
+import "sort"
+
+//reciprocal rank fusion constant from the original paper, dampens the head of each list
+const rrfK = 60
+
+// SearchOptions are the per request retrieval knobs shared by documents and memories
+type SearchOptions struct {
+	TopK int
+	//share of the fused score given to BM25, 0 is pure vector search and 1 pure keyword
+	KeywordWeight float64
+	//name of the RAGService reranker to apply to documents, empty or RerankerNone skips reranking
+	Reranker string
+	//maximal marginal relevance trade-off, lower picks more diverse results, 0 or 1 turns it off
+	MMRLambda float64
+	//join neighbouring chunks of the same file into one document
+	MergeAdjacent bool
+	//results with a lower cosine similarity to the query are dropped, 0 keeps everything
+	MinScore float64
+	//parsed filter expression, applied before scoring (see ParseFilter)
+	Filter []FilterCondition
+}
+
+//how deep into each ranking fusion looks before cutting to TopK
+func (o SearchOptions) candidates() int {
+	n := o.TopK * 4
+	if n < 20 {
+		n = 20
+	}
+	return n
+}
+
+// fuseLists merges the rankings of several queries for the same question with equal weight
+func fuseLists(lists [][]uint) []uint {
+	if len(lists) == 1 {
+		return lists[0]
+	}
+	scores := map[uint]float64{}
+	var order []uint
+	for _, list := range lists {
+		for rank, id := range list {
+			if _, ok := scores[id]; !ok {
+				order = append(order, id)
+			}
+			scores[id] += 1 / float64(rrfK+rank+1)
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return scores[order[i]] > scores[order[j]]
+	})
+	return order
+}
+
+// fuseRankings merges a vector and a keyword ranking with weighted reciprocal rank fusion
+func fuseRankings(vector []uint, keyword []uint, keywordWeight float64) []uint {
+	if keywordWeight <= 0 || len(keyword) == 0 {
+		return vector
+	}
+	if keywordWeight > 1 {
+		keywordWeight = 1
+	}
+
+	scores := map[uint]float64{}
+	for rank, id := range vector {
+		scores[id] += (1 - keywordWeight) / float64(rrfK+rank+1)
+	}
+	for rank, id := range keyword {
+		scores[id] += keywordWeight / float64(rrfK+rank+1)
+	}
+
+	fused := make([]uint, 0, len(scores))
+	for id := range scores {
+		fused = append(fused, id)
+	}
+	sort.Slice(fused, func(i, j int) bool {
+		if scores[fused[i]] == scores[fused[j]] {
+			return fused[i] > fused[j]
+		}
+		return scores[fused[i]] > scores[fused[j]]
+	})
+	return fused
+}
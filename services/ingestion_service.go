@@ -0,0 +1,470 @@
+package services
+
+import (
+	"context-aware-ai/models"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var ErrJobNotFound = errors.New("job not found")
+
+//part of a batch was settled or deleted while it was being embedded, nothing of it was committed
+var errBatchChanged = errors.New("batch changed underneath the worker")
+
+// IngestionService embeds uploaded chunks in the background with a fixed number of workers.
+// Documents stay pending (not searchable) until every chunk of their job is indexed.
+type IngestionService struct {
+	DB          *gorm.DB
+	RAGService  *RAGService
+	Workers     int
+	MaxAttempts int
+
+	//batches handed from the dispatcher to the workers, unbuffered so it waits for a free worker
+	batches chan []uint
+	//nudges the dispatcher when new chunks are pending
+	wake chan struct{}
+	mu   sync.Mutex
+	//chunks claimed by the dispatcher and not yet released by a worker
+	inflight map[uint]bool
+	//sqlite only allows one writer so the workers take turns committing
+	writeMu sync.Mutex
+}
+
+//how often the dispatcher looks for pending chunks when nobody woke it up
+const ingestionPollInterval = 5 * time.Second
+
+//how often jobs whose documents didn't make it into the vector store are tried again
+const publishRetryInterval = 30 * time.Second
+
+// Start launches the workers and picks up chunks left pending, and jobs left publishing, by a previous run
+func (s *IngestionService) Start() error {
+	if s.Workers <= 0 {
+		s.Workers = 4
+	}
+	if s.MaxAttempts <= 0 {
+		s.MaxAttempts = 3
+	}
+	s.batches = make(chan []uint)
+	s.wake = make(chan struct{}, 1)
+	s.inflight = map[uint]bool{}
+
+	var pending int64
+	if err := s.DB.Model(&models.IngestionChunk{}).Where("status = ?", models.ChunkPending).Count(&pending).Error; err != nil {
+		return err
+	}
+	if pending > 0 {
+		log.Printf("resuming %d pending ingestion chunks", pending)
+	}
+	for i := 0; i < s.Workers; i++ {
+		go s.worker()
+	}
+	go s.dispatch()
+	go s.republish()
+	return nil
+}
+
+// Submit stores the chunks as a new job and queues them for embedding,
+// tags and metadata end up on every document of the job
+func (s *IngestionService) Submit(userID, tabID uint, source string, chunks []CodeChunk, tags []string, metadata map[string]string) (*models.IngestionJob, error) {
+	job := models.IngestionJob{
+		UserID:      userID,
+		TabID:       tabID,
+		Source:      source,
+		Status:      models.JobQueued,
+		TotalChunks: len(chunks),
+		Tags:        tags,
+		Metadata:    metadata,
+	}
+	if len(chunks) == 0 {
+		job.Status = models.JobCompleted
+	}
+
+	rows := make([]models.IngestionChunk, len(chunks))
+	s.writeMu.Lock()
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&job).Error; err != nil {
+			return err
+		}
+		if len(chunks) == 0 {
+			return nil
+		}
+		for i, c := range chunks {
+			rows[i] = models.IngestionChunk{
+				JobID:      job.ID,
+				Source:     c.Path,
+				Symbol:     c.Symbol,
+				StartLine:  c.StartLine,
+				EndLine:    c.EndLine,
+				ChunkIndex: i,
+				Content:    c.Content,
+				Status:     models.ChunkPending,
+			}
+		}
+		return tx.CreateInBatches(&rows, 200).Error
+	})
+	s.writeMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	s.notify()
+	return &job, nil
+}
+
+func (s *IngestionService) GetJob(userID, jobID uint) (*models.IngestionJob, error) {
+	var job models.IngestionJob
+	err := s.DB.Where("id = ? AND user_id = ?", jobID, userID).First(&job).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// RetryFailed puts the failed chunks of a job back on the queue with a fresh attempt budget
+func (s *IngestionService) RetryFailed(userID, jobID uint) (*models.IngestionJob, error) {
+	job, err := s.GetJob(userID, jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []uint
+	s.writeMu.Lock()
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.IngestionChunk{}).
+			Where("job_id = ? AND status = ?", job.ID, models.ChunkFailed).
+			Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		if err := tx.Model(&models.IngestionChunk{}).Where("id IN ?", ids).
+			Updates(map[string]interface{}{"status": models.ChunkPending, "attempts": 0, "error": "", "next_attempt_at": time.Time{}}).Error; err != nil {
+			return err
+		}
+		return tx.Model(job).Updates(map[string]interface{}{
+			"status":        models.JobRunning,
+			"failed_chunks": gorm.Expr("failed_chunks - ?", len(ids)),
+			"error":         "",
+		}).Error
+	})
+	s.writeMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	s.notify()
+	return s.GetJob(userID, jobID)
+}
+
+// DeleteJobsByTabID drops the jobs of a tab, workers skip any of their chunks still queued
+func (s *IngestionService) DeleteJobsByTabID(userID, tabID uint) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		jobs := tx.Model(&models.IngestionJob{}).Select("id").Where("user_id = ? AND tab_id = ?", userID, tabID)
+		if err := tx.Where("job_id IN (?)", jobs).Delete(&models.IngestionChunk{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ? AND tab_id = ?", userID, tabID).Delete(&models.IngestionJob{}).Error
+	})
+}
+
+// Exclusive runs fn while no worker is committing, for deletes that reach into ingestion tables
+func (s *IngestionService) Exclusive(fn func() error) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return fn()
+}
+
+//wakes the dispatcher without waiting, one pending nudge is enough since it reads everything pending
+func (s *IngestionService) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+//the database is the queue: the dispatcher claims pending chunks in id order and hands them out
+//one embedding batch at a time, blocking while every worker is busy
+func (s *IngestionService) dispatch() {
+	size := s.RAGService.batchSize()
+	for {
+		ids, err := s.claim(size * s.Workers)
+		if err != nil {
+			log.Printf("ingestion: loading pending chunks: %v", err)
+		}
+		if len(ids) == 0 {
+			select {
+			case <-s.wake:
+			case <-time.After(s.untilNextRetry()):
+			}
+			continue
+		}
+		for len(ids) > 0 {
+			n := min(size, len(ids))
+			s.batches <- ids[:n]
+			ids = ids[n:]
+		}
+	}
+}
+
+//claim returns up to limit pending chunks no worker has yet and marks them in flight
+func (s *IngestionService) claim(limit int) ([]uint, error) {
+	s.mu.Lock()
+	busy := make([]uint, 0, len(s.inflight))
+	for id := range s.inflight {
+		busy = append(busy, id)
+	}
+	s.mu.Unlock()
+
+	query := s.DB.Model(&models.IngestionChunk{}).
+		//rows from before the column existed have no next attempt
+		Where("status = ? AND (next_attempt_at IS NULL OR next_attempt_at <= ?)", models.ChunkPending, time.Now())
+	if len(busy) > 0 {
+		query = query.Where("id NOT IN ?", busy)
+	}
+	var ids []uint
+	if err := query.Order("id").Limit(limit).Pluck("id", &ids).Error; err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	for _, id := range ids {
+		s.inflight[id] = true
+	}
+	s.mu.Unlock()
+	return ids, nil
+}
+
+//how long until a chunk waiting out its backoff is due, at most the poll interval
+func (s *IngestionService) untilNextRetry() time.Duration {
+	var next models.IngestionChunk
+	err := s.DB.Select("next_attempt_at").
+		Where("status = ? AND next_attempt_at > ?", models.ChunkPending, time.Now()).
+		Order("next_attempt_at").Limit(1).Find(&next).Error
+	if err != nil || next.NextAttemptAt.IsZero() {
+		return ingestionPollInterval
+	}
+	return min(time.Until(next.NextAttemptAt), ingestionPollInterval)
+}
+
+//chunks the worker didn't settle are still pending and get claimed again on the next look
+func (s *IngestionService) worker() {
+	for ids := range s.batches {
+		err := s.process(ids)
+		if err != nil {
+			log.Printf("ingestion chunks %v: %v", ids, err)
+		}
+		s.mu.Lock()
+		for _, id := range ids {
+			delete(s.inflight, id)
+		}
+		s.mu.Unlock()
+		//the unsettled chunks of a changed batch are requeued right away, after other errors
+		//wait for the next poll rather than spinning on them
+		if err == nil || errors.Is(err, errBatchChanged) {
+			s.notify()
+		}
+	}
+}
+
+func (s *IngestionService) process(chunkIDs []uint) error {
+	var chunks []models.IngestionChunk
+	if err := s.DB.Where("id IN ? AND status = ?", chunkIDs, models.ChunkPending).
+		Order("id").Find(&chunks).Error; err != nil {
+		return err
+	}
+
+	byJob := map[uint][]models.IngestionChunk{}
+	var jobIDs []uint
+	for _, c := range chunks {
+		if _, ok := byJob[c.JobID]; !ok {
+			jobIDs = append(jobIDs, c.JobID)
+		}
+		byJob[c.JobID] = append(byJob[c.JobID], c)
+	}
+	//one job's trouble doesn't hold back the others in the batch
+	var firstErr error
+	for _, jobID := range jobIDs {
+		if err := s.processJobChunks(jobID, byJob[jobID]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (s *IngestionService) processJobChunks(jobID uint, chunks []models.IngestionChunk) error {
+	var job models.IngestionJob
+	if err := s.DB.First(&job, jobID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	if job.Status == models.JobQueued {
+		s.writeMu.Lock()
+		s.DB.Model(&models.IngestionJob{}).Where("id = ? AND status = ?", job.ID, models.JobQueued).
+			Update("status", models.JobRunning)
+		s.writeMu.Unlock()
+	}
+
+	docs := make([]models.Document, len(chunks))
+	ids := make([]uint, len(chunks))
+	for i, chunk := range chunks {
+		ids[i] = chunk.ID
+		docs[i] = models.Document{
+			UserID:     job.UserID,
+			TabID:      job.TabID,
+			Source:     chunk.Source,
+			Symbol:     chunk.Symbol,
+			StartLine:  chunk.StartLine,
+			EndLine:    chunk.EndLine,
+			ChunkIndex: chunk.ChunkIndex,
+			Content:    chunk.Content,
+			Tags:       job.Tags,
+			Metadata:   job.Metadata,
+			JobID:      job.ID,
+			Pending:    true,
+		}
+	}
+
+	embedErr := s.RAGService.EmbedDocuments(docs)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if embedErr != nil {
+		return s.failChunks(job.ID, chunks, embedErr)
+	}
+	publishing := false
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		//chunks are gone if their tab was deleted while we were embedding
+		res := tx.Model(&models.IngestionChunk{}).
+			Where("id IN ? AND status = ?", ids, models.ChunkPending).
+			Updates(map[string]interface{}{"status": models.ChunkDone, "attempts": gorm.Expr("attempts + 1"), "error": ""})
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		if int(res.RowsAffected) != len(ids) {
+			//someone else settled part of the batch, roll back so the rest stays pending and is claimed again
+			return errBatchChanged
+		}
+		if err := s.RAGService.InsertDocuments(tx, docs); err != nil {
+			return err
+		}
+		if err := tx.Model(&models.IngestionJob{}).Where("id = ?", job.ID).
+			Update("done_chunks", gorm.Expr("done_chunks + ?", len(ids))).Error; err != nil {
+			return err
+		}
+		ready, err := finishJob(tx, job.ID)
+		publishing = ready
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.RAGService.IndexKeywords(docs)
+	if publishing {
+		return s.publish(job.ID)
+	}
+	return nil
+}
+
+//the documents go into the vector store before they turn searchable and the job completed, so a
+//failed upsert leaves the job publishing for republish instead of completed with nothing to find.
+//callers hold writeMu
+func (s *IngestionService) publish(jobID uint) error {
+	if err := s.RAGService.PublishJob(jobID); err != nil {
+		return err
+	}
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Document{}).Where("job_id = ?", jobID).Update("pending", false).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.IngestionJob{}).Where("id = ? AND status = ?", jobID, models.JobPublishing).
+			Update("status", models.JobCompleted).Error
+	})
+}
+
+//retries the jobs stuck publishing, starting with those a previous run left behind
+func (s *IngestionService) republish() {
+	for {
+		var ids []uint
+		if err := s.DB.Model(&models.IngestionJob{}).Where("status = ?", models.JobPublishing).
+			Order("id").Pluck("id", &ids).Error; err != nil {
+			log.Printf("ingestion: loading jobs to publish: %v", err)
+		}
+		for _, id := range ids {
+			s.writeMu.Lock()
+			err := s.publish(id)
+			s.writeMu.Unlock()
+			if err != nil {
+				log.Printf("publishing ingestion job %d: %v", id, err)
+			}
+		}
+		time.Sleep(publishRetryInterval)
+	}
+}
+
+//chunks with attempts left stay pending and wait out a doubling backoff, the rest are marked failed
+func (s *IngestionService) failChunks(jobID uint, chunks []models.IngestionChunk, embedErr error) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		var failed []uint
+		for _, chunk := range chunks {
+			attempts := chunk.Attempts + 1
+			if attempts >= s.MaxAttempts {
+				failed = append(failed, chunk.ID)
+				continue
+			}
+			backoff := time.Duration(1<<(attempts-1)) * 500 * time.Millisecond
+			if err := tx.Model(&models.IngestionChunk{}).
+				Where("id = ? AND status = ?", chunk.ID, models.ChunkPending).
+				Updates(map[string]interface{}{
+					"attempts":        attempts,
+					"error":           embedErr.Error(),
+					"next_attempt_at": time.Now().Add(backoff),
+				}).Error; err != nil {
+				return err
+			}
+		}
+		if len(failed) == 0 {
+			return nil
+		}
+		res := tx.Model(&models.IngestionChunk{}).
+			Where("id IN ? AND status = ?", failed, models.ChunkPending).
+			Updates(map[string]interface{}{"status": models.ChunkFailed, "attempts": s.MaxAttempts, "error": embedErr.Error()})
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		if err := tx.Model(&models.IngestionJob{}).Where("id = ?", jobID).
+			Update("failed_chunks", gorm.Expr("failed_chunks + ?", res.RowsAffected)).Error; err != nil {
+			return err
+		}
+		_, err := finishJob(tx, jobID)
+		return err
+	})
+}
+
+//once every chunk has been tried the job either moves on to publishing or is marked failed, reports whether it is publishing
+func finishJob(tx *gorm.DB, jobID uint) (bool, error) {
+	var job models.IngestionJob
+	if err := tx.First(&job, jobID).Error; err != nil {
+		return false, err
+	}
+	if job.DoneChunks+job.FailedChunks < job.TotalChunks {
+		return false, nil
+	}
+	if job.FailedChunks > 0 {
+		return false, tx.Model(&job).Updates(map[string]interface{}{
+			"status": models.JobFailed,
+			"error":  fmt.Sprintf("%d of %d chunks failed", job.FailedChunks, job.TotalChunks),
+		}).Error
+	}
+	return true, tx.Model(&job).Update("status", models.JobPublishing).Error
+}
@@ -0,0 +1,168 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWTKeys signs tokens with the current key and verifies them with whichever known key their
+// kid header names, so a key can be rotated while tokens signed with the old one are still valid.
+// Only the configured algorithm is accepted, whatever a token's alg header says.
+type JWTKeys struct {
+	Method jwt.SigningMethod
+	KeyID  string
+	Issuer string
+
+	signKey interface{}
+	//kid -> key used to verify, includes the current key
+	verifyKeys map[string]interface{}
+}
+
+const (
+	defaultJWTIssuer = "context-aware-ai"
+	jwtLeeway        = 30 * time.Second
+)
+
+// JWTConfig is read from the environment in main
+type JWTConfig struct {
+	//HS256 (default), RS256 or EdDSA
+	Algorithm string
+	KeyID     string
+	Issuer    string
+	//HS256 only: the current secret and older ones still accepted, as kid:secret pairs
+	Secret          string
+	PreviousSecrets string
+	//RS256 and EdDSA: PEM private key of the current kid and older public keys as kid=path pairs
+	PrivateKeyFile   string
+	PreviousKeyFiles string
+}
+
+func NewJWTKeys(cfg JWTConfig) (*JWTKeys, error) {
+	k := &JWTKeys{
+		KeyID:      cfg.KeyID,
+		Issuer:     cfg.Issuer,
+		verifyKeys: map[string]interface{}{},
+	}
+	if k.KeyID == "" {
+		k.KeyID = "default"
+	}
+	if k.Issuer == "" {
+		k.Issuer = defaultJWTIssuer
+	}
+
+	switch strings.ToUpper(cfg.Algorithm) {
+	case "", "HS256":
+		k.Method = jwt.SigningMethodHS256
+		if cfg.Secret == "" {
+			return nil, errors.New("JWT_SECRET_KEY is required for HS256")
+		}
+		k.signKey = []byte(cfg.Secret)
+		k.verifyKeys[k.KeyID] = k.signKey
+		for kid, secret := range splitPairs(cfg.PreviousSecrets, ":") {
+			k.verifyKeys[kid] = []byte(secret)
+		}
+	case "RS256", "EDDSA":
+		if strings.ToUpper(cfg.Algorithm) == "RS256" {
+			k.Method = jwt.SigningMethodRS256
+		} else {
+			k.Method = jwt.SigningMethodEdDSA
+		}
+		pem, err := os.ReadFile(cfg.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading JWT private key: %v", err)
+		}
+		private, public, err := parsePrivateKey(k.Method, pem)
+		if err != nil {
+			return nil, err
+		}
+		k.signKey = private
+		k.verifyKeys[k.KeyID] = public
+		for kid, path := range splitPairs(cfg.PreviousKeyFiles, "=") {
+			pem, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("reading JWT public key %s: %v", kid, err)
+			}
+			public, err := parsePublicKey(k.Method, pem)
+			if err != nil {
+				return nil, fmt.Errorf("JWT public key %s: %v", kid, err)
+			}
+			k.verifyKeys[kid] = public
+		}
+	default:
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", cfg.Algorithm)
+	}
+	return k, nil
+}
+
+// Sign signs the claims with the current key and names it in the kid header
+func (k *JWTKeys) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.Method, claims)
+	token.Header["kid"] = k.KeyID
+	return token.SignedString(k.signKey)
+}
+
+// Parse verifies the signature, algorithm, issuer, audience, expiry and not-before and fills in claims
+func (k *JWTKeys) Parse(tokenString string, claims jwt.Claims, audience string) error {
+	parser := jwt.NewParser(
+		jwt.WithValidMethods([]string{k.Method.Alg()}),
+		jwt.WithIssuer(k.Issuer),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(jwtLeeway),
+	)
+	_, err := parser.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := k.verifyKeys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key id %q", kid)
+		}
+		return key, nil
+	})
+	return err
+}
+
+func parsePrivateKey(method jwt.SigningMethod, pem []byte) (interface{}, interface{}, error) {
+	if method == jwt.SigningMethodRS256 {
+		key, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, &key.PublicKey, nil
+	}
+	key, err := jwt.ParseEdPrivateKeyFromPEM(pem)
+	if err != nil {
+		return nil, nil, err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("not an Ed25519 key")
+	}
+	return edKey, edKey.Public(), nil
+}
+
+func parsePublicKey(method jwt.SigningMethod, pem []byte) (crypto.PublicKey, error) {
+	if method == jwt.SigningMethodRS256 {
+		return jwt.ParseRSAPublicKeyFromPEM(pem)
+	}
+	return jwt.ParseEdPublicKeyFromPEM(pem)
+}
+
+// "a:x,b:y" -> {a: x, b: y}, entries without the separator are skipped
+func splitPairs(s, sep string) map[string]string {
+	out := map[string]string{}
+	for _, part := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), sep)
+		if ok && key != "" && value != "" {
+			out[key] = value
+		}
+	}
+	return out
+}
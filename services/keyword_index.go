@@ -0,0 +1,253 @@
+package services
+
+import (
+	"context-aware-ai/models"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"gorm.io/gorm"
+)
+
+const (
+	KindDocuments = "documents"
+	KindMemories  = "memories"
+)
+
+//standard bm25 parameters
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// KeywordIndex is an in-process BM25 inverted index over document content and memory text.
+// Each (kind, user, tab) corpus is built from the database the first time it is searched
+// and kept up to date by the services afterwards.
+type KeywordIndex struct {
+	DB *gorm.DB
+
+	mu      sync.Mutex
+	corpora map[corpusKey]*keywordCorpus
+}
+
+type KeywordHit struct {
+	ID    uint
+	Score float64
+}
+
+type corpusKey struct {
+	kind   string
+	userID uint
+	tabID  uint
+}
+
+type keywordCorpus struct {
+	mu       sync.RWMutex
+	postings map[string]map[uint]int
+	lengths  map[uint]int
+	terms    map[uint][]string
+	totalLen int
+}
+
+func (k *KeywordIndex) Add(kind string, userID, tabID, id uint, text string) {
+	c := k.loaded(corpusKey{kind, userID, tabID})
+	if c == nil {
+		//not built yet, the first search will read it from the database
+		return
+	}
+	c.mu.Lock()
+	c.add(id, text)
+	c.mu.Unlock()
+}
+
+// Drop forgets a whole corpus, used when a tab's documents or memories are deleted
+func (k *KeywordIndex) Drop(kind string, userID, tabID uint) {
+	if k == nil {
+		return
+	}
+	k.mu.Lock()
+	delete(k.corpora, corpusKey{kind, userID, tabID})
+	k.mu.Unlock()
+}
+
+// Search returns up to limit ids ordered by BM25 score, ids with no matching term are left out
+func (k *KeywordIndex) Search(kind string, userID, tabID uint, query string, limit int) ([]KeywordHit, error) {
+	if k == nil {
+		return nil, nil
+	}
+	c, err := k.corpus(corpusKey{kind, userID, tabID})
+	if err != nil {
+		return nil, err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	n := len(c.lengths)
+	if n == 0 {
+		return nil, nil
+	}
+	avgLen := float64(c.totalLen) / float64(n)
+
+	scores := map[uint]float64{}
+	seen := map[string]bool{}
+	for _, term := range tokenize(query) {
+		if seen[term] {
+			continue
+		}
+		seen[term] = true
+		posting := c.postings[term]
+		if len(posting) == 0 {
+			continue
+		}
+		idf := math.Log(1 + (float64(n)-float64(len(posting))+0.5)/(float64(len(posting))+0.5))
+		for id, tf := range posting {
+			f := float64(tf)
+			norm := f + bm25K1*(1-bm25B+bm25B*float64(c.lengths[id])/avgLen)
+			scores[id] += idf * f * (bm25K1 + 1) / norm
+		}
+	}
+
+	hits := make([]KeywordHit, 0, len(scores))
+	for id, score := range scores {
+		hits = append(hits, KeywordHit{ID: id, Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score == hits[j].Score {
+			return hits[i].ID > hits[j].ID
+		}
+		return hits[i].Score > hits[j].Score
+	})
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits, nil
+}
+
+//a nil index means hybrid search is off, so writes are simply dropped
+func (k *KeywordIndex) loaded(key corpusKey) *keywordCorpus {
+	if k == nil {
+		return nil
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.corpora[key]
+}
+
+//builds the corpus under the index lock so an Add can't slip in between the read and the publish
+func (k *KeywordIndex) corpus(key corpusKey) (*keywordCorpus, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if c, ok := k.corpora[key]; ok {
+		return c, nil
+	}
+
+	c := &keywordCorpus{
+		postings: map[string]map[uint]int{},
+		lengths:  map[uint]int{},
+		terms:    map[uint][]string{},
+	}
+	type row struct {
+		ID   uint
+		Text string
+	}
+	var rows []row
+	var err error
+	switch key.kind {
+	case KindDocuments:
+		err = k.DB.Model(&models.Document{}).Select("id, content AS text").
+			Where("user_id = ? AND tab_id = ?", key.userID, key.tabID).Scan(&rows).Error
+	case KindMemories:
+		err = k.DB.Model(&models.Memory{}).Select("id, text").
+			Where("user_id = ? AND tab_id = ?", key.userID, key.tabID).Scan(&rows).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		c.add(r.ID, r.Text)
+	}
+
+	if k.corpora == nil {
+		k.corpora = map[corpusKey]*keywordCorpus{}
+	}
+	k.corpora[key] = c
+	return c, nil
+}
+
+func (c *keywordCorpus) add(id uint, text string) {
+	c.remove(id)
+	terms := tokenize(text)
+	for _, t := range terms {
+		if c.postings[t] == nil {
+			c.postings[t] = map[uint]int{}
+		}
+		c.postings[t][id]++
+	}
+	c.lengths[id] = len(terms)
+	c.terms[id] = terms
+	c.totalLen += len(terms)
+}
+
+func (c *keywordCorpus) remove(id uint) {
+	terms, ok := c.terms[id]
+	if !ok {
+		return
+	}
+	for _, t := range terms {
+		delete(c.postings[t], id)
+		if len(c.postings[t]) == 0 {
+			delete(c.postings, t)
+		}
+	}
+	c.totalLen -= c.lengths[id]
+	delete(c.lengths, id)
+	delete(c.terms, id)
+}
+
+// tokenize lowercases words made of letters, digits and underscores. Identifiers like
+// ERR_CONN_RESET or getUserByID also emit their parts so either form of a query matches.
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+	var terms []string
+	for _, w := range words {
+		lower := strings.ToLower(w)
+		terms = append(terms, lower)
+		parts := splitIdentifier(w)
+		if len(parts) > 1 {
+			for _, p := range parts {
+				terms = append(terms, strings.ToLower(p))
+			}
+		}
+	}
+	return terms
+}
+
+func splitIdentifier(w string) []string {
+	var parts []string
+	for _, seg := range strings.Split(w, "_") {
+		if seg == "" {
+			continue
+		}
+		runes := []rune(seg)
+		start := 0
+		for i := 1; i < len(runes); i++ {
+			prev, cur := runes[i-1], runes[i]
+			//fooBar, HTTPServer and v2Api all split where the case or kind changes
+			boundary := unicode.IsLower(prev) && unicode.IsUpper(cur) ||
+				unicode.IsUpper(prev) && unicode.IsUpper(cur) && i+1 < len(runes) && unicode.IsLower(runes[i+1]) ||
+				unicode.IsDigit(prev) != unicode.IsDigit(cur)
+			if boundary {
+				parts = append(parts, string(runes[start:i]))
+				start = i
+			}
+		}
+		if start < len(runes) {
+			parts = append(parts, string(runes[start:]))
+		}
+	}
+	return parts
+}
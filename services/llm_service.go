@@ -3,3 +3,15 @@ package services
 type LLMService interface {
     GenerateResponse(prompt string) (string, error)
 }
+
+// Usage is what the provider reported for one generation, Model is the model that answered
+type Usage struct {
+    Model        string
+    InputTokens  int
+    OutputTokens int
+}
+
+// MeteredLLM is implemented by the providers that report token usage, UsageService.Wrap records it
+type MeteredLLM interface {
+    Generate(prompt string) (string, Usage, error)
+}
@@ -0,0 +1,109 @@
+package services
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// LoginThrottle slows down password guessing per client IP and username: after Free failed
+// attempts every further failure locks the pair for Base, doubling each time up to Max. A
+// successful login clears it. Keying on the IP too means nobody can lock a user out from
+// elsewhere, guessing from many IPs is left to the per-IP rate limit. Unknown names are tracked
+// the same way so the lockout says nothing about which exist.
+type LoginThrottle struct {
+	Free int
+	Base time.Duration
+	Max  time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]*loginFailures
+	lastPrune time.Time
+}
+
+type loginFailures struct {
+	count int
+	//attempts that were let through and haven't reported back yet
+	inflight    int
+	lockedUntil time.Time
+	last        time.Time
+}
+
+//failures older than this are forgotten
+const loginFailureMemory = 24 * time.Hour
+
+//how long to wait when the pair is not locked but its one allowed attempt is still running
+const loginInflightWait = time.Second
+
+// Attempt reserves a login attempt for the pair. When it is locked, or parallel attempts would
+// go past what is allowed, it returns how long to wait and a nil done. Otherwise done must be
+// called once with whether the login succeeded. Attempts in flight count as failures until they
+// report back, so parallel requests can't try more passwords than sequential ones.
+func (t *LoginThrottle) Attempt(ip, name string) (time.Duration, func(ok bool)) {
+	if t == nil {
+		return 0, func(bool) {}
+	}
+	now := time.Now()
+	key := ip + "\x00" + strings.ToLower(name)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.entries == nil {
+		t.entries = map[string]*loginFailures{}
+	}
+	if now.Sub(t.lastPrune) > time.Hour {
+		t.prune(now)
+	}
+	e, ok := t.entries[key]
+	if !ok || (e.inflight == 0 && now.Sub(e.last) > loginFailureMemory) {
+		e = &loginFailures{}
+		t.entries[key] = e
+	}
+	if wait := e.lockedUntil.Sub(now); wait > 0 {
+		return wait, nil
+	}
+	//past the free attempts only one at a time, each failure then locks before the next
+	if e.count+e.inflight >= t.Free && e.inflight > 0 {
+		return loginInflightWait, nil
+	}
+	e.inflight++
+	e.last = now
+
+	var once sync.Once
+	return 0, func(ok bool) {
+		once.Do(func() { t.finish(key, e, ok) })
+	}
+}
+
+func (t *LoginThrottle) finish(key string, e *loginFailures, ok bool) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e.inflight--
+	e.last = now
+	if ok {
+		e.count = 0
+		e.lockedUntil = time.Time{}
+		if e.inflight == 0 && t.entries[key] == e {
+			delete(t.entries, key)
+		}
+		return
+	}
+	e.count++
+	if e.count <= t.Free {
+		return
+	}
+	lock := t.Base << min(e.count-t.Free-1, 30)
+	if lock > t.Max || lock <= 0 {
+		lock = t.Max
+	}
+	e.lockedUntil = now.Add(lock)
+}
+
+func (t *LoginThrottle) prune(now time.Time) {
+	for key, e := range t.entries {
+		if e.inflight == 0 && now.Sub(e.last) > loginFailureMemory {
+			delete(t.entries, key)
+		}
+	}
+	t.lastPrune = now
+}
@@ -1,16 +1,22 @@
 package services
 
 import (
-	"encoding/json"
-	"math"
 	"time"
 	"sort"
 	"context-aware-ai/models"
 	"gorm.io/gorm"
 )
 
+// MemoryHit is a retrieved memory with its cosine similarity to the query
+type MemoryHit struct {
+	models.Memory
+	Score float64
+}
+
 type MemoryService struct {
-	DB *gorm.DB
+	DB           *gorm.DB
+	KeywordIndex *KeywordIndex
+	VectorStore  VectorStore
 }
 
 func NewMemoryService(db *gorm.DB) *MemoryService {
@@ -18,20 +24,31 @@ func NewMemoryService(db *gorm.DB) *MemoryService {
 	return &MemoryService{DB: db}
 }
 
-func (s *MemoryService) StoreMemory(text string, embedding []float64, userID uint, tabID uint) error {
-	data, err := json.Marshal(embedding)
-	if err != nil {
-		return err
-	}
-
+//tags and metadata are optional and can be filtered on like those of documents
+func (s *MemoryService) StoreMemory(text string, embedding []float64, userID uint, tabID uint, tags []string, metadata map[string]string) error {
+	vec := NormalizeEmbedding(embedding)
 	mem := models.Memory{
 		Text:      text,
-		Embedding: data,
+		Embedding: encodeVector(vec, flagNormalized),
 		UserID:    userID,
 		TabID:     tabID,
+		Tags:      tags,
+		Metadata:  metadata,
 	}
 
-	return s.DB.Create(&mem).Error
+	if err := s.DB.Create(&mem).Error; err != nil {
+		return err
+	}
+	s.KeywordIndex.Add(KindMemories, userID, tabID, mem.ID, text)
+	return s.VectorStore.Upsert(KindMemories, []VectorRecord{{
+		ID:        mem.ID,
+		UserID:    userID,
+		TabID:     tabID,
+		Vector:    vec,
+		Tags:      tags,
+		Metadata:  metadata,
+		CreatedAt: mem.CreatedAt,
+	}})
 }
 
 func (s *MemoryService) GetAllMemories(userID uint, tabID uint) ([]models.Memory, error) {
@@ -40,13 +57,43 @@ func (s *MemoryService) GetAllMemories(userID uint, tabID uint) ([]models.Memory
 	return memories, err
 }
 
-func (s *MemoryService) RetrieveRelevant(queryEmbedding []float64,topK int, userID uint,tabID uint,) ([]models.Memory, error) {
-    memories, err := s.GetAllMemories(userID, tabID)
+//ranks by cosine plus recency, fused with BM25 over the memory text when opts.KeywordWeight is set.
+//the vector store picks the most similar candidates and recency is applied to those.
+//memories less similar to the query than opts.MinScore are dropped.
+func (s *MemoryService) RetrieveRelevant(query string, queryEmbedding []float64, opts SearchOptions, userID uint, tabID uint) ([]MemoryHit, error) {
+    qv := NormalizeEmbedding(queryEmbedding)
+    conds := filterFor(KindMemories, opts.Filter)
+    hits, err := s.VectorStore.Search(KindMemories, qv, opts.candidates(), VectorFilter{UserID: userID, TabIDs: []uint{tabID}, Conditions: conds})
     if err != nil {
         return nil, err
     }
-    if len(memories) == 0 {
-        return []models.Memory{}, nil
+
+    var keywordHits []KeywordHit
+    if opts.KeywordWeight > 0 {
+        keywordHits, err = s.KeywordIndex.Search(KindMemories, userID, tabID, query, opts.candidates())
+        if err != nil {
+            return nil, err
+        }
+    }
+    if len(hits) == 0 && len(keywordHits) == 0 {
+        return []MemoryHit{}, nil
+    }
+
+    ids := make([]uint, 0, len(hits)+len(keywordHits))
+    for _, h := range hits {
+        ids = append(ids, h.ID)
+    }
+    for _, h := range keywordHits {
+        ids = append(ids, h.ID)
+    }
+    var memories []models.Memory
+    q := s.DB.Where("id IN ? AND user_id = ? AND tab_id = ?", ids, userID, tabID)
+    if err := applyFilter(q, conds).Find(&memories).Error; err != nil {
+        return nil, err
+    }
+    byID := make(map[uint]models.Memory, len(memories))
+    for _, m := range memories {
+        byID[m.ID] = m
     }
 
     type scoredMemory struct {
@@ -54,17 +101,10 @@ func (s *MemoryService) RetrieveRelevant(queryEmbedding []float64,topK int, user
         Score  float64
     }
 
-    scored := make([]scoredMemory, 0, len(memories))
-    newest := memories[0].CreatedAt
-    oldest := memories[0].CreatedAt
-
-    for _, m := range memories {
-        if m.CreatedAt.After(newest) {
-            newest = m.CreatedAt
-        }
-        if m.CreatedAt.Before(oldest) {
-            oldest = m.CreatedAt
-        }
+    scored := make([]scoredMemory, 0, len(hits))
+    oldest, newest, err := s.timeRange(userID, tabID)
+    if err != nil {
+        return nil, err
     }
 
     timeRange := newest.Sub(oldest)
@@ -74,17 +114,15 @@ func (s *MemoryService) RetrieveRelevant(queryEmbedding []float64,topK int, user
 	//weight of consine similarity
     alpha := 0.8
 
-    for _, m := range memories {
-        var emb []float64
-        if err := json.Unmarshal(m.Embedding, &emb); err != nil {
+    for _, h := range hits {
+        m, ok := byID[h.ID]
+        if !ok {
             continue
         }
 
-        cos := cosineSimilarity(queryEmbedding, emb)
-
         recency := float64(m.CreatedAt.Sub(oldest)) / float64(timeRange)
 
-        finalScore := alpha*cos + (1-alpha)*recency
+        finalScore := alpha*h.Score + (1-alpha)*recency
 
         scored = append(scored, scoredMemory{
             Memory: m,
@@ -96,36 +134,120 @@ func (s *MemoryService) RetrieveRelevant(queryEmbedding []float64,topK int, user
         return scored[i].Score > scored[j].Score
     })
 
-    if topK > len(scored) {
-        topK = len(scored)
+    vectorRank := make([]uint, len(scored))
+    for i, sm := range scored {
+        vectorRank[i] = sm.Memory.ID
     }
 
-    results := make([]models.Memory, topK)
-    for i := 0; i < topK; i++ {
-        results[i] = scored[i].Memory
+    var keywordRank []uint
+    for _, h := range keywordHits {
+        if _, ok := byID[h.ID]; ok {
+            keywordRank = append(keywordRank, h.ID)
+        }
     }
 
+    //scores reported and thresholded are plain cosine similarity, recency only affects the order
+    var results []MemoryHit
+    var vecs [][]float32
+    for _, id := range fuseRankings(vectorRank, keywordRank, opts.KeywordWeight) {
+        vec, err := decodeEmbedding(byID[id].Embedding)
+        if err != nil {
+            continue
+        }
+        score := dot32(qv, vec)
+        if score < opts.MinScore {
+            continue
+        }
+        results = append(results, MemoryHit{Memory: byID[id], Score: score})
+        vecs = append(vecs, vec)
+    }
+    if mmrEnabled(opts.MMRLambda) {
+        picked := mmrSelect(vecs, opts.TopK, opts.MMRLambda)
+        diverse := make([]MemoryHit, len(picked))
+        for i, idx := range picked {
+            diverse[i] = results[idx]
+        }
+        results = diverse
+    }
+    if len(results) > opts.TopK {
+        results = results[:opts.TopK]
+    }
+    if results == nil {
+        results = []MemoryHit{}
+    }
     return results, nil
 }
 
+// RetrieveRelevantQueries is RetrieveRelevant over several queries with their embeddings,
+// fused the same way as RAGService.SearchQueries
+func (s *MemoryService) RetrieveRelevantQueries(queries []string, embeddings [][]float64, opts SearchOptions, userID uint, tabID uint) ([]MemoryHit, error) {
+    if len(queries) == 1 {
+        return s.RetrieveRelevant(queries[0], embeddings[0], opts, userID, tabID)
+    }
+    byID := map[uint]MemoryHit{}
+    lists := make([][]uint, 0, len(queries))
+    for i, q := range queries {
+        hits, err := s.RetrieveRelevant(q, embeddings[i], opts, userID, tabID)
+        if err != nil {
+            return nil, err
+        }
+        ids := make([]uint, len(hits))
+        for j, h := range hits {
+            ids[j] = h.ID
+            if prev, ok := byID[h.ID]; !ok || h.Score > prev.Score {
+                byID[h.ID] = h
+            }
+        }
+        lists = append(lists, ids)
+    }
 
-func cosineSimilarity(a, b []float64) float64 {
-	if len(a) != len(b) {
-		return 0
-	}
-	var dot, normA, normB float64
-	for i := range a {
-		dot += a[i] * b[i]
-		normA += a[i] * a[i]
-		normB += b[i] * b[i]
-	}
-	if normA == 0 || normB == 0 {
-		return 0
-	}
-	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+    results := make([]MemoryHit, 0, opts.TopK)
+    for _, id := range fuseLists(lists) {
+        if len(results) == opts.TopK {
+            break
+        }
+        results = append(results, byID[id])
+    }
+    return results, nil
+}
+
+// RecentMemories returns the last n exchanges of a tab, oldest first
+func (s *MemoryService) RecentMemories(userID uint, tabID uint, n int) ([]models.Memory, error) {
+    var memories []models.Memory
+    err := s.DB.Where("user_id = ? AND tab_id = ?", userID, tabID).
+        Order("created_at desc").Order("id desc").Limit(n).Find(&memories).Error
+    if err != nil {
+        return nil, err
+    }
+    for i, j := 0, len(memories)-1; i < j; i, j = i+1, j-1 {
+        memories[i], memories[j] = memories[j], memories[i]
+    }
+    return memories, nil
+}
+
+//creation time of the tab's oldest and newest memory, recency is scaled between the two
+func (s *MemoryService) timeRange(userID uint, tabID uint) (time.Time, time.Time, error) {
+    var oldest, newest models.Memory
+    q := s.DB.Select("created_at").Where("user_id = ? AND tab_id = ?", userID, tabID)
+    if err := q.Session(&gorm.Session{}).Order("created_at asc").Limit(1).Find(&oldest).Error; err != nil {
+        return time.Time{}, time.Time{}, err
+    }
+    if err := q.Session(&gorm.Session{}).Order("created_at desc").Limit(1).Find(&newest).Error; err != nil {
+        return time.Time{}, time.Time{}, err
+    }
+    return oldest.CreatedAt, newest.CreatedAt, nil
 }
 
 func (s *MemoryService) DeleteMemoriesByTabID(userID uint, tabID uint) error {
     err := s.DB.Where("user_id = ? AND tab_id = ?", userID, tabID).Delete(&models.Memory{}).Error
-    return err
+    if err != nil {
+        return err
+    }
+    return s.DropIndexes(userID, tabID)
+}
+
+//forgets the tab's memories in the keyword index and the vector store, for when the rows are already gone
+func (s *MemoryService) DropIndexes(userID uint, tabID uint) error {
+    s.KeywordIndex.Drop(KindMemories, userID, tabID)
+    return s.VectorStore.DeleteWhere(KindMemories, VectorFilter{UserID: userID, TabIDs: []uint{tabID}})
 }
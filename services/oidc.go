@@ -0,0 +1,450 @@
+package services
+
+import (
+	"context-aware-ai/models"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrOIDCStateInvalid = errors.New("login state unknown or expired")
+	ErrOIDCTokenInvalid = errors.New("id token invalid")
+)
+
+// OIDCStateTTL is how long a user has to get through the provider's login page
+const OIDCStateTTL = 10 * time.Minute
+
+const (
+	//unknown key ids trigger a JWKS refetch at most this often
+	oidcKeysRefresh = time.Minute
+)
+
+type OIDCConfig struct {
+	Issuer   string
+	ClientID string
+	//empty for public clients, PKCE protects the code either way
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	//whether the first login of an unknown provider account creates a user
+	AutoProvision bool
+	//when set only verified emails in these domains are provisioned, e.g. example.com
+	AllowedDomains []string
+}
+
+// OIDCIdentity is what the provider vouched for in a verified ID token
+type OIDCIdentity struct {
+	Issuer            string
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+	Name              string
+}
+
+// OIDCService runs the authorization code flow with PKCE against one provider.
+// The provider's discovery document and keys are fetched on first use.
+type OIDCService struct {
+	DB     *gorm.DB
+	Config OIDCConfig
+	HTTP   *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	SigningAlgs           []string `json:"id_token_signing_alg_values_supported"`
+}
+
+type oidcClaims struct {
+	Nonce             string   `json:"nonce"`
+	Email             string   `json:"email"`
+	EmailVerified     oidcBool `json:"email_verified"`
+	PreferredUsername string   `json:"preferred_username"`
+	Name              string   `json:"name"`
+	jwt.RegisteredClaims
+}
+
+// some providers send email_verified as the string "true"
+type oidcBool bool
+
+func (b *oidcBool) UnmarshalJSON(data []byte) error {
+	*b = oidcBool(strings.Trim(string(data), `"`) == "true")
+	return nil
+}
+
+// MayProvision reports whether a login of an account without a user may create one
+func (s *OIDCService) MayProvision(id *OIDCIdentity) bool {
+	if !s.Config.AutoProvision {
+		return false
+	}
+	if len(s.Config.AllowedDomains) == 0 {
+		return true
+	}
+	_, domain, ok := strings.Cut(id.Email, "@")
+	if !ok || !id.EmailVerified {
+		return false
+	}
+	for _, allowed := range s.Config.AllowedDomains {
+		if strings.EqualFold(domain, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Begin records a new login and returns the provider URL to send the browser to, along with the
+// state the caller ties to that browser so only it can finish the login
+func (s *OIDCService) Begin() (string, string, error) {
+	d, err := s.discover()
+	if err != nil {
+		return "", "", err
+	}
+	state, err := randomID()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomID()
+	if err != nil {
+		return "", "", err
+	}
+	verifier, challenge, err := newPKCE()
+	if err != nil {
+		return "", "", err
+	}
+	err = s.DB.Create(&models.OIDCLoginState{
+		State:        state,
+		CodeVerifier: verifier,
+		Nonce:        nonce,
+		ExpiresAt:    time.Now().Add(OIDCStateTTL),
+	}).Error
+	if err != nil {
+		return "", "", err
+	}
+
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {s.Config.ClientID},
+		"redirect_uri":          {s.Config.RedirectURL},
+		"scope":                 {strings.Join(s.scopes(), " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), state, nil
+}
+
+// Finish consumes the login state, swaps the code for tokens and verifies the ID token
+func (s *OIDCService) Finish(state, code string) (*OIDCIdentity, error) {
+	var login models.OIDCLoginState
+	res := s.DB.Where("state = ? AND expires_at > ?", state, time.Now()).Limit(1).Find(&login)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, ErrOIDCStateInvalid
+	}
+	//only the request that manages to delete the state goes on, so it can't be used twice
+	del := s.DB.Where("state = ?", state).Delete(&models.OIDCLoginState{})
+	if del.Error != nil {
+		return nil, del.Error
+	}
+	if del.RowsAffected == 0 {
+		return nil, ErrOIDCStateInvalid
+	}
+
+	rawIDToken, err := s.exchange(code, login.CodeVerifier)
+	if err != nil {
+		return nil, err
+	}
+	return s.verify(rawIDToken, login.Nonce)
+}
+
+// PurgeExpired deletes logins that were started and never finished
+func (s *OIDCService) PurgeExpired() error {
+	return s.DB.Where("expires_at < ?", time.Now()).Delete(&models.OIDCLoginState{}).Error
+}
+
+func (s *OIDCService) exchange(code, verifier string) (string, error) {
+	d, err := s.discover()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {s.Config.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if s.Config.ClientSecret == "" {
+		form.Set("client_id", s.Config.ClientID)
+	}
+	req, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if s.Config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(s.Config.ClientID), url.QueryEscape(s.Config.ClientSecret))
+	}
+
+	var r struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	status, err := s.getJSON(req, &r)
+	if err != nil {
+		return "", err
+	}
+	if status != http.StatusOK || r.IDToken == "" {
+		return "", fmt.Errorf("token exchange failed (%d): %s %s", status, r.Error, r.ErrorDescription)
+	}
+	return r.IDToken, nil
+}
+
+func (s *OIDCService) verify(rawIDToken, nonce string) (*OIDCIdentity, error) {
+	d, err := s.discover()
+	if err != nil {
+		return nil, err
+	}
+	algs := d.SigningAlgs
+	if len(algs) == 0 {
+		algs = []string{"RS256"}
+	}
+	parser := jwt.NewParser(
+		jwt.WithValidMethods(algs),
+		jwt.WithIssuer(d.Issuer),
+		jwt.WithAudience(s.Config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(jwtLeeway),
+	)
+	claims := &oidcClaims{}
+	_, err = parser.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return s.key(kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrOIDCTokenInvalid, err)
+	}
+	if claims.Nonce != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrOIDCTokenInvalid)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: no subject", ErrOIDCTokenInvalid)
+	}
+	return &OIDCIdentity{
+		Issuer:            d.Issuer,
+		Subject:           claims.Subject,
+		Email:             claims.Email,
+		EmailVerified:     bool(claims.EmailVerified),
+		PreferredUsername: claims.PreferredUsername,
+		Name:              claims.Name,
+	}, nil
+}
+
+func (s *OIDCService) discover() (*oidcDiscovery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.discovery != nil {
+		return s.discovery, nil
+	}
+	issuer := strings.TrimSuffix(s.Config.Issuer, "/")
+	req, err := http.NewRequest("GET", issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	var d oidcDiscovery
+	status, err := s.getJSON(req, &d)
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery: %v", err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("oidc discovery returned %d", status)
+	}
+	//the spec requires an exact match, anything else could be someone else's tokens
+	if strings.TrimSuffix(d.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("oidc discovery issuer %q doesn't match %q", d.Issuer, s.Config.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("oidc discovery document is missing endpoints")
+	}
+	s.discovery = &d
+	return s.discovery, nil
+}
+
+// looks the signing key up by kid, refetching the JWKS when the provider has rotated keys
+func (s *OIDCService) key(kid string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key, ok := s.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(s.keysFetched) < oidcKeysRefresh && s.keys != nil {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	keys, err := s.fetchKeys(s.discovery.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	s.keys, s.keysFetched = keys, time.Now()
+	key, ok := s.keys[kid]
+	//providers with a single key don't always name it
+	if !ok && kid == "" && len(s.keys) == 1 {
+		for _, k := range s.keys {
+			return k, nil
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return key, nil
+}
+
+func (s *OIDCService) fetchKeys(jwksURI string) (map[string]interface{}, error) {
+	req, err := http.NewRequest("GET", jwksURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	status, err := s.getJSON(req, &set)
+	if err != nil {
+		return nil, fmt.Errorf("fetching jwks: %v", err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("jwks returned %d", status)
+	}
+	keys := map[string]interface{}{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		//keys of a type we can't use are skipped, the provider may publish several
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (s *OIDCService) getJSON(req *http.Request, out interface{}) (int, error) {
+	client := s.HTTP
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return 0, err
+	}
+	if err := json.Unmarshal(body, out); err != nil && resp.StatusCode == http.StatusOK {
+		return 0, err
+	}
+	return resp.StatusCode, nil
+}
+
+func (s *OIDCService) scopes() []string {
+	scopes := s.Config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	}
+	for _, sc := range scopes {
+		if sc == "openid" {
+			return scopes
+		}
+	}
+	return append([]string{"openid"}, scopes...)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// S256 PKCE pair, the verifier stays with us and the challenge goes to the provider
+func newPKCE() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	verifier := base64.RawURLEncoding.EncodeToString(b)
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
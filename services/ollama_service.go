@@ -2,16 +2,22 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"strings"
+	"sync"
 )
 
 type OllamaService struct {
 	BaseURL        string
 	GenerateModel  string
 	EmbeddingModel string
+	//a yes/no reranker such as qwen3-reranker, empty disables the ollama reranker
+	RerankModel string
 }
 
 type EmbeddingResponse struct {
@@ -19,7 +25,10 @@ type EmbeddingResponse struct {
 }
 
 type GenerateResponse struct {
-	Response string `json:"response"`
+	Response        string `json:"response"`
+	Model           string `json:"model"`
+	PromptEvalCount int    `json:"prompt_eval_count"`
+	EvalCount       int    `json:"eval_count"`
 }
 
 func (os *OllamaService) GetEmbedding(text string) ([]float64, error) {
@@ -33,26 +42,178 @@ func (os *OllamaService) GetEmbedding(text string) ([]float64, error) {
 	}
 	defer resp.Body.Close()
 	body, _ := ioutil.ReadAll(resp.Body)
+	//surface failures as errors so ingestion can retry instead of storing an empty vector
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ollama embeddings returned %s: %s", resp.Status, body)
+	}
 	var r EmbeddingResponse
 	err = json.Unmarshal(body, &r)
 	if err != nil {
 		return nil, err
 	}
+	if len(r.Embedding) == 0 {
+		return nil, fmt.Errorf("ollama returned an empty embedding")
+	}
 	return r.Embedding, nil
 }
 
+type EmbedResponse struct {
+	Embeddings [][]float64 `json:"embeddings"`
+}
+
+//uses /api/embed which takes the whole batch in one request
+func (os *OllamaService) GetEmbeddings(texts []string) ([][]float64, error) {
+	if len(texts) == 0 {
+		return nil, nil
+	}
+	url := fmt.Sprintf("%s/api/embed", os.BaseURL)
+	payload, err := json.Marshal(map[string]interface{}{
+		"model": os.EmbeddingModel,
+		"input": texts,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(payload))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ollama embed returned %s: %s", resp.Status, body)
+	}
+	var r EmbedResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, err
+	}
+	if len(r.Embeddings) != len(texts) {
+		return nil, fmt.Errorf("ollama returned %d embeddings for %d inputs", len(r.Embeddings), len(texts))
+	}
+	return r.Embeddings, nil
+}
+
 func (os *OllamaService) GenerateResponse(prompt string) (string, error) {
+	text, _, err := os.Generate(prompt)
+	return text, err
+}
+
+func (os *OllamaService) Generate(prompt string) (string, Usage, error) {
 	url := fmt.Sprintf("%s/api/generate", os.BaseURL)
 	payload := fmt.Sprintf(`{"model":"%s","prompt":%q,"stream":false}`, os.GenerateModel, prompt)
 	req, _ := http.NewRequest("POST", url, bytes.NewBuffer([]byte(payload)))
 	req.Header.Set("Content-Type", "application/json")
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return "", err
+		return "", Usage{}, err
 	}
 	defer resp.Body.Close()
 	body, _ := ioutil.ReadAll(resp.Body)
 	var r GenerateResponse
 	json.Unmarshal(body, &r)
-	return r.Response, nil
+	usage := Usage{Model: r.Model, InputTokens: r.PromptEvalCount, OutputTokens: r.EvalCount}
+	if usage.Model == "" {
+		usage.Model = os.GenerateModel
+	}
+	return r.Response, usage, nil
+}
+
+type rerankLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+}
+
+type rerankResponse struct {
+	Response string `json:"response"`
+	Logprobs []struct {
+		rerankLogprob
+		TopLogprobs []rerankLogprob `json:"top_logprobs"`
+	} `json:"logprobs"`
+}
+
+//passages judged at once, ollama queues the rest anyway
+const rerankConcurrency = 4
+
+// Rerank asks the rerank model whether each passage answers the query and scores it by
+// the probability of "yes" against "no"
+func (os *OllamaService) Rerank(ctx context.Context, query string, passages []string) ([]float64, error) {
+	scores := make([]float64, len(passages))
+	errs := make([]error, len(passages))
+	sem := make(chan struct{}, rerankConcurrency)
+	var wg sync.WaitGroup
+	for i, p := range passages {
+		wg.Add(1)
+		go func(i int, p string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			scores[i], errs[i] = os.judge(ctx, query, p)
+		}(i, p)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return scores, nil
+}
+
+func (os *OllamaService) judge(ctx context.Context, query, passage string) (float64, error) {
+	prompt := fmt.Sprintf("Judge whether the Document meets the requirements based on the Query. "+
+		"Note that the answer can only be \"yes\" or \"no\".\n\nQuery: %s\n\nDocument: %s\n\nAnswer:",
+		query, truncateRunes(passage, maxRerankPassage))
+	payload, err := json.Marshal(map[string]interface{}{
+		"model":        os.RerankModel,
+		"prompt":       prompt,
+		"stream":       false,
+		"logprobs":     true,
+		"top_logprobs": 5,
+		"options":      map[string]interface{}{"temperature": 0, "num_predict": 1},
+	})
+	if err != nil {
+		return 0, err
+	}
+	url := fmt.Sprintf("%s/api/generate", os.BaseURL)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("ollama rerank returned %s: %s", resp.Status, body)
+	}
+	var r rerankResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return 0, err
+	}
+
+	//older ollama versions don't return logprobs, fall back to the answer itself
+	if len(r.Logprobs) == 0 {
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(r.Response)), "yes") {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	yes, no := math.Inf(-1), math.Inf(-1)
+	for _, lp := range append(r.Logprobs[0].TopLogprobs, r.Logprobs[0].rerankLogprob) {
+		switch strings.ToLower(strings.TrimSpace(lp.Token)) {
+		case "yes":
+			yes = math.Max(yes, lp.Logprob)
+		case "no":
+			no = math.Max(no, lp.Logprob)
+		}
+	}
+	if math.IsInf(yes, -1) {
+		return 0, nil
+	}
+	return math.Exp(yes) / (math.Exp(yes) + math.Exp(no)), nil
 }
@@ -9,11 +9,17 @@ import (
 )
 
 type OpenAIService struct {
-    APIKey string
-    Model  string
+    APIKey         string
+    Model          string
+    EmbeddingModel string
 }
 
 func (os *OpenAIService) GenerateResponse(prompt string) (string, error) {
+    text, _, err := os.Generate(prompt)
+    return text, err
+}
+
+func (os *OpenAIService) Generate(prompt string) (string, Usage, error) {
     url := "https://api.openai.com/v1/chat/completions"
 
     payload := map[string]interface{}{
@@ -29,12 +35,12 @@ func (os *OpenAIService) GenerateResponse(prompt string) (string, error) {
 
     data, err := json.Marshal(payload)
     if err != nil {
-        return "", err
+        return "", Usage{}, err
     }
 
     req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
     if err != nil {
-        return "", err
+        return "", Usage{}, err
     }
 
     req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", os.APIKey))
@@ -42,13 +48,13 @@ func (os *OpenAIService) GenerateResponse(prompt string) (string, error) {
 
     resp, err := http.DefaultClient.Do(req)
     if err != nil {
-        return "", err
+        return "", Usage{}, err
     }
     defer resp.Body.Close()
 
     body, err := ioutil.ReadAll(resp.Body)
     if err != nil {
-        return "", err
+        return "", Usage{}, err
     }
 
     var r struct {
@@ -57,15 +63,96 @@ func (os *OpenAIService) GenerateResponse(prompt string) (string, error) {
                 Content string `json:"content"`
             } `json:"message"`
         } `json:"choices"`
+        Model string `json:"model"`
+        Usage struct {
+            PromptTokens     int `json:"prompt_tokens"`
+            CompletionTokens int `json:"completion_tokens"`
+        } `json:"usage"`
     }
 
     if err := json.Unmarshal(body, &r); err != nil {
-        return "", err
+        return "", Usage{}, err
     }
 
     if len(r.Choices) == 0 {
-        return "", fmt.Errorf("no choices returned")
+        return "", Usage{}, fmt.Errorf("no choices returned")
+    }
+
+    usage := Usage{Model: r.Model, InputTokens: r.Usage.PromptTokens, OutputTokens: r.Usage.CompletionTokens}
+    if usage.Model == "" {
+        usage.Model = os.Model
+    }
+    return r.Choices[0].Message.Content, usage, nil
+}
+
+func (os *OpenAIService) GetEmbedding(text string) ([]float64, error) {
+    embs, err := os.GetEmbeddings([]string{text})
+    if err != nil {
+        return nil, err
+    }
+    return embs[0], nil
+}
+
+func (os *OpenAIService) GetEmbeddings(texts []string) ([][]float64, error) {
+    if len(texts) == 0 {
+        return nil, nil
+    }
+    url := "https://api.openai.com/v1/embeddings"
+
+    payload := map[string]interface{}{
+        "model": os.EmbeddingModel,
+        "input": texts,
+    }
+
+    data, err := json.Marshal(payload)
+    if err != nil {
+        return nil, err
+    }
+
+    req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+    if err != nil {
+        return nil, err
     }
 
-    return r.Choices[0].Message.Content, nil
+    req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", os.APIKey))
+    req.Header.Set("Content-Type", "application/json")
+
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("openai embeddings returned %s: %s", resp.Status, body)
+    }
+
+    var r struct {
+        Data []struct {
+            Index     int       `json:"index"`
+            Embedding []float64 `json:"embedding"`
+        } `json:"data"`
+    }
+
+    if err := json.Unmarshal(body, &r); err != nil {
+        return nil, err
+    }
+
+    if len(r.Data) != len(texts) {
+        return nil, fmt.Errorf("openai returned %d embeddings for %d inputs", len(r.Data), len(texts))
+    }
+
+    //results carry their input index, don't rely on the order
+    embs := make([][]float64, len(texts))
+    for _, d := range r.Data {
+        if d.Index < 0 || d.Index >= len(embs) {
+            return nil, fmt.Errorf("openai returned embedding for unknown index %d", d.Index)
+        }
+        embs[d.Index] = d.Embedding
+    }
+    return embs, nil
 }
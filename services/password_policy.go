@@ -0,0 +1,57 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+var ErrWeakPassword = errors.New("password too weak")
+
+//bcrypt only looks at the first 72 bytes, anything past that would silently not count
+const maxPasswordBytes = 72
+
+// PasswordPolicy is checked whenever a user picks a password
+type PasswordPolicy struct {
+	MinLength int
+	//how many of lowercase, uppercase, digits and symbols have to appear
+	MinClasses int
+}
+
+// Check returns ErrWeakPassword wrapped with the reason, or nil
+func (p PasswordPolicy) Check(username, password string) error {
+	if len([]rune(password)) < max(p.MinLength, 1) {
+		return fmt.Errorf("%w: must be at least %d characters", ErrWeakPassword, max(p.MinLength, 1))
+	}
+	if len(password) > maxPasswordBytes {
+		return fmt.Errorf("%w: must be at most %d bytes", ErrWeakPassword, maxPasswordBytes)
+	}
+	if username != "" && strings.EqualFold(password, username) {
+		return fmt.Errorf("%w: can't be the username", ErrWeakPassword)
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	classes := 0
+	for _, ok := range []bool{lower, upper, digit, symbol} {
+		if ok {
+			classes++
+		}
+	}
+	if classes < p.MinClasses {
+		return fmt.Errorf("%w: must mix at least %d of lowercase, uppercase, digits and symbols", ErrWeakPassword, p.MinClasses)
+	}
+	return nil
+}
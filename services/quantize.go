@@ -0,0 +1,313 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+)
+
+// QuantizationMode picks how a tab's vectors are held in memory.
+// Quantized tabs are scanned over compact codes for candidates, which are then re-scored
+// exactly against the full vectors in sqlite.
+type QuantizationMode string
+
+const (
+	QuantizationNone QuantizationMode = "none"
+	//one byte per dimension plus a scale, 4x smaller than float32
+	QuantizationInt8 QuantizationMode = "int8"
+	//one byte per 8 dimensions, 32x smaller, codebooks are trained on the tab's own vectors
+	QuantizationPQ QuantizationMode = "pq"
+)
+
+func ParseQuantizationMode(s string) (QuantizationMode, error) {
+	switch QuantizationMode(s) {
+	case "", QuantizationNone:
+		return QuantizationNone, nil
+	case QuantizationInt8, QuantizationPQ:
+		return QuantizationMode(s), nil
+	}
+	return "", fmt.Errorf("unknown quantization mode %q", s)
+}
+
+// quantizedSet holds a corpus as codes, search scores are approximate
+type quantizedSet interface {
+	add(id uint, vec []float32)
+	remove(id uint)
+	ids() []uint
+	search(q []float32, k int) []VectorHit
+}
+
+func newQuantizedSet(mode QuantizationMode, vecs map[uint][]float32) quantizedSet {
+	switch mode {
+	case QuantizationInt8:
+		s := &int8Set{codes: map[uint]int8Code{}}
+		for id, vec := range vecs {
+			s.add(id, vec)
+		}
+		return s
+	case QuantizationPQ:
+		s := &pqSet{codes: map[uint][]uint8{}, raw: map[uint][]float32{}}
+		s.build(vecs)
+		return s
+	}
+	return nil
+}
+
+type int8Code struct {
+	codes []int8
+	scale float32
+}
+
+// quantizeInt8 scales each vector by its own largest component so the full int8 range is used
+func quantizeInt8(vec []float32) int8Code {
+	var max float32
+	for _, v := range vec {
+		if a := float32(math.Abs(float64(v))); a > max {
+			max = a
+		}
+	}
+	c := int8Code{codes: make([]int8, len(vec))}
+	if max == 0 {
+		return c
+	}
+	c.scale = max / 127
+	for i, v := range vec {
+		c.codes[i] = int8(math.Round(float64(v / c.scale)))
+	}
+	return c
+}
+
+func (c int8Code) dot(o int8Code) float64 {
+	if len(c.codes) != len(o.codes) {
+		return 0
+	}
+	//127*127*dims stays well inside int32 for any embedding size in use
+	var sum int32
+	for i, a := range c.codes {
+		sum += int32(a) * int32(o.codes[i])
+	}
+	return float64(sum) * float64(c.scale) * float64(o.scale)
+}
+
+type int8Set struct {
+	codes map[uint]int8Code
+}
+
+func (s *int8Set) add(id uint, vec []float32) { s.codes[id] = quantizeInt8(vec) }
+func (s *int8Set) remove(id uint)             { delete(s.codes, id) }
+
+func (s *int8Set) ids() []uint {
+	ids := make([]uint, 0, len(s.codes))
+	for id := range s.codes {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (s *int8Set) search(q []float32, k int) []VectorHit {
+	qc := quantizeInt8(q)
+	hits := make([]VectorHit, 0, len(s.codes))
+	for id, c := range s.codes {
+		hits = append(hits, VectorHit{ID: id, Score: qc.dot(c)})
+	}
+	sortHits(hits)
+	if len(hits) > k {
+		hits = hits[:k]
+	}
+	return hits
+}
+
+const (
+	pqSubDim     = 8
+	pqCentroids  = 256
+	pqIterations = 6
+	//vectors are kept exact until there are enough to train codebooks on
+	pqTrainSize = 1024
+	pqMaxTrain  = 4096
+)
+
+// pqSet is product quantization: vectors are split into subspaces of pqSubDim dimensions
+// and each piece is replaced by the index of its nearest k-means centroid.
+type pqSet struct {
+	dim       int
+	bounds    []int
+	centroids [][][]float32
+	codes     map[uint][]uint8
+	//exact vectors from before training, or whose dimension doesn't match the codebooks
+	raw map[uint][]float32
+}
+
+func (s *pqSet) build(vecs map[uint][]float32) {
+	if len(vecs) >= pqTrainSize {
+		s.train(vecs)
+	}
+	for id, vec := range vecs {
+		s.add(id, vec)
+	}
+}
+
+func (s *pqSet) add(id uint, vec []float32) {
+	delete(s.codes, id)
+	delete(s.raw, id)
+	if s.centroids == nil || len(vec) != s.dim {
+		s.raw[id] = vec
+		if s.centroids == nil && len(s.raw) >= pqTrainSize {
+			pending := s.raw
+			s.raw = map[uint][]float32{}
+			s.build(pending)
+		}
+		return
+	}
+	s.codes[id] = s.encode(vec)
+}
+
+func (s *pqSet) remove(id uint) {
+	delete(s.codes, id)
+	delete(s.raw, id)
+}
+
+func (s *pqSet) ids() []uint {
+	ids := make([]uint, 0, len(s.codes)+len(s.raw))
+	for id := range s.codes {
+		ids = append(ids, id)
+	}
+	for id := range s.raw {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (s *pqSet) search(q []float32, k int) []VectorHit {
+	hits := make([]VectorHit, 0, len(s.codes)+len(s.raw))
+	if s.centroids != nil && len(q) == s.dim {
+		//the query stays exact, each code is scored by summing precomputed piece products
+		lut := make([][]float64, len(s.centroids))
+		for sub, cents := range s.centroids {
+			piece := q[s.bounds[sub]:s.bounds[sub+1]]
+			lut[sub] = make([]float64, len(cents))
+			for c, cent := range cents {
+				lut[sub][c] = dot32(piece, cent)
+			}
+		}
+		for id, code := range s.codes {
+			var score float64
+			for sub, c := range code {
+				score += lut[sub][c]
+			}
+			hits = append(hits, VectorHit{ID: id, Score: score})
+		}
+	}
+	for id, vec := range s.raw {
+		hits = append(hits, VectorHit{ID: id, Score: dot32(q, vec)})
+	}
+	sortHits(hits)
+	if len(hits) > k {
+		hits = hits[:k]
+	}
+	return hits
+}
+
+func (s *pqSet) encode(vec []float32) []uint8 {
+	code := make([]uint8, len(s.centroids))
+	for sub, cents := range s.centroids {
+		code[sub] = uint8(nearestCentroid(vec[s.bounds[sub]:s.bounds[sub+1]], cents))
+	}
+	return code
+}
+
+func (s *pqSet) train(vecs map[uint][]float32) {
+	var sample [][]float32
+	for _, vec := range vecs {
+		if s.dim == 0 {
+			s.dim = len(vec)
+		}
+		if len(vec) == s.dim {
+			sample = append(sample, vec)
+		}
+	}
+	//map order is random, shuffle with a fixed seed so the sample doesn't depend on it more than it has to
+	rng := rand.New(rand.NewSource(1))
+	rng.Shuffle(len(sample), func(i, j int) { sample[i], sample[j] = sample[j], sample[i] })
+	if len(sample) > pqMaxTrain {
+		sample = sample[:pqMaxTrain]
+	}
+
+	subspaces := s.dim / pqSubDim
+	if subspaces == 0 {
+		subspaces = 1
+	}
+	s.bounds = make([]int, subspaces+1)
+	for i := range s.bounds {
+		s.bounds[i] = i * s.dim / subspaces
+	}
+	s.centroids = make([][][]float32, subspaces)
+	var wg sync.WaitGroup
+	for sub := 0; sub < subspaces; sub++ {
+		wg.Add(1)
+		go func(sub int) {
+			defer wg.Done()
+			pieces := make([][]float32, len(sample))
+			for i, vec := range sample {
+				pieces[i] = vec[s.bounds[sub]:s.bounds[sub+1]]
+			}
+			s.centroids[sub] = kmeans(pieces, pqCentroids, pqIterations)
+		}(sub)
+	}
+	wg.Wait()
+}
+
+// kmeans clusters points into at most k centroids, seeded with the first k points
+func kmeans(points [][]float32, k, iterations int) [][]float32 {
+	if k > len(points) {
+		k = len(points)
+	}
+	dim := len(points[0])
+	centroids := make([][]float32, k)
+	for i := range centroids {
+		centroids[i] = append([]float32(nil), points[i]...)
+	}
+	assign := make([]int, len(points))
+	for it := 0; it < iterations; it++ {
+		for i, p := range points {
+			assign[i] = nearestCentroid(p, centroids)
+		}
+		sums := make([][]float64, k)
+		counts := make([]int, k)
+		for i := range sums {
+			sums[i] = make([]float64, dim)
+		}
+		for i, p := range points {
+			c := assign[i]
+			counts[c]++
+			for d, v := range p {
+				sums[c][d] += float64(v)
+			}
+		}
+		for c := range centroids {
+			//an empty cluster keeps its old centroid
+			if counts[c] == 0 {
+				continue
+			}
+			for d := range centroids[c] {
+				centroids[c][d] = float32(sums[c][d] / float64(counts[c]))
+			}
+		}
+	}
+	return centroids
+}
+
+func nearestCentroid(p []float32, centroids [][]float32) int {
+	best, bestDist := 0, float32(math.MaxFloat32)
+	for c, cent := range centroids {
+		var dist float32
+		for d, v := range p {
+			diff := v - cent[d]
+			dist += diff * diff
+		}
+		if dist < bestDist {
+			best, bestDist = c, dist
+		}
+	}
+	return best
+}
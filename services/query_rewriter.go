@@ -0,0 +1,147 @@
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// QueryRewriter uses the chat model to turn a question into better retrieval queries
+// before anything is embedded
+type QueryRewriter struct {
+	LLM LLMService
+}
+
+// QueryPlan says which extra queries to generate, every one of them is retrieved and fused
+type QueryPlan struct {
+	//rewrite follow-ups into a standalone question using the recent exchanges
+	Rewrite bool
+	//number of paraphrases of the (rewritten) question
+	Paraphrases int
+	//add a hypothetical answer, embedded in place of the question (HyDE)
+	HyDE bool
+}
+
+//upper bound so a request can't fan out into an unbounded number of searches
+const maxParaphrases = 5
+
+//strips "1.", "2)", "-" and similar list markers the model likes to add
+var listMarker = regexp.MustCompile(`^\s*(?:[-*•]|\d+[.)])\s*`)
+
+// Queries returns the queries to retrieve with, the (rewritten) question first.
+// Each step that fails is skipped so retrieval always has at least the original question.
+func (q *QueryRewriter) Queries(question string, history []string, plan QueryPlan) ([]string, []error) {
+	var errs []error
+	query := question
+	if plan.Rewrite && len(history) > 0 {
+		rewritten, err := q.Rewrite(question, history)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rewrite: %w", err))
+		} else {
+			query = rewritten
+		}
+	}
+	queries := []string{query}
+
+	if n := min(plan.Paraphrases, maxParaphrases); n > 0 {
+		paraphrases, err := q.Paraphrase(query, n)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("paraphrase: %w", err))
+		}
+		queries = appendUnique(queries, paraphrases...)
+	}
+	if plan.HyDE {
+		answer, err := q.Hypothetical(query)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("hyde: %w", err))
+		} else {
+			queries = appendUnique(queries, answer)
+		}
+	}
+	return queries, errs
+}
+
+// Rewrite turns a follow-up into a question that can be understood without the conversation
+func (q *QueryRewriter) Rewrite(question string, history []string) (string, error) {
+	var sb strings.Builder
+	sb.WriteString("Rewrite the last question of this conversation as a standalone search query that can be understood without the conversation. ")
+	sb.WriteString("Resolve pronouns and references like \"it\" or \"that\" using the earlier turns. ")
+	sb.WriteString("If it is already standalone, repeat it unchanged. Reply with the query only.\n\n")
+	sb.WriteString("Conversation:\n")
+	for _, h := range history {
+		sb.WriteString(truncateRunes(h, maxRerankPassage))
+		sb.WriteString("\n")
+	}
+	sb.WriteString(fmt.Sprintf("\nLast question: %s\n", question))
+
+	reply, err := q.LLM.GenerateResponse(sb.String())
+	if err != nil {
+		return "", err
+	}
+	rewritten := cleanQueryLine(reply)
+	if rewritten == "" {
+		return "", fmt.Errorf("empty rewrite")
+	}
+	return rewritten, nil
+}
+
+// Paraphrase returns up to n differently worded versions of the query
+func (q *QueryRewriter) Paraphrase(query string, n int) ([]string, error) {
+	prompt := fmt.Sprintf("Write %d different search queries that ask for the same information as the query below, "+
+		"using different wording and synonyms. Reply with one query per line and nothing else.\n\nQuery: %s\n", n, query)
+	reply, err := q.LLM.GenerateResponse(prompt)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, line := range strings.Split(reply, "\n") {
+		if p := cleanQueryLine(line); p != "" && len(out) < n {
+			out = append(out, p)
+		}
+	}
+	return out, nil
+}
+
+// Hypothetical writes a short passage that would answer the query, documents tend to sit
+// closer to an answer than to the question in embedding space
+func (q *QueryRewriter) Hypothetical(query string) (string, error) {
+	prompt := fmt.Sprintf("Write a short passage (a few sentences, or a code snippet if the question is about code) "+
+		"that answers the question below as a document in a knowledge base would. Do not mention that it is hypothetical.\n\nQuestion: %s\n", query)
+	reply, err := q.LLM.GenerateResponse(prompt)
+	if err != nil {
+		return "", err
+	}
+	reply = strings.TrimSpace(reply)
+	if reply == "" {
+		return "", fmt.Errorf("empty hypothetical answer")
+	}
+	return reply, nil
+}
+
+//first non-empty line without list markers or quotes
+func cleanQueryLine(s string) string {
+	for _, line := range strings.Split(s, "\n") {
+		line = listMarker.ReplaceAllString(line, "")
+		line = strings.Trim(strings.TrimSpace(line), "\"'`")
+		if line != "" {
+			return line
+		}
+	}
+	return ""
+}
+
+func appendUnique(queries []string, more ...string) []string {
+	for _, m := range more {
+		dup := false
+		for _, q := range queries {
+			if strings.EqualFold(q, m) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			queries = append(queries, m)
+		}
+	}
+	return queries
+}
@@ -1,101 +1,310 @@
 package services
 
 import (
-    "bytes"
+    "context"
     "context-aware-ai/models"
-    "encoding/gob"
-    "math"
-    "sort"
+    "errors"
+    "log"
+    "time"
 
     "gorm.io/gorm"
 )
 
-type RAGService struct {
-    DB            *gorm.DB
-    OllamaService *OllamaService
+// DocumentHit is a retrieved document with its cosine similarity to the query
+type DocumentHit struct {
+    models.Document
+    Score float64
+    vec   []float32
 }
 
-func encodeEmbedding(vec []float64) []byte {
-    var buf bytes.Buffer
-    _ = gob.NewEncoder(&buf).Encode(vec)
-    return buf.Bytes()
+type RAGService struct {
+    DB               *gorm.DB
+    EmbeddingService EmbeddingService
+    //texts per embedding request and rows per insert, defaults to 32
+    BatchSize        int
+    KeywordIndex     *KeywordIndex
+    VectorStore      VectorStore
+    //by name (RerankerOllama, RerankerLLM), tabs pick one through opts.Reranker
+    Rerankers        map[string]Reranker
+    //candidates handed to the reranker, defaults to 20
+    RerankCandidates int
+    //past this the retrieval order is kept, defaults to 10s
+    RerankTimeout    time.Duration
 }
 
-func decodeEmbedding(b []byte) []float64 {
-    var vec []float64
-    _ = gob.NewDecoder(bytes.NewReader(b)).Decode(&vec)
-    return vec
-}
+var ErrQuantizationUnsupported = errors.New("vector store does not support quantization")
 
-func cosine(a, b []float64) float64 {
-    var dot, na, nb float64
-    for i := range a {
-        dot += a[i] * b[i]
-        na += a[i] * a[i]
-        nb += b[i] * b[i]
-    }
-    if na == 0 || nb == 0 {
-        return 0
+//switches how the tab's document vectors are held, only the sqlite store quantizes in process
+func (r *RAGService) SetQuantization(userID, tabID uint, mode QuantizationMode) error {
+    qs, ok := r.VectorStore.(QuantizingStore)
+    if !ok {
+        return ErrQuantizationUnsupported
     }
-    return dot / (math.Sqrt(na) * math.Sqrt(nb))
+    return qs.SetQuantization(KindDocuments, userID, tabID, mode)
 }
 
 func (r *RAGService) DeleteDocumentsByTabID(userID, tabID uint) error {
-    return r.DB.Where("user_id = ? AND tab_id = ?", userID, tabID).Delete(&models.Document{}).Error
+    if err := r.DB.Where("user_id = ? AND tab_id = ?", userID, tabID).Delete(&models.Document{}).Error; err != nil {
+        return err
+    }
+    return r.DropIndexes(userID, tabID)
 }
 
+//forgets the tab's documents in the keyword index and the vector store, for when the rows are already gone
+func (r *RAGService) DropIndexes(userID, tabID uint) error {
+    r.KeywordIndex.Drop(KindDocuments, userID, tabID)
+    return r.VectorStore.DeleteWhere(KindDocuments, VectorFilter{UserID: userID, TabIDs: []uint{tabID}})
+}
 
-func (r *RAGService) IndexChunk(userID, tabID uint, source, content string) error {
-    emb, err := r.OllamaService.GetEmbedding(content)
-    if err != nil {
+//adds the documents of a finished ingestion job to the vector store, they only turn searchable
+//once this worked. upserts are idempotent so a job can be published again after a failure
+func (r *RAGService) PublishJob(jobID uint) error {
+    var docs []models.Document
+    if err := r.DB.Select("id, user_id, tab_id, source, symbol, tags, metadata, created_at, embedding").
+        Where("job_id = ?", jobID).Find(&docs).Error; err != nil {
         return err
     }
+    records := make([]VectorRecord, len(docs))
+    for i, d := range docs {
+        rec, err := documentRecord(d)
+        if err != nil {
+            return err
+        }
+        records[i] = rec
+    }
+    return r.VectorStore.Upsert(KindDocuments, records)
+}
 
-    doc := models.Document{
-        UserID:    userID,
-        TabID:     tabID,
-        Source:    source,
-        Content:   content,
-        Embedding: encodeEmbedding(emb),
+//fills in Embedding for every doc without storing, for callers that manage their own transaction
+func (r *RAGService) EmbedDocuments(docs []models.Document) error {
+    size := r.batchSize()
+    for start := 0; start < len(docs); start += size {
+        end := start + size
+        if end > len(docs) {
+            end = len(docs)
+        }
+        texts := make([]string, end-start)
+        for i := range texts {
+            texts[i] = docs[start+i].Content
+        }
+        embs, err := r.EmbeddingService.GetEmbeddings(texts)
+        if err != nil {
+            return err
+        }
+        for i, emb := range embs {
+            docs[start+i].Embedding = encodeEmbedding(emb)
+        }
     }
+    return nil
+}
 
-    return r.DB.Create(&doc).Error
+func (r *RAGService) InsertDocuments(tx *gorm.DB, docs []models.Document) error {
+    if len(docs) == 0 {
+        return nil
+    }
+    return tx.CreateInBatches(&docs, r.batchSize()).Error
 }
 
-func (r *RAGService) Search(userID, tabID uint, query string, topK int) ([]models.Document, error) {
-    qEmb, err := r.OllamaService.GetEmbedding(query)
+//call once the documents are committed, pending ones are still filtered out at search time
+func (r *RAGService) IndexKeywords(docs []models.Document) {
+    for _, d := range docs {
+        if d.ID == 0 {
+            continue
+        }
+        r.KeywordIndex.Add(KindDocuments, d.UserID, d.TabID, d.ID, d.Content)
+    }
+}
+
+func (r *RAGService) batchSize() int {
+    if r.BatchSize <= 0 {
+        return 32
+    }
+    return r.BatchSize
+}
+
+//ranks the tab's documents by cosine through the vector store, fused with BM25 when opts.KeywordWeight is set.
+//with opts.Reranker a larger candidate set is reordered by the reranker before cutting to TopK,
+//then MMR picks a diverse TopK from the candidates when opts.MMRLambda is set.
+//documents less similar to the query than opts.MinScore never make it into the candidates
+func (r *RAGService) Search(userID, tabID uint, query string, opts SearchOptions) ([]DocumentHit, error) {
+    qEmb, err := r.EmbeddingService.GetEmbedding(query)
     if err != nil {
         return nil, err
     }
 
-    var docs []models.Document
-    if err := r.DB.Where("user_id = ? AND tab_id = ?", userID, tabID).Find(&docs).Error; err != nil {
+    reranker := r.Rerankers[opts.Reranker]
+    keep := opts.TopK
+    depth := opts.candidates()
+    if reranker != nil && r.rerankCandidates() > keep {
+        keep = r.rerankCandidates()
+    }
+    if mmrEnabled(opts.MMRLambda) && depth > keep {
+        keep = depth
+    }
+    if depth < keep {
+        depth = keep
+    }
+
+    qv := NormalizeEmbedding(qEmb)
+    hits, err := r.VectorStore.Search(KindDocuments, qv, depth, VectorFilter{UserID: userID, TabIDs: []uint{tabID}, Conditions: opts.Filter})
+    if err != nil {
         return nil, err
     }
+    vectorRank := make([]uint, len(hits))
+    for i, h := range hits {
+        vectorRank[i] = h.ID
+    }
 
-    type scored struct {
-        Doc   models.Document
-        Score float64
+    var keywordRank []uint
+    if opts.KeywordWeight > 0 {
+        kwHits, err := r.KeywordIndex.Search(KindDocuments, userID, tabID, query, depth)
+        if err != nil {
+            return nil, err
+        }
+        for _, h := range kwHits {
+            keywordRank = append(keywordRank, h.ID)
+        }
     }
 
-    results := make([]scored, 0, len(docs))
+    ranked := fuseRankings(vectorRank, keywordRank, opts.KeywordWeight)
+    if len(ranked) == 0 {
+        return []DocumentHit{}, nil
+    }
+
+    //the keyword index also holds documents of unfinished jobs and ones the filter excludes, those are dropped here
+    var docs []models.Document
+    q := r.DB.Where("id IN ? AND user_id = ? AND tab_id = ? AND pending = ?", ranked, userID, tabID, false)
+    if err := applyFilter(q, opts.Filter).Find(&docs).Error; err != nil {
+        return nil, err
+    }
+    byID := make(map[uint]models.Document, len(docs))
     for _, d := range docs {
-        emb := decodeEmbedding(d.Embedding)
-        score := cosine(qEmb, emb)
-        results = append(results, scored{Doc: d, Score: score})
+        byID[d.ID] = d
     }
 
-    sort.Slice(results, func(i, j int) bool {
-        return results[i].Score > results[j].Score
-    })
+    //scored from the stored vectors so quantized and keyword-only hits get exact similarities too
+    final := make([]DocumentHit, 0, keep)
+    for _, id := range ranked {
+        if len(final) == keep {
+            break
+        }
+        d, ok := byID[id]
+        if !ok {
+            continue
+        }
+        vec, err := decodeEmbedding(d.Embedding)
+        if err != nil {
+            continue
+        }
+        score := dot32(qv, vec)
+        if score < opts.MinScore {
+            continue
+        }
+        final = append(final, DocumentHit{Document: d, Score: score, vec: vec})
+    }
+    if reranker != nil {
+        final = r.rerank(reranker, userID, tabID, query, final)
+    }
+    if mmrEnabled(opts.MMRLambda) {
+        final = diversifyDocuments(final, opts.TopK, opts.MMRLambda)
+    }
+    if len(final) > opts.TopK {
+        final = final[:opts.TopK]
+    }
+    if opts.MergeAdjacent {
+        final = mergeAdjacentChunks(final)
+    }
+    return final, nil
+}
 
-    if len(results) > topK {
-        results = results[:topK]
+// SearchQueries runs Search for each query (a rewritten question, paraphrases, a hypothetical answer)
+// and fuses the results with reciprocal rank fusion. A document found by several queries keeps its
+// best score, adjacent chunks are merged once the fused TopK is known.
+func (r *RAGService) SearchQueries(userID, tabID uint, queries []string, opts SearchOptions) ([]DocumentHit, error) {
+    if len(queries) == 1 {
+        return r.Search(userID, tabID, queries[0], opts)
     }
+    perQuery := opts
+    perQuery.MergeAdjacent = false
 
-    final := make([]models.Document, len(results))
-    for i, r := range results {
-        final[i] = r.Doc
+    byID := map[uint]DocumentHit{}
+    lists := make([][]uint, 0, len(queries))
+    for _, q := range queries {
+        hits, err := r.Search(userID, tabID, q, perQuery)
+        if err != nil {
+            return nil, err
+        }
+        ids := make([]uint, len(hits))
+        for i, h := range hits {
+            ids[i] = h.ID
+            if prev, ok := byID[h.ID]; !ok || h.Score > prev.Score {
+                byID[h.ID] = h
+            }
+        }
+        lists = append(lists, ids)
+    }
+
+    final := make([]DocumentHit, 0, opts.TopK)
+    for _, id := range fuseLists(lists) {
+        if len(final) == opts.TopK {
+            break
+        }
+        final = append(final, byID[id])
+    }
+    if opts.MergeAdjacent {
+        final = mergeAdjacentChunks(final)
     }
     return final, nil
 }
+
+//reorders docs by the reranker's scores, on error or timeout the retrieval order is returned unchanged
+func (r *RAGService) rerank(reranker Reranker, userID, tabID uint, query string, docs []DocumentHit) []DocumentHit {
+    if len(docs) < 2 {
+        return docs
+    }
+    ctx, cancel := context.WithTimeout(WithUsageOwner(context.Background(), userID, tabID), r.rerankTimeout())
+    defer cancel()
+
+    passages := make([]string, len(docs))
+    for i, d := range docs {
+        passages[i] = d.Content
+    }
+    start := time.Now()
+    scores, err := reranker.Rerank(ctx, query, passages)
+    if err == nil && len(scores) != len(docs) {
+        err = errors.New("reranker returned the wrong number of scores")
+    }
+    if err != nil {
+        log.Printf("rerank failed after %s, keeping retrieval order: %v", time.Since(start).Round(time.Millisecond), err)
+        return docs
+    }
+
+    out := make([]DocumentHit, len(docs))
+    for i, idx := range rerankOrder(scores) {
+        out[i] = docs[idx]
+    }
+    return out
+}
+
+//none is always valid, the others only when configured
+func (r *RAGService) HasReranker(name string) bool {
+    if name == RerankerNone {
+        return true
+    }
+    _, ok := r.Rerankers[name]
+    return ok
+}
+
+func (r *RAGService) rerankCandidates() int {
+    if r.RerankCandidates <= 0 {
+        return 20
+    }
+    return r.RerankCandidates
+}
+
+func (r *RAGService) rerankTimeout() time.Duration {
+    if r.RerankTimeout <= 0 {
+        return 10 * time.Second
+    }
+    return r.RerankTimeout
+}
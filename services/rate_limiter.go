@@ -0,0 +1,104 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket per key (a client IP or a user id): it holds up to Burst
+// requests and refills at Rate per second. Buckets live in memory, a restart forgets them.
+type RateLimiter struct {
+	Rate  float64
+	Burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+//full buckets are dropped this often so one-off clients don't pile up
+const rateLimitPruneInterval = time.Minute
+
+// ParseRateLimit reads "<n>/<s|m|h>" with an optional ",<burst>", e.g. "30/m,10".
+// "off" or an empty string gives a nil limiter, which allows everything.
+func ParseRateLimit(spec string) (*RateLimiter, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" || spec == "off" {
+		return nil, nil
+	}
+	rate, burstStr, hasBurst := strings.Cut(spec, ",")
+	count, unit, ok := strings.Cut(rate, "/")
+	if !ok {
+		return nil, fmt.Errorf("rate limit %q: expected <n>/<s|m|h>", spec)
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(count), 64)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("rate limit %q: bad count", spec)
+	}
+	var per time.Duration
+	switch strings.TrimSpace(unit) {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		return nil, fmt.Errorf("rate limit %q: unit must be s, m or h", spec)
+	}
+	burst := int(math.Ceil(n))
+	if hasBurst {
+		if burst, err = strconv.Atoi(strings.TrimSpace(burstStr)); err != nil || burst < 1 {
+			return nil, fmt.Errorf("rate limit %q: bad burst", spec)
+		}
+	}
+	return &RateLimiter{Rate: n / per.Seconds(), Burst: burst}, nil
+}
+
+// Allow takes a token from the key's bucket, when it is empty it reports how long until the next one
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = map[string]*bucket{}
+	}
+	if now.Sub(l.lastPrune) > rateLimitPruneInterval {
+		l.prune(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+	return false, wait
+}
+
+func (l *RateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.Rate >= float64(l.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPrune = now
+}
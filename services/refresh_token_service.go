@@ -0,0 +1,137 @@
+package services
+
+import (
+	"context-aware-ai/models"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token invalid or expired")
+	//a token that was already rotated was presented again, the whole family has been revoked
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// RefreshTokenService keeps track of issued refresh tokens so they can be rotated and revoked
+type RefreshTokenService struct {
+	DB  *gorm.DB
+	TTL time.Duration
+}
+
+// Issue records a new refresh token, an empty familyID starts a new family (a new login)
+func (s *RefreshTokenService) Issue(userID uint, familyID string) (*models.RefreshToken, error) {
+	return s.issue(s.DB, userID, familyID, time.Now())
+}
+
+func (s *RefreshTokenService) issue(tx *gorm.DB, userID uint, familyID string, authTime time.Time) (*models.RefreshToken, error) {
+	jti, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	if familyID == "" {
+		if familyID, err = randomID(); err != nil {
+			return nil, err
+		}
+	}
+	token := models.RefreshToken{
+		JTI:       jti,
+		FamilyID:  familyID,
+		UserID:    userID,
+		AuthTime:  authTime,
+		ExpiresAt: time.Now().Add(s.ttl()),
+	}
+	if err := tx.Create(&token).Error; err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// Rotate marks the token used and issues its successor in the same family.
+// Presenting a token that was already used revokes the family and returns ErrRefreshTokenReused.
+func (s *RefreshTokenService) Rotate(userID uint, jti string) (*models.RefreshToken, error) {
+	var next *models.RefreshToken
+	reused := false
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		var token models.RefreshToken
+		err := tx.Where("jti = ? AND user_id = ?", jti, userID).First(&token).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrRefreshTokenInvalid
+		}
+		if err != nil {
+			return err
+		}
+		if token.RevokedAt != nil || time.Now().After(token.ExpiresAt) {
+			return ErrRefreshTokenInvalid
+		}
+
+		//conditional so two concurrent refreshes with the same token can't both win
+		now := time.Now()
+		res := tx.Model(&models.RefreshToken{}).Where("id = ? AND used_at IS NULL", token.ID).Update("used_at", now)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			reused = true
+			return ErrRefreshTokenReused
+		}
+		next, err = s.issue(tx, userID, token.FamilyID, token.AuthTime)
+		return err
+	})
+	if reused {
+		//outside the rolled back transaction so the revocation sticks
+		if err := s.RevokeFamily(userID, jti); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+	if err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// RevokeFamily revokes every token that shares a family with jti, used to log out one session
+func (s *RefreshTokenService) RevokeFamily(userID uint, jti string) error {
+	var token models.RefreshToken
+	err := s.DB.Where("jti = ? AND user_id = ?", jti, userID).First(&token).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return err
+	}
+	return s.DB.Model(&models.RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", token.FamilyID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// RevokeAll revokes every refresh token of the user
+func (s *RefreshTokenService) RevokeAll(userID uint) error {
+	return s.DB.Model(&models.RefreshToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// PurgeExpired deletes records that can no longer be used
+func (s *RefreshTokenService) PurgeExpired() error {
+	return s.DB.Where("expires_at < ?", time.Now()).Delete(&models.RefreshToken{}).Error
+}
+
+func (s *RefreshTokenService) ttl() time.Duration {
+	if s.TTL <= 0 {
+		return 30 * 24 * time.Hour
+	}
+	return s.TTL
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,197 @@
+package services
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// RepoFile is a text file pulled out of an uploaded repository archive
+type RepoFile struct {
+	Path string
+	Data []byte
+}
+
+// RepoLoader unpacks zip and tar(.gz) archives and filters their files
+type RepoLoader struct {
+	MaxFileSize  int64
+	MaxTotalSize int64
+}
+
+//always skipped on top of whatever the repo ignores itself
+var defaultRepoExcludes = ".git/\nnode_modules/\nvendor/\n*.min.js\n*.lock\ngo.sum\n"
+
+// Load reads every text file in the archive, dropping anything matched by the
+// archive's .gitignore files or by the extra exclude patterns
+func (l *RepoLoader) Load(name string, r io.ReaderAt, size int64, excludes []string) ([]RepoFile, error) {
+	var files []RepoFile
+	var err error
+
+	header := make([]byte, 4)
+	n, _ := r.ReadAt(header, 0)
+	header = header[:n]
+
+	lower := strings.ToLower(name)
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")) || strings.HasSuffix(lower, ".zip"):
+		files, err = l.readZip(r, size)
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		gz, gzErr := gzip.NewReader(io.NewSectionReader(r, 0, size))
+		if gzErr != nil {
+			return nil, fmt.Errorf("invalid gzip archive: %v", gzErr)
+		}
+		defer gz.Close()
+		files, err = l.readTar(gz)
+	default:
+		files, err = l.readTar(io.NewSectionReader(r, 0, size))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	files = stripCommonRoot(files)
+
+	matcher := &IgnoreMatcher{}
+	matcher.AddPatterns("", defaultRepoExcludes)
+	//shallower .gitignore files first so nested ones can override them
+	sort.SliceStable(files, func(i, j int) bool {
+		return strings.Count(files[i].Path, "/") < strings.Count(files[j].Path, "/")
+	})
+	for _, f := range files {
+		if path.Base(f.Path) != ".gitignore" {
+			continue
+		}
+		dir := path.Dir(f.Path)
+		if dir == "." {
+			dir = ""
+		}
+		matcher.AddPatterns(dir, string(f.Data))
+	}
+	matcher.AddPatterns("", strings.Join(excludes, "\n"))
+
+	kept := make([]RepoFile, 0, len(files))
+	for _, f := range files {
+		if path.Base(f.Path) == ".gitignore" || matcher.Match(f.Path, false) {
+			continue
+		}
+		if !isText(f.Data) {
+			continue
+		}
+		kept = append(kept, f)
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].Path < kept[j].Path })
+	return kept, nil
+}
+
+func (l *RepoLoader) readZip(r io.ReaderAt, size int64) ([]RepoFile, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("invalid zip archive: %v", err)
+	}
+	var files []RepoFile
+	var total int64
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() || !l.sizeOK(int64(zf.UncompressedSize64)) {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		total += int64(len(data))
+		if l.MaxTotalSize > 0 && total > l.MaxTotalSize {
+			return nil, fmt.Errorf("archive exceeds %d bytes", l.MaxTotalSize)
+		}
+		files = append(files, RepoFile{Path: zf.Name, Data: data})
+	}
+	return files, nil
+}
+
+func (l *RepoLoader) readTar(r io.Reader) ([]RepoFile, error) {
+	tr := tar.NewReader(bufio.NewReader(r))
+	var files []RepoFile
+	var total int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid tar archive: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg || !l.sizeOK(hdr.Size) {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		total += int64(len(data))
+		if l.MaxTotalSize > 0 && total > l.MaxTotalSize {
+			return nil, fmt.Errorf("archive exceeds %d bytes", l.MaxTotalSize)
+		}
+		files = append(files, RepoFile{Path: hdr.Name, Data: data})
+	}
+	return files, nil
+}
+
+func (l *RepoLoader) sizeOK(size int64) bool {
+	return l.MaxFileSize <= 0 || size <= l.MaxFileSize
+}
+
+//github style archives wrap everything in a single repo-sha/ directory
+func stripCommonRoot(files []RepoFile) []RepoFile {
+	for i := range files {
+		files[i].Path = strings.TrimPrefix(path.Clean("/"+files[i].Path), "/")
+	}
+	if len(files) == 0 {
+		return files
+	}
+	root, _, ok := strings.Cut(files[0].Path, "/")
+	if !ok {
+		return files
+	}
+	for _, f := range files {
+		if !strings.HasPrefix(f.Path, root+"/") {
+			return files
+		}
+	}
+	for i := range files {
+		files[i].Path = strings.TrimPrefix(files[i].Path, root+"/")
+	}
+	return files
+}
+
+func isText(data []byte) bool {
+	sample := data
+	if len(sample) > 8000 {
+		sample = sample[:8000]
+	}
+	if bytes.IndexByte(sample, 0) >= 0 {
+		return false
+	}
+	return utf8.Valid(sample[:lastRuneStart(sample)])
+}
+
+//the sample may cut a multi byte rune in half so only validate up to the last full one
+func lastRuneStart(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			return i
+		}
+	}
+	return len(b)
+}
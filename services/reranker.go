@@ -0,0 +1,113 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Reranker scores how relevant each passage is to the query, higher is more relevant.
+// Scores are only compared within one call.
+type Reranker interface {
+	Rerank(ctx context.Context, query string, passages []string) ([]float64, error)
+}
+
+const (
+	RerankerNone   = "none"
+	RerankerOllama = "ollama"
+	RerankerLLM    = "llm"
+)
+
+//keeps prompts bounded when a chunk is unusually long
+const maxRerankPassage = 2000
+
+// LLMReranker asks the chat model to grade every candidate in a single prompt
+type LLMReranker struct {
+	LLM LLMService
+	//records the calls under the user and tab from WithUsageOwner, nil records nothing
+	Usage *UsageService
+}
+
+var rerankScoreLine = regexp.MustCompile(`^\s*\[?(\d+)\]?\s*[:=\-]\s*(\d+(?:\.\d+)?)`)
+
+func (l *LLMReranker) Rerank(ctx context.Context, query string, passages []string) ([]float64, error) {
+	var sb strings.Builder
+	sb.WriteString("Rate how relevant each passage is to the question on a scale from 0 to 10.\n")
+	sb.WriteString("Reply with one line per passage in the form `<passage number>: <score>` and nothing else.\n\n")
+	sb.WriteString(fmt.Sprintf("Question: %s\n", query))
+	for i, p := range passages {
+		sb.WriteString(fmt.Sprintf("\n[%d]\n%s\n", i+1, truncateRunes(p, maxRerankPassage)))
+	}
+
+	llm := l.LLM
+	if owner, ok := usageOwnerFrom(ctx); ok {
+		llm = l.Usage.Wrap(llm, owner.userID, owner.tabID, PurposeRerank)
+	}
+
+	//LLMService has no context, the call is left to finish on its own if we stop waiting
+	type result struct {
+		text string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		text, err := llm.GenerateResponse(sb.String())
+		done <- result{text, err}
+	}()
+	var res result
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res = <-done:
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+
+	scores := make([]float64, len(passages))
+	for i := range scores {
+		scores[i] = -1
+	}
+	parsed := 0
+	for _, line := range strings.Split(res.text, "\n") {
+		m := rerankScoreLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[1])
+		score, err := strconv.ParseFloat(m[2], 64)
+		if err != nil || n < 1 || n > len(passages) {
+			continue
+		}
+		scores[n-1] = score
+		parsed++
+	}
+	if parsed == 0 {
+		return nil, fmt.Errorf("no scores in reranker reply")
+	}
+	return scores, nil
+}
+
+// rerankOrder returns the indexes of scores from most to least relevant,
+// ties keep the retrieval order
+func rerankOrder(scores []float64) []int {
+	order := make([]int, len(scores))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return scores[order[i]] > scores[order[j]]
+	})
+	return order
+}
+
+func truncateRunes(s string, max int) string {
+	r := []rune(s)
+	if len(r) <= max {
+		return s
+	}
+	return string(r[:max]) + "..."
+}
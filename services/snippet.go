@@ -0,0 +1,142 @@
+package services
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Snippet is a window of a document or memory around the query terms.
+// Highlights are [start, end) rune offsets into Text of every word matching a query term.
+type Snippet struct {
+	Text       string   `json:"text"`
+	Highlights [][2]int `json:"highlights"`
+}
+
+// words too common to be worth highlighting
+var snippetStopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "by": true,
+	"do": true, "does": true, "for": true, "from": true, "how": true, "i": true, "in": true, "is": true,
+	"it": true, "of": true, "on": true, "or": true, "the": true, "this": true, "to": true, "what": true,
+	"when": true, "where": true, "which": true, "who": true, "why": true, "with": true,
+}
+
+const snippetEllipsis = "…"
+
+type snippetWord struct {
+	start, end int
+	match      bool
+}
+
+// MakeSnippet picks the window of at most maxRunes runes holding the most query term matches,
+// the same tokens the keyword index uses so identifiers like parseConfig match "config"
+func MakeSnippet(text, query string, maxRunes int) Snippet {
+	terms := map[string]bool{}
+	for _, t := range tokenize(query) {
+		if !snippetStopWords[t] {
+			terms[t] = true
+		}
+	}
+
+	runes := []rune(text)
+	words := snippetWords(runes, terms)
+
+	start, end := 0, len(runes)
+	if len(runes) > maxRunes {
+		start, end = bestWindow(runes, words, maxRunes)
+	}
+
+	var sb strings.Builder
+	offset := 0
+	if start > 0 {
+		sb.WriteString(snippetEllipsis)
+		offset = len([]rune(snippetEllipsis))
+	}
+	sb.WriteString(string(runes[start:end]))
+	if end < len(runes) {
+		sb.WriteString(snippetEllipsis)
+	}
+
+	highlights := [][2]int{}
+	for _, w := range words {
+		if w.match && w.start >= start && w.end <= end {
+			highlights = append(highlights, [2]int{w.start - start + offset, w.end - start + offset})
+		}
+	}
+	return Snippet{Text: sb.String(), Highlights: highlights}
+}
+
+func snippetWords(runes []rune, terms map[string]bool) []snippetWord {
+	var words []snippetWord
+	for i := 0; i < len(runes); {
+		if !isSnippetWord(runes[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(runes) && isSnippetWord(runes[j]) {
+			j++
+		}
+		match := false
+		for _, t := range tokenize(string(runes[i:j])) {
+			if terms[t] {
+				match = true
+				break
+			}
+		}
+		words = append(words, snippetWord{start: i, end: j, match: match})
+		i = j
+	}
+	return words
+}
+
+// starts a little before a match so the first hit has some context, then snaps to word boundaries
+func bestWindow(runes []rune, words []snippetWord, maxRunes int) (int, int) {
+	const lead = 30
+	best, bestCount := 0, -1
+	for i, w := range words {
+		if !w.match {
+			continue
+		}
+		start := max(w.start-lead, 0)
+		count := 0
+		for _, o := range words[i:] {
+			if o.end > start+maxRunes {
+				break
+			}
+			if o.match {
+				count++
+			}
+		}
+		if count > bestCount {
+			best, bestCount = start, count
+		}
+	}
+
+	start := best
+	end := min(start+maxRunes, len(runes))
+	if end == len(runes) {
+		start = max(end-maxRunes, 0)
+	}
+	//don't cut words in half
+	for start > 0 && start < end && isSnippetWord(runes[start-1]) && isSnippetWord(runes[start]) {
+		start++
+	}
+	for end < len(runes) && end > start && isSnippetWord(runes[end-1]) && isSnippetWord(runes[end]) {
+		end--
+	}
+	if end <= start {
+		end = min(start+maxRunes, len(runes))
+	}
+	for start < end && unicode.IsSpace(runes[start]) {
+		start++
+	}
+	for end > start && unicode.IsSpace(runes[end-1]) {
+		end--
+	}
+	return start, end
+}
+
+// same word characters as tokenize
+func isSnippetWord(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
@@ -35,6 +35,16 @@ func (s *TabService) GetTabByID(tabID uint) (*models.Tab, error) {
 	return &tab, err
 }
 
+func (s *TabService) SetQuantization(userID uint, tabID uint, mode QuantizationMode) error {
+	return s.DB.Model(&models.Tab{}).Where("user_id = ? AND id = ?", userID, tabID).
+		Update("quantization", string(mode)).Error
+}
+
+func (s *TabService) SetReranker(userID uint, tabID uint, reranker string) error {
+	return s.DB.Model(&models.Tab{}).Where("user_id = ? AND id = ?", userID, tabID).
+		Update("reranker", reranker).Error
+}
+
 func (s *TabService) DeleteTab(userID uint, tabID uint) error {
     err := s.DB.Where("user_id = ? AND id = ?", userID, tabID).Delete(&models.Tab{}).Error
     return err
@@ -0,0 +1,288 @@
+package services
+
+import (
+	"context"
+	"context-aware-ai/models"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// what an LLM call was made for, stored with every usage record
+const (
+	PurposeChat      = "chat"
+	PurposeReasoning = "reasoning"
+	PurposeRewrite   = "rewrite"
+	PurposeRerank    = "rerank"
+)
+
+var ErrQuotaExceeded = errors.New("usage quota exceeded")
+
+// UsagePrice is the price of a million input and a million output tokens
+type UsagePrice struct {
+	Input  float64
+	Output float64
+}
+
+// UsageLimits are the quotas of a user, 0 is unlimited. Days and months start at UTC midnight.
+type UsageLimits struct {
+	DailyTokens   int64   `json:"daily_tokens"`
+	MonthlyTokens int64   `json:"monthly_tokens"`
+	DailyCost     float64 `json:"daily_cost"`
+	MonthlyCost   float64 `json:"monthly_cost"`
+}
+
+// UsageService records the tokens every LLM call used, prices them and enforces quotas.
+// Quotas are checked before a request starts and again before each of its LLM calls, so only the
+// call that crosses one goes over.
+type UsageService struct {
+	DB *gorm.DB
+	//by model name, a model without an exact entry uses the longest entry it starts with
+	Prices map[string]UsagePrice
+	//applied to users without their own UsageQuota
+	Defaults UsageLimits
+}
+
+type UsageTotals struct {
+	Requests     int64   `json:"requests"`
+	InputTokens  int64   `json:"input_tokens"`
+	OutputTokens int64   `json:"output_tokens"`
+	Cost         float64 `json:"cost"`
+}
+
+// UsagePeriod is the consumption of the current day or month against its quota
+type UsagePeriod struct {
+	UsageTotals
+	Start      time.Time `json:"start"`
+	ResetsAt   time.Time `json:"resets_at"`
+	TokenLimit int64     `json:"token_limit"`
+	CostLimit  float64   `json:"cost_limit"`
+}
+
+// UsageGroup is the consumption of one model, tab or purpose
+type UsageGroup struct {
+	UsageTotals
+	Key string `gorm:"column:group_key" json:"-"`
+}
+
+// ParsePrices reads "model=input:output,..." with prices per million tokens,
+// e.g. "gpt-4o-mini=0.15:0.6,claude-3-5-haiku=0.8:4"
+func ParsePrices(spec string) (map[string]UsagePrice, error) {
+	prices := map[string]UsagePrice{}
+	for model, pair := range splitPairs(spec, "=") {
+		in, out, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("price of %s: expected input:output", model)
+		}
+		input, err := strconv.ParseFloat(in, 64)
+		if err != nil || input < 0 {
+			return nil, fmt.Errorf("price of %s: bad input price %q", model, in)
+		}
+		output, err := strconv.ParseFloat(out, 64)
+		if err != nil || output < 0 {
+			return nil, fmt.Errorf("price of %s: bad output price %q", model, out)
+		}
+		prices[model] = UsagePrice{Input: input, Output: output}
+	}
+	return prices, nil
+}
+
+// Cost estimates the price of the usage, models missing from the price table cost 0
+func (s *UsageService) Cost(u Usage) float64 {
+	price, ok := s.Prices[u.Model]
+	if !ok {
+		//providers answer with dated versions such as gpt-4o-mini-2024-07-18
+		best := ""
+		for model, p := range s.Prices {
+			if strings.HasPrefix(u.Model, model) && len(model) > len(best) {
+				best, price = model, p
+			}
+		}
+	}
+	return (float64(u.InputTokens)*price.Input + float64(u.OutputTokens)*price.Output) / 1e6
+}
+
+func (s *UsageService) Record(userID, tabID uint, purpose string, u Usage) error {
+	return s.DB.Create(&models.UsageRecord{
+		UserID:       userID,
+		TabID:        tabID,
+		Purpose:      purpose,
+		Model:        u.Model,
+		InputTokens:  u.InputTokens,
+		OutputTokens: u.OutputTokens,
+		Cost:         s.Cost(u),
+	}).Error
+}
+
+// Wrap returns an LLMService that records the usage of every call under the user and tab.
+// Providers that don't report usage, and a nil UsageService, get llm back unchanged.
+func (s *UsageService) Wrap(llm LLMService, userID, tabID uint, purpose string) LLMService {
+	metered, ok := llm.(MeteredLLM)
+	if s == nil || !ok {
+		return llm
+	}
+	return &usageLLM{llm: metered, usage: s, userID: userID, tabID: tabID, purpose: purpose}
+}
+
+type usageLLM struct {
+	llm     MeteredLLM
+	usage   *UsageService
+	userID  uint
+	tabID   uint
+	purpose string
+}
+
+// GenerateResponse checks the quota again before every call, one request makes several (rewrites,
+// reranking, reasoning) and it can run out midway, so only the call that crosses it goes over
+func (u *usageLLM) GenerateResponse(prompt string) (string, error) {
+	if _, err := u.usage.CheckQuota(u.userID); err != nil {
+		return "", err
+	}
+	text, usage, err := u.llm.Generate(prompt)
+	if err != nil {
+		return "", err
+	}
+	//the answer is already paid for, losing the record is better than failing the request
+	if err := u.usage.Record(u.userID, u.tabID, u.purpose, usage); err != nil {
+		log.Printf("recording usage of user %d: %v", u.userID, err)
+	}
+	return text, nil
+}
+
+type usageOwnerKey struct{}
+
+type usageOwner struct {
+	userID uint
+	tabID  uint
+}
+
+// WithUsageOwner marks ctx as work for the user and tab, for LLM calls made deep inside retrieval
+func WithUsageOwner(ctx context.Context, userID, tabID uint) context.Context {
+	return context.WithValue(ctx, usageOwnerKey{}, usageOwner{userID, tabID})
+}
+
+func usageOwnerFrom(ctx context.Context) (usageOwner, bool) {
+	owner, ok := ctx.Value(usageOwnerKey{}).(usageOwner)
+	return owner, ok
+}
+
+// Limits returns the user's quotas, their own UsageQuota overrides the defaults field by field
+func (s *UsageService) Limits(userID uint) (UsageLimits, error) {
+	limits := s.Defaults
+	var q models.UsageQuota
+	res := s.DB.Where("user_id = ?", userID).Limit(1).Find(&q)
+	if res.Error != nil {
+		return limits, res.Error
+	}
+	if q.DailyTokens != nil {
+		limits.DailyTokens = *q.DailyTokens
+	}
+	if q.MonthlyTokens != nil {
+		limits.MonthlyTokens = *q.MonthlyTokens
+	}
+	if q.DailyCost != nil {
+		limits.DailyCost = *q.DailyCost
+	}
+	if q.MonthlyCost != nil {
+		limits.MonthlyCost = *q.MonthlyCost
+	}
+	return limits, nil
+}
+
+func (s *UsageService) Quota(userID uint) (*models.UsageQuota, error) {
+	q := models.UsageQuota{UserID: userID}
+	err := s.DB.Where("user_id = ?", userID).Limit(1).Find(&q).Error
+	return &q, err
+}
+
+// SetQuota replaces the user's overrides, all fields nil puts the user back on the defaults
+func (s *UsageService) SetQuota(q *models.UsageQuota) error {
+	if q.DailyTokens == nil && q.MonthlyTokens == nil && q.DailyCost == nil && q.MonthlyCost == nil {
+		return s.DB.Where("user_id = ?", q.UserID).Delete(&models.UsageQuota{}).Error
+	}
+	return s.DB.Save(q).Error
+}
+
+// Periods returns the user's consumption of the current day and month with their quotas
+func (s *UsageService) Periods(userID uint) (day, month UsagePeriod, err error) {
+	limits, err := s.Limits(userID)
+	if err != nil {
+		return day, month, err
+	}
+	dayStart, monthStart := periodStarts(time.Now())
+	day = UsagePeriod{Start: dayStart, ResetsAt: dayStart.AddDate(0, 0, 1),
+		TokenLimit: limits.DailyTokens, CostLimit: limits.DailyCost}
+	month = UsagePeriod{Start: monthStart, ResetsAt: monthStart.AddDate(0, 1, 0),
+		TokenLimit: limits.MonthlyTokens, CostLimit: limits.MonthlyCost}
+	if day.UsageTotals, err = s.totals(userID, dayStart); err != nil {
+		return day, month, err
+	}
+	month.UsageTotals, err = s.totals(userID, monthStart)
+	return day, month, err
+}
+
+// CheckQuota returns ErrQuotaExceeded, naming the quota, when the user has used up a daily or
+// monthly quota, along with when it resets
+func (s *UsageService) CheckQuota(userID uint) (time.Time, error) {
+	if s == nil {
+		return time.Time{}, nil
+	}
+	day, month, err := s.Periods(userID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	//the month is checked first, waiting for the next day doesn't help when it is used up
+	for _, p := range []struct {
+		name string
+		UsagePeriod
+	}{{"monthly", month}, {"daily", day}} {
+		if p.TokenLimit > 0 && p.InputTokens+p.OutputTokens >= p.TokenLimit {
+			return p.ResetsAt, fmt.Errorf("%w: %s token quota", ErrQuotaExceeded, p.name)
+		}
+		if p.CostLimit > 0 && p.Cost >= p.CostLimit {
+			return p.ResetsAt, fmt.Errorf("%w: %s cost quota", ErrQuotaExceeded, p.name)
+		}
+	}
+	return time.Time{}, nil
+}
+
+// Breakdown groups the user's consumption since the time by model, tab_id or purpose, largest first
+func (s *UsageService) Breakdown(userID uint, since time.Time, column string) ([]UsageGroup, error) {
+	switch column {
+	case "model", "tab_id", "purpose":
+	default:
+		return nil, fmt.Errorf("can't group usage by %q", column)
+	}
+	var groups []UsageGroup
+	err := s.DB.Model(&models.UsageRecord{}).
+		Select("CAST("+column+" AS TEXT) AS group_key, COUNT(*) AS requests, SUM(input_tokens) AS input_tokens, "+
+			"SUM(output_tokens) AS output_tokens, SUM(cost) AS cost").
+		//sqlite compares the times as text, they have to be in the zone they were stored in
+		Where("user_id = ? AND created_at >= ?", userID, since.Local()).
+		Group(column).
+		Order("SUM(input_tokens) + SUM(output_tokens) DESC").
+		Scan(&groups).Error
+	return groups, err
+}
+
+func (s *UsageService) totals(userID uint, since time.Time) (UsageTotals, error) {
+	var t UsageTotals
+	err := s.DB.Model(&models.UsageRecord{}).
+		Select("COUNT(*) AS requests, COALESCE(SUM(input_tokens), 0) AS input_tokens, "+
+			"COALESCE(SUM(output_tokens), 0) AS output_tokens, COALESCE(SUM(cost), 0) AS cost").
+		Where("user_id = ? AND created_at >= ?", userID, since.Local()).
+		Scan(&t).Error
+	return t, err
+}
+
+func periodStarts(now time.Time) (day, month time.Time) {
+	now = now.UTC()
+	day = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return day, month
+}
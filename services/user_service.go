@@ -4,11 +4,40 @@ import (
 	"golang.org/x/crypto/bcrypt"
 	"context-aware-ai/models"
 	"gorm.io/gorm"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 )
 
+var (
+	ErrUserNotFound  = errors.New("user not found")
+	ErrUserExists    = errors.New("username already taken")
+	ErrWrongPassword = errors.New("wrong password")
+	//unknown user or wrong password, deliberately not saying which
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	//unknown, expired or already used
+	ErrInviteInvalid = errors.New("invite code invalid")
+)
+
+// UserStats is what an admin sees of a user's storage and activity
+type UserStats struct {
+	Tabs           int64      `json:"tabs"`
+	Memories       int64      `json:"memories"`
+	MemoryBytes    int64      `json:"memory_bytes"`
+	Documents      int64      `json:"documents"`
+	DocumentBytes  int64      `json:"document_bytes"`
+	Sources        int64      `json:"sources"`
+	IngestionJobs  int64      `json:"ingestion_jobs"`
+	ActiveAPIKeys  int64      `json:"active_api_keys"`
+	ActiveSessions int64      `json:"active_sessions"`
+	LastMemoryAt   *time.Time `json:"last_memory_at"`
+	LastAPIKeyUse  *time.Time `json:"last_api_key_use"`
+}
+
 type UserService struct {
-	DB *gorm.DB
+	DB     *gorm.DB
+	Policy PasswordPolicy
 }
 
 func NewUserService(db *gorm.DB) *UserService {
@@ -17,6 +46,47 @@ func NewUserService(db *gorm.DB) *UserService {
 }
 
 func (s *UserService) CreateUser(name, password string) (*models.User, error) {
+	return s.createUser(s.DB, name, password)
+}
+
+// CreateUserWithInvite registers the user and uses up the invite code, neither happens without the other
+func (s *UserService) CreateUserWithInvite(name, password, code string) (*models.User, error) {
+	var user *models.User
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		//conditional so the same code can't register two users at once
+		res := tx.Model(&models.InviteCode{}).
+			Where("hash = ? AND used_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", hashSecret(code), time.Now()).
+			Update("used_at", time.Now())
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrInviteInvalid
+		}
+		var err error
+		if user, err = s.createUser(tx, name, password); err != nil {
+			return err
+		}
+		return tx.Model(&models.InviteCode{}).Where("hash = ?", hashSecret(code)).Update("used_by", user.ID).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *UserService) createUser(tx *gorm.DB, name, password string) (*models.User, error) {
+	if err := s.Policy.Check(name, password); err != nil {
+		return nil, err
+	}
+	var taken int64
+	if err := tx.Model(&models.User{}).Where("user_name = ?", name).Count(&taken).Error; err != nil {
+		return nil, err
+	}
+	if taken > 0 {
+		return nil, ErrUserExists
+	}
+
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return nil, fmt.Errorf("failed to hash password: %v", err)
@@ -27,7 +97,7 @@ func (s *UserService) CreateUser(name, password string) (*models.User, error) {
 		PasswordHash: string(hashedPassword),
 	}
 
-	err = s.DB.Create(&user).Error
+	err = tx.Create(&user).Error
 	if err != nil {
 		return nil, fmt.Errorf("failed to create user: %v", err)
 	}
@@ -53,6 +123,25 @@ func (s *UserService) GetUserByID(userID uint) (*models.User, error) {
 	return &user, nil
 }
 
+//compared against when there is no real hash, so every failed login costs the same bcrypt time
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// Authenticate checks a username and password, failures are ErrInvalidCredentials whatever went wrong
+func (s *UserService) Authenticate(name, password string) (*models.User, error) {
+	user, err := s.GetUserByUserName(name)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if err != nil || user.PasswordHash == "" {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return user, nil
+}
+
 func (s *UserService) CheckPassword(userID uint, password string) (bool, error) {
 	var user models.User
 	err := s.DB.First(&user, userID).Error
@@ -66,3 +155,265 @@ func (s *UserService) CheckPassword(userID uint, password string) (bool, error)
 	}
 	return true, nil
 }
+
+//access tokens issued up to now stop working, see Auth.Required
+func (s *UserService) RevokeTokens(userID uint) error {
+	return s.updateUser(userID, map[string]interface{}{"token_version": gorm.Expr("token_version + 1")})
+}
+
+// ChangePassword checks the old password, stores the new one and ends every access token issued so far.
+// Accounts without a password (single sign-on) set their first one without an old password, the
+// caller has to make sure the login is recent instead.
+func (s *UserService) ChangePassword(userID uint, oldPassword, newPassword string) error {
+	user, err := s.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if user.PasswordHash != "" && bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(oldPassword)) != nil {
+		return ErrWrongPassword
+	}
+	if err := s.Policy.Check(user.UserName, newPassword); err != nil {
+		return err
+	}
+	if oldPassword == newPassword {
+		return fmt.Errorf("%w: must differ from the current password", ErrWeakPassword)
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %v", err)
+	}
+	return s.updateUser(userID, map[string]interface{}{
+		"password_hash":           string(hashedPassword),
+		"password_reset_required": false,
+		"token_version":           gorm.Expr("token_version + 1"),
+	})
+}
+
+// EnsureAdmin creates the bootstrap admin. A user who already has the name is only promoted when
+// the password matches theirs, otherwise anyone could register the name first and become admin.
+func (s *UserService) EnsureAdmin(name, password string) (*models.User, error) {
+	user, err := s.GetUserByUserName(name)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if password == "" {
+			return nil, errors.New("a password is required to create the admin")
+		}
+		user, err = s.CreateUser(name, password)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !user.IsAdmin() {
+		if password == "" || user.PasswordHash == "" ||
+			bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+			return nil, fmt.Errorf("user %q already exists and is not an admin, its password doesn't match the admin password", name)
+		}
+		if err := s.SetRole(user.ID, models.RoleAdmin); err != nil {
+			return nil, err
+		}
+		user.Role = models.RoleAdmin
+	}
+	return user, nil
+}
+
+func (s *UserService) ListUsers() ([]models.User, error) {
+	var users []models.User
+	err := s.DB.Order("id").Find(&users).Error
+	return users, err
+}
+
+func (s *UserService) SetRole(userID uint, role string) error {
+	return s.updateUser(userID, map[string]interface{}{"role": role})
+}
+
+// SetDisabled disables or re-enables the user, disabling also ends the sessions that are open
+func (s *UserService) SetDisabled(userID uint, disabled bool) error {
+	if !disabled {
+		return s.updateUser(userID, map[string]interface{}{"disabled_at": nil})
+	}
+	return s.updateUser(userID, map[string]interface{}{"disabled_at": time.Now(), "token_version": gorm.Expr("token_version + 1")})
+}
+
+// ResetPassword replaces the password with a random one the user has to change after logging in,
+// the temporary password is returned so the admin can pass it on
+func (s *UserService) ResetPassword(userID uint) (string, error) {
+	password, err := randomID()
+	if err != nil {
+		return "", err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %v", err)
+	}
+	err = s.updateUser(userID, map[string]interface{}{
+		"password_hash":           string(hashedPassword),
+		"password_reset_required": true,
+		"token_version":           gorm.Expr("token_version + 1"),
+	})
+	if err != nil {
+		return "", err
+	}
+	return password, nil
+}
+
+// DeleteAccount removes the user and everything they own in one transaction. Only the database is
+// touched, the keyword and vector indexes of the user's tabs have to be dropped afterwards.
+func (s *UserService) DeleteAccount(userID uint) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		jobs := tx.Model(&models.IngestionJob{}).Select("id").Where("user_id = ?", userID)
+		if err := tx.Where("job_id IN (?)", jobs).Delete(&models.IngestionChunk{}).Error; err != nil {
+			return err
+		}
+		for _, model := range []interface{}{
+			&models.IngestionJob{},
+			&models.Memory{},
+			&models.Document{},
+			&models.Tab{},
+			&models.APIKey{},
+			&models.RefreshToken{},
+			&models.ExternalIdentity{},
+			&models.UsageRecord{},
+			&models.UsageQuota{},
+		} {
+			if err := tx.Where("user_id = ?", userID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		res := tx.Delete(&models.User{}, userID)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrUserNotFound
+		}
+		return nil
+	})
+}
+
+// ExternalUser returns the user linked to the provider account. With provision the first login
+// creates one, otherwise it gets ErrUserNotFound. A local user who happens to have the same name
+// is never linked, the new user gets a suffix instead.
+func (s *UserService) ExternalUser(id *OIDCIdentity, provision bool) (*models.User, error) {
+	var link models.ExternalIdentity
+	res := s.DB.Where("issuer = ? AND subject = ?", id.Issuer, id.Subject).Limit(1).Find(&link)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected > 0 {
+		return s.GetUserByID(link.UserID)
+	}
+	if !provision {
+		return nil, ErrUserNotFound
+	}
+
+	var user models.User
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		base := externalUserName(id)
+		name := base
+		for i := 2; ; i++ {
+			var taken int64
+			if err := tx.Model(&models.User{}).Where("user_name = ?", name).Count(&taken).Error; err != nil {
+				return err
+			}
+			if taken == 0 {
+				break
+			}
+			name = fmt.Sprintf("%s-%d", base, i)
+		}
+		//no password hash, so the account can't log in with a password until one is set
+		user = models.User{UserName: name}
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.ExternalIdentity{
+			UserID:  user.ID,
+			Issuer:  id.Issuer,
+			Subject: id.Subject,
+			Email:   id.Email,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func externalUserName(id *OIDCIdentity) string {
+	for _, name := range []string{id.PreferredUsername, id.Email, id.Subject} {
+		if name = strings.TrimSpace(name); name != "" && len(name) <= 200 {
+			return name
+		}
+	}
+	return "user-" + id.Subject[:min(len(id.Subject), 32)]
+}
+
+// CreateInvite makes a single use invite code, returned in the clear only this once
+func (s *UserService) CreateInvite(createdBy uint, expiresAt *time.Time) (string, *models.InviteCode, error) {
+	code, err := randomID()
+	if err != nil {
+		return "", nil, err
+	}
+	invite := models.InviteCode{
+		Prefix:    code[:6],
+		Hash:      hashSecret(code),
+		CreatedBy: createdBy,
+		ExpiresAt: expiresAt,
+	}
+	if err := s.DB.Create(&invite).Error; err != nil {
+		return "", nil, err
+	}
+	return code, &invite, nil
+}
+
+func (s *UserService) ListInvites() ([]models.InviteCode, error) {
+	var invites []models.InviteCode
+	err := s.DB.Order("id").Find(&invites).Error
+	return invites, err
+}
+
+func (s *UserService) Stats(userID uint) (*UserStats, error) {
+	var stats UserStats
+	now := time.Now()
+	queries := []*gorm.DB{
+		s.DB.Model(&models.Tab{}).Where("user_id = ?", userID).Count(&stats.Tabs),
+		s.DB.Model(&models.Memory{}).Where("user_id = ?", userID).Count(&stats.Memories),
+		s.DB.Model(&models.Memory{}).Where("user_id = ?", userID).Select("COALESCE(SUM(LENGTH(text)), 0)").Scan(&stats.MemoryBytes),
+		s.DB.Model(&models.Document{}).Where("user_id = ?", userID).Count(&stats.Documents),
+		s.DB.Model(&models.Document{}).Where("user_id = ?", userID).Select("COALESCE(SUM(LENGTH(content)), 0)").Scan(&stats.DocumentBytes),
+		s.DB.Model(&models.Document{}).Where("user_id = ?", userID).Distinct("source").Count(&stats.Sources),
+		s.DB.Model(&models.IngestionJob{}).Where("user_id = ?", userID).Count(&stats.IngestionJobs),
+		s.DB.Model(&models.APIKey{}).Where("user_id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", userID, now).Count(&stats.ActiveAPIKeys),
+		s.DB.Model(&models.RefreshToken{}).Where("user_id = ? AND used_at IS NULL AND revoked_at IS NULL AND expires_at > ?", userID, now).Count(&stats.ActiveSessions),
+	}
+	for _, q := range queries {
+		if q.Error != nil {
+			return nil, q.Error
+		}
+	}
+
+	var lastMemory models.Memory
+	err := s.DB.Where("user_id = ?", userID).Order("created_at DESC").Limit(1).Find(&lastMemory).Error
+	if err != nil {
+		return nil, err
+	}
+	if lastMemory.ID != 0 {
+		stats.LastMemoryAt = &lastMemory.CreatedAt
+	}
+	var lastKey models.APIKey
+	err = s.DB.Where("user_id = ? AND last_used_at IS NOT NULL", userID).Order("last_used_at DESC").Limit(1).Find(&lastKey).Error
+	if err != nil {
+		return nil, err
+	}
+	stats.LastAPIKeyUse = lastKey.LastUsedAt
+	return &stats, nil
+}
+
+func (s *UserService) updateUser(userID uint, fields map[string]interface{}) error {
+	res := s.DB.Model(&models.User{}).Where("id = ?", userID).Updates(fields)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
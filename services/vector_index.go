@@ -0,0 +1,320 @@
+package services
+
+import (
+	"sort"
+	"sync"
+)
+
+// VectorIndex keeps unit length embeddings in memory, one corpus per (kind, user, tab).
+// Corpora smaller than MinGraphSize are scanned exactly, larger ones are searched
+// through an HNSW graph. Corpora with a quantization mode only keep codes and are
+// scanned over those, Search results for them are approximate.
+type VectorIndex struct {
+	Config       HNSWConfig
+	MinGraphSize int
+
+	mu      sync.Mutex
+	corpora map[corpusKey]*vectorCorpus
+	//which corpus each id lives in, so deletes only need the id
+	owners map[string]map[uint]corpusKey
+	modes  map[corpusKey]QuantizationMode
+}
+
+type vectorCorpus struct {
+	mu    sync.RWMutex
+	vecs  map[uint][]float32
+	graph *hnswGraph
+	quant quantizedSet
+	//set under mu once SetQuantization swapped in a replacement, writers that got hold
+	//of the corpus before then go back for the replacement instead of writing to this one
+	retired bool
+}
+
+func (v *VectorIndex) Add(kind string, userID, tabID, id uint, vec []float32) {
+	if v == nil || len(vec) == 0 {
+		return
+	}
+	key := corpusKey{kind, userID, tabID}
+	if prev, ok := v.owner(kind, id); ok && prev != key {
+		v.Remove(kind, id)
+	}
+	v.mu.Lock()
+	if v.owners == nil {
+		v.owners = map[string]map[uint]corpusKey{}
+	}
+	if v.owners[kind] == nil {
+		v.owners[kind] = map[uint]corpusKey{}
+	}
+	v.owners[kind][id] = key
+	v.mu.Unlock()
+
+	c := v.lockCorpus(key, true)
+	defer c.mu.Unlock()
+	if c.quant != nil {
+		c.quant.add(id, vec)
+		return
+	}
+	c.vecs[id] = vec
+	if c.graph != nil {
+		c.graph.insert(id, vec)
+	} else if len(c.vecs) >= v.minGraphSize() {
+		c.graph = v.buildGraph(c.vecs)
+	}
+}
+
+func (v *VectorIndex) Remove(kind string, ids ...uint) {
+	if v == nil {
+		return
+	}
+	byCorpus := map[corpusKey][]uint{}
+	v.mu.Lock()
+	for _, id := range ids {
+		if key, ok := v.owners[kind][id]; ok {
+			byCorpus[key] = append(byCorpus[key], id)
+			delete(v.owners[kind], id)
+		}
+	}
+	v.mu.Unlock()
+
+	for key, ids := range byCorpus {
+		c := v.lockCorpus(key, false)
+		if c == nil {
+			continue
+		}
+		if c.quant != nil {
+			for _, id := range ids {
+				c.quant.remove(id)
+			}
+			c.mu.Unlock()
+			continue
+		}
+		for _, id := range ids {
+			delete(c.vecs, id)
+			if c.graph != nil {
+				c.graph.remove(id)
+			}
+		}
+		if c.graph != nil {
+			if len(c.vecs) < v.minGraphSize()/2 {
+				c.graph = nil
+			} else if c.graph.stale() {
+				c.graph = v.buildGraph(c.vecs)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (v *VectorIndex) Drop(kind string, userID, tabID uint) {
+	if v == nil {
+		return
+	}
+	key := corpusKey{kind, userID, tabID}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.corpora[key]
+	if !ok {
+		return
+	}
+	delete(v.corpora, key)
+	c.mu.RLock()
+	for _, id := range c.ids() {
+		delete(v.owners[kind], id)
+	}
+	c.mu.RUnlock()
+}
+
+// SetQuantization rebuilds a corpus from vecs in the given mode and swaps it in,
+// searches keep using the old corpus until the new one is ready
+func (v *VectorIndex) SetQuantization(kind string, userID, tabID uint, mode QuantizationMode, vecs map[uint][]float32) {
+	if v == nil {
+		return
+	}
+	key := corpusKey{kind, userID, tabID}
+	c := &vectorCorpus{vecs: map[uint][]float32{}}
+	if mode == QuantizationNone {
+		for id, vec := range vecs {
+			c.vecs[id] = vec
+		}
+		if len(c.vecs) >= v.minGraphSize() {
+			c.graph = v.buildGraph(c.vecs)
+		}
+	} else {
+		c.quant = newQuantizedSet(mode, vecs)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.setMode(key, mode)
+	if old, ok := v.corpora[key]; ok {
+		old.mu.Lock()
+		old.retired = true
+		for _, id := range old.ids() {
+			delete(v.owners[kind], id)
+		}
+		old.mu.Unlock()
+	}
+	if v.corpora == nil {
+		v.corpora = map[corpusKey]*vectorCorpus{}
+	}
+	v.corpora[key] = c
+	if v.owners == nil {
+		v.owners = map[string]map[uint]corpusKey{}
+	}
+	if v.owners[kind] == nil {
+		v.owners[kind] = map[uint]corpusKey{}
+	}
+	for id := range vecs {
+		v.owners[kind][id] = key
+	}
+}
+
+// SetMode only records the mode so vectors added afterwards are quantized, used while loading
+func (v *VectorIndex) SetMode(kind string, userID, tabID uint, mode QuantizationMode) {
+	if v == nil {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.setMode(corpusKey{kind, userID, tabID}, mode)
+}
+
+func (v *VectorIndex) setMode(key corpusKey, mode QuantizationMode) {
+	if mode == QuantizationNone {
+		delete(v.modes, key)
+		return
+	}
+	if v.modes == nil {
+		v.modes = map[corpusKey]QuantizationMode{}
+	}
+	v.modes[key] = mode
+}
+
+// Quantization is the corpus' mode, Search scores are approximate unless it is QuantizationNone
+func (v *VectorIndex) Quantization(kind string, userID, tabID uint) QuantizationMode {
+	if v == nil {
+		return QuantizationNone
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if mode, ok := v.modes[corpusKey{kind, userID, tabID}]; ok {
+		return mode
+	}
+	return QuantizationNone
+}
+
+// Search returns the k most similar ids by cosine, nearest first
+func (v *VectorIndex) Search(kind string, userID, tabID uint, query []float32, k int) []VectorHit {
+	if v == nil {
+		return nil
+	}
+	c := v.corpus(corpusKey{kind, userID, tabID}, false)
+	if c == nil {
+		return nil
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.quant != nil {
+		return c.quant.search(query, k)
+	}
+	if c.graph != nil {
+		return c.graph.search(query, k, v.Config.withDefaults().EfSearch)
+	}
+	return bruteForce(c.vecs, query, k)
+}
+
+// lockCorpus returns the key's current corpus write locked, never one that was swapped out while
+// waiting for the lock
+func (v *VectorIndex) lockCorpus(key corpusKey, create bool) *vectorCorpus {
+	for {
+		c := v.corpus(key, create)
+		if c == nil {
+			return nil
+		}
+		c.mu.Lock()
+		if !c.retired {
+			return c
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (v *VectorIndex) corpus(key corpusKey, create bool) *vectorCorpus {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.corpora[key]
+	if !ok && create {
+		if v.corpora == nil {
+			v.corpora = map[corpusKey]*vectorCorpus{}
+		}
+		c = &vectorCorpus{vecs: map[uint][]float32{}}
+		if mode, ok := v.modes[key]; ok {
+			c.quant = newQuantizedSet(mode, nil)
+		}
+		v.corpora[key] = c
+	}
+	return c
+}
+
+//callers hold c.mu
+func (c *vectorCorpus) ids() []uint {
+	if c.quant != nil {
+		return c.quant.ids()
+	}
+	ids := make([]uint, 0, len(c.vecs))
+	for id := range c.vecs {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (v *VectorIndex) owner(kind string, id uint) (corpusKey, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	key, ok := v.owners[kind][id]
+	return key, ok
+}
+
+func (v *VectorIndex) buildGraph(vecs map[uint][]float32) *hnswGraph {
+	//insert in id order so rebuilds are deterministic
+	ids := make([]uint, 0, len(vecs))
+	for id := range vecs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	g := newHNSWGraph(v.Config)
+	for _, id := range ids {
+		g.insert(id, vecs[id])
+	}
+	return g
+}
+
+func (v *VectorIndex) minGraphSize() int {
+	if v.MinGraphSize <= 0 {
+		return 1000
+	}
+	return v.MinGraphSize
+}
+
+// bruteForce is the exact scan used for small corpora and as the recall baseline
+func bruteForce(vecs map[uint][]float32, q []float32, k int) []VectorHit {
+	hits := make([]VectorHit, 0, len(vecs))
+	for id, vec := range vecs {
+		hits = append(hits, VectorHit{ID: id, Score: dot32(q, vec)})
+	}
+	sortHits(hits)
+	if len(hits) > k {
+		hits = hits[:k]
+	}
+	return hits
+}
+
+//best score first, ties broken by newest id
+func sortHits(hits []VectorHit) {
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score == hits[j].Score {
+			return hits[i].ID > hits[j].ID
+		}
+		return hits[i].Score > hits[j].Score
+	})
+}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+//embeddings cluster by topic, so the corpora are drawn around a few random centres
+func randomCorpus(n, dim int, seed int64) map[uint][]float32 {
+	rng := rand.New(rand.NewSource(seed))
+	centres := make([][]float64, 32)
+	for i := range centres {
+		centres[i] = make([]float64, dim)
+		for j := range centres[i] {
+			centres[i][j] = rng.NormFloat64()
+		}
+	}
+	vecs := make(map[uint][]float32, n)
+	for id := 1; id <= n; id++ {
+		vecs[uint(id)] = randomNear(rng, centres[rng.Intn(len(centres))], 0.5)
+	}
+	return vecs
+}
+
+func randomNear(rng *rand.Rand, centre []float64, spread float64) []float32 {
+	vec := make([]float64, len(centre))
+	for i, c := range centre {
+		vec[i] = c + spread*rng.NormFloat64()
+	}
+	return normalize32(vec)
+}
+
+func randomQueries(vecs map[uint][]float32, n int, seed int64) [][]float32 {
+	rng := rand.New(rand.NewSource(seed))
+	queries := make([][]float32, n)
+	for i := range queries {
+		//a neighbour of a stored vector, not the vector itself
+		base := vecs[uint(rng.Intn(len(vecs))+1)]
+		centre := make([]float64, len(base))
+		for j, x := range base {
+			centre[j] = float64(x)
+		}
+		queries[i] = randomNear(rng, centre, 0.5/math.Sqrt(float64(len(base))))
+	}
+	return queries
+}
+
+//ids go in in order so the graph, and with it the recall, is the same on every run
+func newGraphIndex(vecs map[uint][]float32, cfg HNSWConfig) *VectorIndex {
+	v := &VectorIndex{Config: cfg, MinGraphSize: 1}
+	for id := uint(1); id <= uint(len(vecs)); id++ {
+		v.Add(KindDocuments, 1, 1, id, vecs[id])
+	}
+	return v
+}
+
+func TestHNSWRecall(t *testing.T) {
+	const k = 10
+	vecs := randomCorpus(3000, 64, 1)
+	queries := randomQueries(vecs, 200, 2)
+	exact := make([]map[uint]bool, len(queries))
+	for i, q := range queries {
+		exact[i] = map[uint]bool{}
+		for _, h := range bruteForce(vecs, q, k) {
+			exact[i][h.ID] = true
+		}
+	}
+
+	for _, tc := range []struct {
+		efSearch  int
+		minRecall float64
+	}{
+		{0, 0.9},
+		{256, 0.98},
+	} {
+		v := newGraphIndex(vecs, HNSWConfig{EfSearch: tc.efSearch})
+		if v.corpus(corpusKey{KindDocuments, 1, 1}, false).graph == nil {
+			t.Fatal("corpus is scanned, not searched through the graph")
+		}
+		found := 0
+		for i, q := range queries {
+			for _, h := range v.Search(KindDocuments, 1, 1, q, k) {
+				if exact[i][h.ID] {
+					found++
+				}
+			}
+		}
+		recall := float64(found) / float64(len(queries)*k)
+		t.Logf("ef_search %d: recall@%d %.3f", v.Config.withDefaults().EfSearch, k, recall)
+		if recall < tc.minRecall {
+			t.Errorf("ef_search %d: recall@%d is %.3f, want at least %.2f", v.Config.withDefaults().EfSearch, k, recall, tc.minRecall)
+		}
+	}
+}
+
+func benchmarkCorpus(b *testing.B) (map[uint][]float32, [][]float32) {
+	b.Helper()
+	vecs := randomCorpus(10000, 384, 1)
+	return vecs, randomQueries(vecs, 256, 2)
+}
+
+func BenchmarkHNSW(b *testing.B) {
+	vecs, queries := benchmarkCorpus(b)
+	v := newGraphIndex(vecs, HNSWConfig{})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		v.Search(KindDocuments, 1, 1, queries[i%len(queries)], 10)
+	}
+}
+
+func BenchmarkScan(b *testing.B) {
+	vecs, queries := benchmarkCorpus(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bruteForce(vecs, queries[i%len(queries)], 10)
+	}
+}
@@ -0,0 +1,121 @@
+package services
+
+import (
+	"context-aware-ai/models"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// VectorRecord is one embedding plus what a store needs to filter on.
+// ID is the primary key of the matching documents/memories row, Vector has unit length.
+// Metadata holds the user's metadata plus source and symbol for documents.
+type VectorRecord struct {
+	ID        uint
+	UserID    uint
+	TabID     uint
+	Vector    []float32
+	Tags      []string
+	Metadata  map[string]string
+	CreatedAt time.Time
+}
+
+// VectorFilter restricts a search or delete to a user's tabs, every condition must hold
+type VectorFilter struct {
+	UserID     uint
+	TabIDs     []uint
+	Conditions []FilterCondition
+}
+
+// VectorStore holds the embeddings for a collection (KindDocuments or KindMemories).
+// The text itself always stays in the sqlite rows, stores only return ids and scores.
+// Vectors and queries are normalized by the caller (NormalizeEmbedding).
+type VectorStore interface {
+	Upsert(collection string, records []VectorRecord) error
+	Delete(collection string, ids []uint) error
+	DeleteWhere(collection string, filter VectorFilter) error
+	//nearest first, Score is cosine similarity
+	Search(collection string, query []float32, k int, filter VectorFilter) ([]VectorHit, error)
+}
+
+// QuantizingStore is implemented by stores that can keep a tab's vectors quantized in memory
+type QuantizingStore interface {
+	SetQuantization(collection string, userID, tabID uint, mode QuantizationMode) error
+}
+
+func documentRecord(d models.Document) (VectorRecord, error) {
+	vec, err := decodeEmbedding(d.Embedding)
+	if err != nil {
+		return VectorRecord{}, err
+	}
+	meta := map[string]string{}
+	for k, v := range d.Metadata {
+		meta[k] = v
+	}
+	meta[FilterSource] = d.Source
+	if d.Symbol != "" {
+		meta[FilterSymbol] = d.Symbol
+	}
+	return VectorRecord{
+		ID:        d.ID,
+		UserID:    d.UserID,
+		TabID:     d.TabID,
+		Vector:    vec,
+		Tags:      d.Tags,
+		Metadata:  meta,
+		CreatedAt: d.CreatedAt,
+	}, nil
+}
+
+func memoryRecord(m models.Memory) (VectorRecord, error) {
+	vec, err := decodeEmbedding(m.Embedding)
+	if err != nil {
+		return VectorRecord{}, err
+	}
+	return VectorRecord{
+		ID:        m.ID,
+		UserID:    m.UserID,
+		TabID:     m.TabID,
+		Vector:    vec,
+		Tags:      m.Tags,
+		Metadata:  m.Metadata,
+		CreatedAt: m.CreatedAt,
+	}, nil
+}
+
+// BackfillVectorStore copies every searchable row from sqlite into the store,
+// used once after switching VECTOR_STORE to an external backend
+func BackfillVectorStore(db *gorm.DB, store VectorStore) (int, error) {
+	total := 0
+	var docs []models.Document
+	err := db.Where("pending = ?", false).FindInBatches(&docs, 500, func(tx *gorm.DB, batch int) error {
+		records := make([]VectorRecord, 0, len(docs))
+		for _, d := range docs {
+			r, err := documentRecord(d)
+			if err != nil {
+				continue
+			}
+			records = append(records, r)
+		}
+		total += len(records)
+		return store.Upsert(KindDocuments, records)
+	}).Error
+	if err != nil {
+		return total, err
+	}
+
+	var mems []models.Memory
+	err = db.FindInBatches(&mems, 500, func(tx *gorm.DB, batch int) error {
+		records := make([]VectorRecord, 0, len(mems))
+		for _, m := range mems {
+			r, err := memoryRecord(m)
+			if err != nil {
+				continue
+			}
+			records = append(records, r)
+		}
+		total += len(records)
+		return store.Upsert(KindMemories, records)
+	}).Error
+	return total, err
+}
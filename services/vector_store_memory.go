@@ -0,0 +1,79 @@
+package services
+
+import "sync"
+
+// MemoryVectorStore keeps everything in a map and scans it exactly. Nothing is persisted,
+// it exists for local development and as a stand-in for the real backends.
+type MemoryVectorStore struct {
+	mu      sync.RWMutex
+	records map[string]map[uint]memoryVectorEntry
+}
+
+type memoryVectorEntry struct {
+	record VectorRecord
+	vec    []float32
+}
+
+func (m *MemoryVectorStore) Upsert(collection string, records []VectorRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.records == nil {
+		m.records = map[string]map[uint]memoryVectorEntry{}
+	}
+	if m.records[collection] == nil {
+		m.records[collection] = map[uint]memoryVectorEntry{}
+	}
+	for _, r := range records {
+		m.records[collection][r.ID] = memoryVectorEntry{record: r, vec: r.Vector}
+	}
+	return nil
+}
+
+func (m *MemoryVectorStore) Delete(collection string, ids []uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, id := range ids {
+		delete(m.records[collection], id)
+	}
+	return nil
+}
+
+func (m *MemoryVectorStore) DeleteWhere(collection string, filter VectorFilter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, e := range m.records[collection] {
+		if matchesFilter(e.record, filter) {
+			delete(m.records[collection], id)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryVectorStore) Search(collection string, query []float32, k int, filter VectorFilter) ([]VectorHit, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	vecs := map[uint][]float32{}
+	for id, e := range m.records[collection] {
+		if matchesFilter(e.record, filter) {
+			vecs[id] = e.vec
+		}
+	}
+	return bruteForce(vecs, query, k), nil
+}
+
+func matchesFilter(r VectorRecord, filter VectorFilter) bool {
+	if r.UserID != filter.UserID {
+		return false
+	}
+	inTab := false
+	for _, tabID := range filter.TabIDs {
+		if r.TabID == tabID {
+			inTab = true
+			break
+		}
+	}
+	if !inTab {
+		return false
+	}
+	return matchesConditions(r, filter.Conditions)
+}
@@ -0,0 +1,190 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// PgVectorStore keeps embeddings in Postgres with the pgvector extension, one table per
+// collection with an HNSW cosine index. Tables are created on the first upsert once the
+// embedding dimension is known.
+type PgVectorStore struct {
+	DB *gorm.DB
+
+	mu     sync.Mutex
+	tables map[string]bool
+}
+
+func NewPgVectorStore(dsn string) (*PgVectorStore, error) {
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Exec("CREATE EXTENSION IF NOT EXISTS vector").Error; err != nil {
+		return nil, fmt.Errorf("enabling pgvector: %v", err)
+	}
+	return &PgVectorStore{DB: db}, nil
+}
+
+func (p *PgVectorStore) Upsert(collection string, records []VectorRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	if err := p.ensureTable(collection, len(records[0].Vector)); err != nil {
+		return err
+	}
+	return p.DB.Transaction(func(tx *gorm.DB) error {
+		for _, r := range records {
+			meta, err := json.Marshal(r.Metadata)
+			if err != nil {
+				return err
+			}
+			tags, err := json.Marshal(r.Tags)
+			if err != nil {
+				return err
+			}
+			err = tx.Exec(
+				"INSERT INTO "+pgTable(collection)+" (id, user_id, tab_id, metadata, tags, created_at, embedding) "+
+					"VALUES (?, ?, ?, ?::jsonb, ?::jsonb, ?, ?::vector) "+
+					"ON CONFLICT (id) DO UPDATE SET user_id = EXCLUDED.user_id, tab_id = EXCLUDED.tab_id, "+
+					"metadata = EXCLUDED.metadata, tags = EXCLUDED.tags, created_at = EXCLUDED.created_at, embedding = EXCLUDED.embedding",
+				r.ID, r.UserID, r.TabID, string(meta), string(tags), r.CreatedAt, pgVector(r.Vector),
+			).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (p *PgVectorStore) Delete(collection string, ids []uint) error {
+	if len(ids) == 0 || !p.hasTable(collection) {
+		return nil
+	}
+	return p.DB.Exec("DELETE FROM "+pgTable(collection)+" WHERE id IN ?", ids).Error
+}
+
+func (p *PgVectorStore) DeleteWhere(collection string, filter VectorFilter) error {
+	if !p.hasTable(collection) {
+		return nil
+	}
+	where, args := pgWhere(filter)
+	return p.DB.Exec("DELETE FROM "+pgTable(collection)+" WHERE "+where, args...).Error
+}
+
+func (p *PgVectorStore) Search(collection string, query []float32, k int, filter VectorFilter) ([]VectorHit, error) {
+	if !p.hasTable(collection) {
+		return nil, nil
+	}
+	where, args := pgWhere(filter)
+	vec := pgVector(query)
+	//<=> is cosine distance, ordering by the operator lets postgres use the hnsw index
+	sql := "SELECT id, 1 - (embedding <=> ?::vector) AS score FROM " + pgTable(collection) +
+		" WHERE " + where + " ORDER BY embedding <=> ?::vector LIMIT ?"
+	args = append([]interface{}{vec}, args...)
+	args = append(args, vec, k)
+
+	var hits []VectorHit
+	if err := p.DB.Raw(sql, args...).Scan(&hits).Error; err != nil {
+		return nil, err
+	}
+	return hits, nil
+}
+
+func (p *PgVectorStore) ensureTable(collection string, dim int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tables[collection] {
+		return nil
+	}
+	table := pgTable(collection)
+	stmts := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			id BIGINT PRIMARY KEY,
+			user_id BIGINT NOT NULL,
+			tab_id BIGINT NOT NULL,
+			metadata JSONB NOT NULL DEFAULT '{}',
+			embedding VECTOR(%d) NOT NULL
+		)`, table, dim),
+		//tables created before filter expressions existed
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS tags JSONB NOT NULL DEFAULT '[]'", table),
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ", table),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_owner_idx ON %s (user_id, tab_id)", table, table),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_embedding_idx ON %s USING hnsw (embedding vector_cosine_ops)", table, table),
+	}
+	for _, stmt := range stmts {
+		if err := p.DB.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	if p.tables == nil {
+		p.tables = map[string]bool{}
+	}
+	p.tables[collection] = true
+	return nil
+}
+
+func (p *PgVectorStore) hasTable(collection string) bool {
+	p.mu.Lock()
+	known := p.tables[collection]
+	p.mu.Unlock()
+	if known {
+		return true
+	}
+	return p.DB.Migrator().HasTable(pgTable(collection))
+}
+
+//collections are the fixed Kind constants, never user input, so they are safe to splice in
+func pgTable(collection string) string {
+	return "vectors_" + collection
+}
+
+func pgWhere(filter VectorFilter) (string, []interface{}) {
+	where := "user_id = ? AND tab_id IN ?"
+	args := []interface{}{filter.UserID, filter.TabIDs}
+	for _, c := range filter.Conditions {
+		switch c.Field {
+		case FilterCreatedAfter:
+			where += " AND created_at >= ?"
+			args = append(args, c.Time)
+		case FilterCreatedBefore:
+			where += " AND created_at < ?"
+			args = append(args, c.Time)
+		case FilterTag:
+			hasTag := "EXISTS (SELECT 1 FROM jsonb_array_elements_text(tags) t WHERE t IN ?)"
+			if negated(c.Op) {
+				hasTag = "NOT " + hasTag
+			}
+			where += " AND " + hasTag
+			args = append(args, c.Values)
+		default:
+			//->> with a bound key, null when the key is missing
+			field := "metadata->>?"
+			if negated(c.Op) {
+				where += " AND (" + field + " IS NULL OR " + field + " NOT IN ?)"
+				args = append(args, c.Field, c.Field, c.Values)
+			} else {
+				where += " AND " + field + " IN ?"
+				args = append(args, c.Field, c.Values)
+			}
+		}
+	}
+	return where, args
+}
+
+//pgvector's text format, e.g. [0.1,0.2,0.3]
+func pgVector(vec []float32) string {
+	parts := make([]string, len(vec))
+	for i, v := range vec {
+		parts[i] = strconv.FormatFloat(float64(v), 'f', -1, 32)
+	}
+	return "[" + strings.Join(parts, ",") + "]"
+}
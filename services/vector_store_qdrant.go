@@ -0,0 +1,206 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// QdrantStore talks to Qdrant's REST api, one collection per kind with cosine distance.
+// Point ids are the sqlite row ids and user, tab and metadata go in the payload.
+type QdrantStore struct {
+	BaseURL string
+	APIKey  string
+	//prepended to the collection name so several deployments can share one qdrant
+	Prefix string
+	//defaults to a client with a 10s timeout, a hung qdrant would otherwise hold up chat and ingestion
+	HTTP *http.Client
+
+	mu          sync.Mutex
+	collections map[string]bool
+}
+
+type qdrantHit struct {
+	ID    uint    `json:"id"`
+	Score float64 `json:"score"`
+}
+
+func (q *QdrantStore) Upsert(collection string, records []VectorRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	if err := q.ensureCollection(collection, len(records[0].Vector)); err != nil {
+		return err
+	}
+	points := make([]map[string]interface{}, len(records))
+	for i, r := range records {
+		points[i] = map[string]interface{}{
+			"id":     r.ID,
+			"vector": r.Vector,
+			"payload": map[string]interface{}{
+				"user_id":    r.UserID,
+				"tab_id":     r.TabID,
+				"metadata":   r.Metadata,
+				"tags":       r.Tags,
+				"created_at": r.CreatedAt.Unix(),
+			},
+		}
+	}
+	return q.do("PUT", "/collections/"+q.name(collection)+"/points?wait=true", map[string]interface{}{"points": points}, nil)
+}
+
+func (q *QdrantStore) Delete(collection string, ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return q.deletePoints(collection, map[string]interface{}{"points": ids})
+}
+
+func (q *QdrantStore) DeleteWhere(collection string, filter VectorFilter) error {
+	return q.deletePoints(collection, map[string]interface{}{"filter": qdrantFilter(filter)})
+}
+
+func (q *QdrantStore) Search(collection string, query []float32, k int, filter VectorFilter) ([]VectorHit, error) {
+	var r struct {
+		Result []qdrantHit `json:"result"`
+	}
+	err := q.do("POST", "/collections/"+q.name(collection)+"/points/search", map[string]interface{}{
+		"vector": query,
+		"limit":  k,
+		"filter": qdrantFilter(filter),
+	}, &r)
+	if err == errQdrantNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	hits := make([]VectorHit, len(r.Result))
+	for i, h := range r.Result {
+		hits[i] = VectorHit{ID: h.ID, Score: h.Score}
+	}
+	return hits, nil
+}
+
+func (q *QdrantStore) deletePoints(collection string, body map[string]interface{}) error {
+	err := q.do("POST", "/collections/"+q.name(collection)+"/points/delete?wait=true", body, nil)
+	//nothing was ever stored in a collection that doesn't exist yet
+	if err == errQdrantNotFound {
+		return nil
+	}
+	return err
+}
+
+func (q *QdrantStore) ensureCollection(collection string, dim int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.collections[collection] {
+		return nil
+	}
+	name := q.name(collection)
+	err := q.do("GET", "/collections/"+name, nil, nil)
+	if err == errQdrantNotFound {
+		err = q.do("PUT", "/collections/"+name, map[string]interface{}{
+			"vectors": map[string]interface{}{"size": dim, "distance": "Cosine"},
+		}, nil)
+		if err == nil {
+			err = q.do("PUT", "/collections/"+name+"/index", map[string]interface{}{
+				"field_name": "user_id", "field_schema": "integer",
+			}, nil)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if q.collections == nil {
+		q.collections = map[string]bool{}
+	}
+	q.collections[collection] = true
+	return nil
+}
+
+func (q *QdrantStore) name(collection string) string {
+	return q.Prefix + collection
+}
+
+var errQdrantNotFound = fmt.Errorf("qdrant collection not found")
+
+//the largest response read, search results for any sensible k are far smaller
+const qdrantMaxResponse = 8 << 20
+
+func (q *QdrantStore) do(method, path string, body interface{}, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, q.BaseURL+path, bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if q.APIKey != "" {
+		req.Header.Set("api-key", q.APIKey)
+	}
+	client := q.HTTP
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, qdrantMaxResponse))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return errQdrantNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("qdrant %s %s returned %s: %s", method, path, resp.Status, respBody)
+	}
+	if out != nil {
+		return json.Unmarshal(respBody, out)
+	}
+	return nil
+}
+
+func qdrantFilter(filter VectorFilter) map[string]interface{} {
+	must := []map[string]interface{}{
+		{"key": "user_id", "match": map[string]interface{}{"value": filter.UserID}},
+		{"key": "tab_id", "match": map[string]interface{}{"any": filter.TabIDs}},
+	}
+	var mustNot []map[string]interface{}
+	for _, c := range filter.Conditions {
+		key := "metadata." + c.Field
+		switch c.Field {
+		case FilterCreatedAfter:
+			must = append(must, map[string]interface{}{"key": "created_at", "range": map[string]interface{}{"gte": c.Time.Unix()}})
+			continue
+		case FilterCreatedBefore:
+			must = append(must, map[string]interface{}{"key": "created_at", "range": map[string]interface{}{"lt": c.Time.Unix()}})
+			continue
+		case FilterTag:
+			key = "tags"
+		}
+		cond := map[string]interface{}{"key": key, "match": map[string]interface{}{"any": c.Values}}
+		if negated(c.Op) {
+			mustNot = append(mustNot, cond)
+		} else {
+			must = append(must, cond)
+		}
+	}
+	out := map[string]interface{}{"must": must}
+	if len(mustNot) > 0 {
+		out["must_not"] = mustNot
+	}
+	return out
+}
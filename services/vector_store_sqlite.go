@@ -0,0 +1,252 @@
+package services
+
+import (
+	"context-aware-ai/models"
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SQLiteVectorStore is the default store. The embeddings already live in the documents and
+// memories rows, so it only keeps the in-memory index in sync with them and falls back to
+// scanning the matching rows when a search has filter conditions.
+type SQLiteVectorStore struct {
+	DB    *gorm.DB
+	Index *VectorIndex
+	//quantized tabs fetch k*factor candidates and re-score them exactly, defaults to 4 for int8
+	//and 20 for pq whose codes are much coarser
+	RescoreFactor   int
+	PQRescoreFactor int
+}
+
+// Load builds the index from every searchable row, pending documents are added once their job completes
+func (s *SQLiteVectorStore) Load() error {
+	start := time.Now()
+	count := 0
+
+	var tabs []models.Tab
+	if err := s.DB.Where("quantization IN ?", []QuantizationMode{QuantizationInt8, QuantizationPQ}).Find(&tabs).Error; err != nil {
+		return err
+	}
+	//pq tabs are collected first so their codebooks are trained on the whole tab
+	pqVecs := map[corpusKey]map[uint][]float32{}
+	for _, t := range tabs {
+		mode := QuantizationMode(t.Quantization)
+		if mode == QuantizationPQ {
+			pqVecs[corpusKey{KindDocuments, t.UserID, t.ID}] = map[uint][]float32{}
+		} else {
+			s.Index.SetMode(KindDocuments, t.UserID, t.ID, mode)
+		}
+	}
+
+	var docs []models.Document
+	err := s.DB.Select("id, user_id, tab_id, embedding").
+		Where("pending = ?", false).
+		FindInBatches(&docs, 1000, func(tx *gorm.DB, batch int) error {
+			for _, d := range docs {
+				vec, err := decodeEmbedding(d.Embedding)
+				if err != nil {
+					log.Printf("skipping document %d in vector index: %v", d.ID, err)
+					continue
+				}
+				if vecs, ok := pqVecs[corpusKey{KindDocuments, d.UserID, d.TabID}]; ok {
+					vecs[d.ID] = vec
+					continue
+				}
+				s.Index.Add(KindDocuments, d.UserID, d.TabID, d.ID, vec)
+			}
+			count += len(docs)
+			return nil
+		}).Error
+	if err != nil {
+		return err
+	}
+	for key, vecs := range pqVecs {
+		s.Index.SetQuantization(key.kind, key.userID, key.tabID, QuantizationPQ, vecs)
+	}
+
+	var mems []models.Memory
+	err = s.DB.Select("id, user_id, tab_id, embedding").
+		FindInBatches(&mems, 1000, func(tx *gorm.DB, batch int) error {
+			for _, m := range mems {
+				vec, err := decodeEmbedding(m.Embedding)
+				if err != nil {
+					log.Printf("skipping memory %d in vector index: %v", m.ID, err)
+					continue
+				}
+				s.Index.Add(KindMemories, m.UserID, m.TabID, m.ID, vec)
+			}
+			count += len(mems)
+			return nil
+		}).Error
+	if err != nil {
+		return err
+	}
+
+	log.Printf("vector index loaded %d embeddings in %s", count, time.Since(start))
+	return nil
+}
+
+// SetQuantization reloads the tab's vectors from sqlite and rebuilds its corpus in the new mode
+func (s *SQLiteVectorStore) SetQuantization(collection string, userID, tabID uint, mode QuantizationMode) error {
+	q, err := s.filteredRows(collection, VectorFilter{UserID: userID, TabIDs: []uint{tabID}})
+	if err != nil {
+		return err
+	}
+	type row struct {
+		ID        uint
+		Embedding []byte
+	}
+	var rows []row
+	if err := q.Select("id, embedding").Scan(&rows).Error; err != nil {
+		return err
+	}
+	vecs := make(map[uint][]float32, len(rows))
+	for _, r := range rows {
+		vec, err := decodeEmbedding(r.Embedding)
+		if err != nil {
+			continue
+		}
+		vecs[r.ID] = vec
+	}
+	s.Index.SetQuantization(collection, userID, tabID, mode, vecs)
+	return nil
+}
+
+func (s *SQLiteVectorStore) Upsert(collection string, records []VectorRecord) error {
+	for _, r := range records {
+		s.Index.Add(collection, r.UserID, r.TabID, r.ID, r.Vector)
+	}
+	return nil
+}
+
+func (s *SQLiteVectorStore) Delete(collection string, ids []uint) error {
+	s.Index.Remove(collection, ids...)
+	return nil
+}
+
+func (s *SQLiteVectorStore) DeleteWhere(collection string, filter VectorFilter) error {
+	if len(filter.Conditions) == 0 {
+		for _, tabID := range filter.TabIDs {
+			s.Index.Drop(collection, filter.UserID, tabID)
+		}
+		return nil
+	}
+	var ids []uint
+	q, err := s.filteredRows(collection, filter)
+	if err != nil {
+		return err
+	}
+	if err := q.Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	return s.Delete(collection, ids)
+}
+
+func (s *SQLiteVectorStore) Search(collection string, query []float32, k int, filter VectorFilter) ([]VectorHit, error) {
+	if len(filter.Conditions) > 0 {
+		return s.scan(collection, query, k, filter)
+	}
+	var hits []VectorHit
+	for _, tabID := range filter.TabIDs {
+		mode := s.Index.Quantization(collection, filter.UserID, tabID)
+		if mode == QuantizationNone {
+			hits = append(hits, s.Index.Search(collection, filter.UserID, tabID, query, k)...)
+			continue
+		}
+		cands := s.Index.Search(collection, filter.UserID, tabID, query, k*s.rescoreFactor(mode))
+		exact, err := s.rescore(collection, cands, query)
+		if err != nil {
+			return nil, err
+		}
+		hits = append(hits, exact...)
+	}
+	sortHits(hits)
+	if len(hits) > k {
+		hits = hits[:k]
+	}
+	return hits, nil
+}
+
+//filter conditions are pushed into the WHERE clause and the matching rows scored exactly
+func (s *SQLiteVectorStore) scan(collection string, query []float32, k int, filter VectorFilter) ([]VectorHit, error) {
+	q, err := s.filteredRows(collection, filter)
+	if err != nil {
+		return nil, err
+	}
+	type row struct {
+		ID        uint
+		Embedding []byte
+	}
+	var rows []row
+	if err := q.Select("id, embedding").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	vecs := make(map[uint][]float32, len(rows))
+	for _, r := range rows {
+		vec, err := decodeEmbedding(r.Embedding)
+		if err != nil {
+			continue
+		}
+		vecs[r.ID] = vec
+	}
+	return bruteForce(vecs, query, k), nil
+}
+
+//replaces approximate scores with exact ones from the stored vectors
+func (s *SQLiteVectorStore) rescore(collection string, cands []VectorHit, query []float32) ([]VectorHit, error) {
+	if len(cands) == 0 {
+		return nil, nil
+	}
+	ids := make([]uint, len(cands))
+	for i, c := range cands {
+		ids[i] = c.ID
+	}
+	type row struct {
+		ID        uint
+		Embedding []byte
+	}
+	var rows []row
+	if err := s.DB.Table(collection).Select("id, embedding").Where("id IN ?", ids).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	hits := make([]VectorHit, 0, len(rows))
+	for _, r := range rows {
+		vec, err := decodeEmbedding(r.Embedding)
+		if err != nil {
+			continue
+		}
+		hits = append(hits, VectorHit{ID: r.ID, Score: dot32(query, vec)})
+	}
+	return hits, nil
+}
+
+func (s *SQLiteVectorStore) rescoreFactor(mode QuantizationMode) int {
+	if mode == QuantizationPQ {
+		if s.PQRescoreFactor <= 0 {
+			return 20
+		}
+		return s.PQRescoreFactor
+	}
+	if s.RescoreFactor <= 0 {
+		return 4
+	}
+	return s.RescoreFactor
+}
+
+func (s *SQLiteVectorStore) filteredRows(collection string, filter VectorFilter) (*gorm.DB, error) {
+	var q *gorm.DB
+	switch collection {
+	case KindDocuments:
+		q = s.DB.Model(&models.Document{}).Where("pending = ?", false)
+	case KindMemories:
+		q = s.DB.Model(&models.Memory{})
+	default:
+		return nil, fmt.Errorf("unknown collection %q", collection)
+	}
+	q = q.Where("user_id = ? AND tab_id IN ?", filter.UserID, filter.TabIDs)
+	return applyFilter(q, filterFor(collection, filter.Conditions)), nil
+}
@@ -0,0 +1,238 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var filterTime = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+func TestPgWhere(t *testing.T) {
+	base := "user_id = ? AND tab_id IN ?"
+	tabs := []uint{1, 2}
+	for _, tc := range []struct {
+		name  string
+		conds []FilterCondition
+		where string
+		args  []interface{}
+	}{
+		{
+			name:  "no conditions",
+			where: base,
+			args:  []interface{}{uint(7), tabs},
+		},
+		{
+			name:  "created range",
+			conds: []FilterCondition{{Field: FilterCreatedAfter, Time: filterTime}, {Field: FilterCreatedBefore, Time: filterTime}},
+			where: base + " AND created_at >= ? AND created_at < ?",
+			args:  []interface{}{uint(7), tabs, filterTime, filterTime},
+		},
+		{
+			name:  "tag in",
+			conds: []FilterCondition{{Field: FilterTag, Op: FilterIn, Values: []string{"hr", "legal"}}},
+			where: base + " AND EXISTS (SELECT 1 FROM jsonb_array_elements_text(tags) t WHERE t IN ?)",
+			args:  []interface{}{uint(7), tabs, []string{"hr", "legal"}},
+		},
+		{
+			name:  "tag not in",
+			conds: []FilterCondition{{Field: FilterTag, Op: FilterNotIn, Values: []string{"hr"}}},
+			where: base + " AND NOT EXISTS (SELECT 1 FROM jsonb_array_elements_text(tags) t WHERE t IN ?)",
+			args:  []interface{}{uint(7), tabs, []string{"hr"}},
+		},
+		{
+			name:  "metadata equals",
+			conds: []FilterCondition{{Field: "team", Op: FilterEq, Values: []string{"infra"}}},
+			where: base + " AND metadata->>? IN ?",
+			args:  []interface{}{uint(7), tabs, "team", []string{"infra"}},
+		},
+		{
+			name:  "metadata not equal also matches a missing key",
+			conds: []FilterCondition{{Field: FilterSource, Op: FilterNe, Values: []string{"a.go"}}},
+			where: base + " AND (metadata->>? IS NULL OR metadata->>? NOT IN ?)",
+			args:  []interface{}{uint(7), tabs, FilterSource, FilterSource, []string{"a.go"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			where, args := pgWhere(VectorFilter{UserID: 7, TabIDs: tabs, Conditions: tc.conds})
+			if where != tc.where {
+				t.Errorf("where:\ngot  %s\nwant %s", where, tc.where)
+			}
+			if !reflect.DeepEqual(args, tc.args) {
+				t.Errorf("args: got %#v, want %#v", args, tc.args)
+			}
+		})
+	}
+}
+
+func TestQdrantFilter(t *testing.T) {
+	owner := `{"key":"user_id","match":{"value":7}},{"key":"tab_id","match":{"any":[1,2]}}`
+	for _, tc := range []struct {
+		name  string
+		conds []FilterCondition
+		want  string
+	}{
+		{
+			name: "no conditions",
+			want: `{"must":[` + owner + `]}`,
+		},
+		{
+			name:  "created range",
+			conds: []FilterCondition{{Field: FilterCreatedAfter, Time: filterTime}, {Field: FilterCreatedBefore, Time: filterTime}},
+			want: `{"must":[` + owner + `,{"key":"created_at","range":{"gte":1709251200}},` +
+				`{"key":"created_at","range":{"lt":1709251200}}]}`,
+		},
+		{
+			name:  "tag in",
+			conds: []FilterCondition{{Field: FilterTag, Op: FilterIn, Values: []string{"hr", "legal"}}},
+			want:  `{"must":[` + owner + `,{"key":"tags","match":{"any":["hr","legal"]}}]}`,
+		},
+		{
+			name: "negated conditions go to must_not",
+			conds: []FilterCondition{
+				{Field: FilterTag, Op: FilterNotIn, Values: []string{"hr"}},
+				{Field: FilterSource, Op: FilterNe, Values: []string{"a.go"}},
+				{Field: "team", Op: FilterEq, Values: []string{"infra"}},
+			},
+			want: `{"must":[` + owner + `,{"key":"metadata.team","match":{"any":["infra"]}}],` +
+				`"must_not":[{"key":"tags","match":{"any":["hr"]}},{"key":"metadata.source","match":{"any":["a.go"]}}]}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := json.Marshal(qdrantFilter(VectorFilter{UserID: 7, TabIDs: []uint{1, 2}, Conditions: tc.conds}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameJSON(t, got, []byte(tc.want)) {
+				t.Errorf("got  %s\nwant %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func sameJSON(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var x, y interface{}
+	if err := json.Unmarshal(a, &x); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &y); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+func TestMemoryVectorStoreFilters(t *testing.T) {
+	m := &MemoryVectorStore{}
+	records := []VectorRecord{
+		{ID: 1, UserID: 7, TabID: 1, Vector: []float32{1, 0}, Tags: []string{"hr"}, Metadata: map[string]string{"team": "infra"}, CreatedAt: filterTime.AddDate(0, 0, -1)},
+		{ID: 2, UserID: 7, TabID: 1, Vector: []float32{0, 1}, Tags: []string{"legal"}, CreatedAt: filterTime.AddDate(0, 0, 1)},
+		{ID: 3, UserID: 7, TabID: 2, Vector: []float32{1, 0}, Metadata: map[string]string{"team": "web"}, CreatedAt: filterTime},
+		//someone else's, never returned
+		{ID: 4, UserID: 8, TabID: 1, Vector: []float32{1, 0}, Tags: []string{"hr"}, CreatedAt: filterTime},
+	}
+	if err := m.Upsert(KindDocuments, records); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		tabs  []uint
+		conds []FilterCondition
+		want  []uint
+	}{
+		{"tab", []uint{1}, nil, []uint{1, 2}},
+		{"tabs", []uint{1, 2}, nil, []uint{3, 1, 2}},
+		{"tag in", []uint{1, 2}, []FilterCondition{{Field: FilterTag, Op: FilterIn, Values: []string{"hr"}}}, []uint{1}},
+		{"tag not in", []uint{1, 2}, []FilterCondition{{Field: FilterTag, Op: FilterNotIn, Values: []string{"hr"}}}, []uint{3, 2}},
+		{"metadata", []uint{1, 2}, []FilterCondition{{Field: "team", Op: FilterEq, Values: []string{"infra"}}}, []uint{1}},
+		{"metadata not equal keeps missing keys", []uint{1, 2}, []FilterCondition{{Field: "team", Op: FilterNe, Values: []string{"infra"}}}, []uint{3, 2}},
+		{"created after", []uint{1, 2}, []FilterCondition{{Field: FilterCreatedAfter, Time: filterTime}}, []uint{3, 2}},
+		{"created before", []uint{1, 2}, []FilterCondition{{Field: FilterCreatedBefore, Time: filterTime}}, []uint{1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hits, err := m.Search(KindDocuments, []float32{1, 0}, 10, VectorFilter{UserID: 7, TabIDs: tc.tabs, Conditions: tc.conds})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]uint, len(hits))
+			for i, h := range hits {
+				got[i] = h.ID
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	if err := m.DeleteWhere(KindDocuments, VectorFilter{UserID: 7, TabIDs: []uint{1}}); err != nil {
+		t.Fatal(err)
+	}
+	hits, _ := m.Search(KindDocuments, []float32{1, 0}, 10, VectorFilter{UserID: 7, TabIDs: []uint{1, 2}})
+	if len(hits) != 1 || hits[0].ID != 3 {
+		t.Errorf("after deleting tab 1 got %v, want only 3", hits)
+	}
+}
+
+func TestQdrantSearch(t *testing.T) {
+	var body map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/collections/test_documents/points/search" || r.Header.Get("api-key") != "secret" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Write([]byte(`{"result":[{"id":3,"score":0.9},{"id":1,"score":0.5}]}`))
+	}))
+	defer srv.Close()
+
+	q := &QdrantStore{BaseURL: srv.URL, APIKey: "secret", Prefix: "test_"}
+	filter := VectorFilter{UserID: 7, TabIDs: []uint{1}}
+	hits, err := q.Search(KindDocuments, []float32{1, 0}, 2, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []VectorHit{{ID: 3, Score: 0.9}, {ID: 1, Score: 0.5}}; !reflect.DeepEqual(hits, want) {
+		t.Errorf("got %v, want %v", hits, want)
+	}
+	sent, _ := json.Marshal(body["filter"])
+	want, _ := json.Marshal(qdrantFilter(filter))
+	if !sameJSON(t, sent, want) {
+		t.Errorf("sent filter %s, want %s", sent, want)
+	}
+
+	//a collection that doesn't exist yet has nothing to find
+	q.Prefix = "missing_"
+	if hits, err := q.Search(KindDocuments, []float32{1, 0}, 2, filter); err != nil || hits != nil {
+		t.Errorf("missing collection: got %v, %v, want no hits and no error", hits, err)
+	}
+}
+
+func TestQdrantTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	q := &QdrantStore{BaseURL: srv.URL, HTTP: &http.Client{Timeout: 50 * time.Millisecond}}
+	done := make(chan error, 1)
+	go func() {
+		_, err := q.Search(KindDocuments, []float32{1, 0}, 2, VectorFilter{UserID: 7, TabIDs: []uint{1}})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		var timeout interface{ Timeout() bool }
+		if !errors.As(err, &timeout) || !timeout.Timeout() {
+			t.Errorf("got %v, want a timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("search against a hung qdrant didn't return")
+	}
+}